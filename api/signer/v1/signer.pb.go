@@ -0,0 +1,359 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.11-devel
+// 	protoc        (unknown)
+// source: api/signer/v1/signer.proto
+
+// The signer protocol lets an external process act as the CA of trustd.
+//
+// trustd connects to the plugin over a Unix socket, builds each certificate
+// itself and asks the plugin to sign its TBS (to-be-signed) part. The plugin
+// should also serve grpc.health.v1.Health for the SignerService.
+
+package signerv1
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+// Hash is the hash function used to compute a digest.
+type Hash int32
+
+const (
+	// The message is signed as a whole, as with Ed25519.
+	Hash_HASH_NONE   Hash = 0
+	Hash_HASH_SHA256 Hash = 1
+	Hash_HASH_SHA384 Hash = 2
+	Hash_HASH_SHA512 Hash = 3
+)
+
+// Enum value maps for Hash.
+var (
+	Hash_name = map[int32]string{
+		0: "HASH_NONE",
+		1: "HASH_SHA256",
+		2: "HASH_SHA384",
+		3: "HASH_SHA512",
+	}
+	Hash_value = map[string]int32{
+		"HASH_NONE":   0,
+		"HASH_SHA256": 1,
+		"HASH_SHA384": 2,
+		"HASH_SHA512": 3,
+	}
+)
+
+func (x Hash) Enum() *Hash {
+	p := new(Hash)
+	*p = x
+	return p
+}
+
+func (x Hash) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (Hash) Descriptor() protoreflect.EnumDescriptor {
+	return file_api_signer_v1_signer_proto_enumTypes[0].Descriptor()
+}
+
+func (Hash) Type() protoreflect.EnumType {
+	return &file_api_signer_v1_signer_proto_enumTypes[0]
+}
+
+func (x Hash) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use Hash.Descriptor instead.
+func (Hash) EnumDescriptor() ([]byte, []int) {
+	return file_api_signer_v1_signer_proto_rawDescGZIP(), []int{0}
+}
+
+type GetPublicChainRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetPublicChainRequest) Reset() {
+	*x = GetPublicChainRequest{}
+	mi := &file_api_signer_v1_signer_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetPublicChainRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetPublicChainRequest) ProtoMessage() {}
+
+func (x *GetPublicChainRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_api_signer_v1_signer_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetPublicChainRequest.ProtoReflect.Descriptor instead.
+func (*GetPublicChainRequest) Descriptor() ([]byte, []int) {
+	return file_api_signer_v1_signer_proto_rawDescGZIP(), []int{0}
+}
+
+type GetPublicChainResponse struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// DER certificates, starting with the signing CA and going towards the
+	// root. The root may be omitted.
+	Certificates  [][]byte `protobuf:"bytes,1,rep,name=certificates,proto3" json:"certificates,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetPublicChainResponse) Reset() {
+	*x = GetPublicChainResponse{}
+	mi := &file_api_signer_v1_signer_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetPublicChainResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetPublicChainResponse) ProtoMessage() {}
+
+func (x *GetPublicChainResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_api_signer_v1_signer_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetPublicChainResponse.ProtoReflect.Descriptor instead.
+func (*GetPublicChainResponse) Descriptor() ([]byte, []int) {
+	return file_api_signer_v1_signer_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *GetPublicChainResponse) GetCertificates() [][]byte {
+	if x != nil {
+		return x.Certificates
+	}
+	return nil
+}
+
+type SignRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Digest of the TBS data, or the TBS data itself with HASH_NONE.
+	Digest []byte `protobuf:"bytes,1,opt,name=digest,proto3" json:"digest,omitempty"`
+	Hash   Hash   `protobuf:"varint,2,opt,name=hash,proto3,enum=trustd.signer.v1.Hash" json:"hash,omitempty"`
+	// If not zero, requests an RSA-PSS signature with this salt
+	// length; -1 means as long as the digest.
+	PssSaltLength int32 `protobuf:"varint,3,opt,name=pss_salt_length,json=pssSaltLength,proto3" json:"pss_salt_length,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SignRequest) Reset() {
+	*x = SignRequest{}
+	mi := &file_api_signer_v1_signer_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SignRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SignRequest) ProtoMessage() {}
+
+func (x *SignRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_api_signer_v1_signer_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SignRequest.ProtoReflect.Descriptor instead.
+func (*SignRequest) Descriptor() ([]byte, []int) {
+	return file_api_signer_v1_signer_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *SignRequest) GetDigest() []byte {
+	if x != nil {
+		return x.Digest
+	}
+	return nil
+}
+
+func (x *SignRequest) GetHash() Hash {
+	if x != nil {
+		return x.Hash
+	}
+	return Hash_HASH_NONE
+}
+
+func (x *SignRequest) GetPssSaltLength() int32 {
+	if x != nil {
+		return x.PssSaltLength
+	}
+	return 0
+}
+
+type SignResponse struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Signature in the encoding of crypto.Signer: ASN.1 for ECDSA, raw bytes
+	// for RSA and Ed25519.
+	Signature     []byte `protobuf:"bytes,1,opt,name=signature,proto3" json:"signature,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SignResponse) Reset() {
+	*x = SignResponse{}
+	mi := &file_api_signer_v1_signer_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SignResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SignResponse) ProtoMessage() {}
+
+func (x *SignResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_api_signer_v1_signer_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SignResponse.ProtoReflect.Descriptor instead.
+func (*SignResponse) Descriptor() ([]byte, []int) {
+	return file_api_signer_v1_signer_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *SignResponse) GetSignature() []byte {
+	if x != nil {
+		return x.Signature
+	}
+	return nil
+}
+
+var File_api_signer_v1_signer_proto protoreflect.FileDescriptor
+
+const file_api_signer_v1_signer_proto_rawDesc = "" +
+	"\n" +
+	"\x1aapi/signer/v1/signer.proto\x12\x10trustd.signer.v1\"\x17\n" +
+	"\x15GetPublicChainRequest\"<\n" +
+	"\x16GetPublicChainResponse\x12\"\n" +
+	"\fcertificates\x18\x01 \x03(\fR\fcertificates\"y\n" +
+	"\vSignRequest\x12\x16\n" +
+	"\x06digest\x18\x01 \x01(\fR\x06digest\x12*\n" +
+	"\x04hash\x18\x02 \x01(\x0e2\x16.trustd.signer.v1.HashR\x04hash\x12&\n" +
+	"\x0fpss_salt_length\x18\x03 \x01(\x05R\rpssSaltLength\",\n" +
+	"\fSignResponse\x12\x1c\n" +
+	"\tsignature\x18\x01 \x01(\fR\tsignature*H\n" +
+	"\x04Hash\x12\r\n" +
+	"\tHASH_NONE\x10\x00\x12\x0f\n" +
+	"\vHASH_SHA256\x10\x01\x12\x0f\n" +
+	"\vHASH_SHA384\x10\x02\x12\x0f\n" +
+	"\vHASH_SHA512\x10\x032\xbb\x01\n" +
+	"\rSignerService\x12c\n" +
+	"\x0eGetPublicChain\x12'.trustd.signer.v1.GetPublicChainRequest\x1a(.trustd.signer.v1.GetPublicChainResponse\x12E\n" +
+	"\x04Sign\x12\x1d.trustd.signer.v1.SignRequest\x1a\x1e.trustd.signer.v1.SignResponseB?Z=github.com/cozystack/standalone-trustd/api/signer/v1;signerv1b\x06proto3"
+
+var (
+	file_api_signer_v1_signer_proto_rawDescOnce sync.Once
+	file_api_signer_v1_signer_proto_rawDescData []byte
+)
+
+func file_api_signer_v1_signer_proto_rawDescGZIP() []byte {
+	file_api_signer_v1_signer_proto_rawDescOnce.Do(func() {
+		file_api_signer_v1_signer_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_api_signer_v1_signer_proto_rawDesc), len(file_api_signer_v1_signer_proto_rawDesc)))
+	})
+	return file_api_signer_v1_signer_proto_rawDescData
+}
+
+var file_api_signer_v1_signer_proto_enumTypes = make([]protoimpl.EnumInfo, 1)
+var file_api_signer_v1_signer_proto_msgTypes = make([]protoimpl.MessageInfo, 4)
+var file_api_signer_v1_signer_proto_goTypes = []any{
+	(Hash)(0),                      // 0: trustd.signer.v1.Hash
+	(*GetPublicChainRequest)(nil),  // 1: trustd.signer.v1.GetPublicChainRequest
+	(*GetPublicChainResponse)(nil), // 2: trustd.signer.v1.GetPublicChainResponse
+	(*SignRequest)(nil),            // 3: trustd.signer.v1.SignRequest
+	(*SignResponse)(nil),           // 4: trustd.signer.v1.SignResponse
+}
+var file_api_signer_v1_signer_proto_depIdxs = []int32{
+	0, // 0: trustd.signer.v1.SignRequest.hash:type_name -> trustd.signer.v1.Hash
+	1, // 1: trustd.signer.v1.SignerService.GetPublicChain:input_type -> trustd.signer.v1.GetPublicChainRequest
+	3, // 2: trustd.signer.v1.SignerService.Sign:input_type -> trustd.signer.v1.SignRequest
+	2, // 3: trustd.signer.v1.SignerService.GetPublicChain:output_type -> trustd.signer.v1.GetPublicChainResponse
+	4, // 4: trustd.signer.v1.SignerService.Sign:output_type -> trustd.signer.v1.SignResponse
+	3, // [3:5] is the sub-list for method output_type
+	1, // [1:3] is the sub-list for method input_type
+	1, // [1:1] is the sub-list for extension type_name
+	1, // [1:1] is the sub-list for extension extendee
+	0, // [0:1] is the sub-list for field type_name
+}
+
+func init() { file_api_signer_v1_signer_proto_init() }
+func file_api_signer_v1_signer_proto_init() {
+	if File_api_signer_v1_signer_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_api_signer_v1_signer_proto_rawDesc), len(file_api_signer_v1_signer_proto_rawDesc)),
+			NumEnums:      1,
+			NumMessages:   4,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_api_signer_v1_signer_proto_goTypes,
+		DependencyIndexes: file_api_signer_v1_signer_proto_depIdxs,
+		EnumInfos:         file_api_signer_v1_signer_proto_enumTypes,
+		MessageInfos:      file_api_signer_v1_signer_proto_msgTypes,
+	}.Build()
+	File_api_signer_v1_signer_proto = out.File
+	file_api_signer_v1_signer_proto_goTypes = nil
+	file_api_signer_v1_signer_proto_depIdxs = nil
+}
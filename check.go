@@ -0,0 +1,143 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/cozystack/standalone-trustd/internal/pki"
+	"github.com/cozystack/standalone-trustd/internal/tenant"
+)
+
+// errCheckFailed is returned by the check command when errors were found.
+var errCheckFailed = errors.New("key material check failed")
+
+// checkOptions returns the options of key material checks.
+func checkOptions(addresses []string) pki.CheckOptions {
+	return pki.CheckOptions{
+		ExpiryWarning: *expiryWarning,
+		CertValidity:  *certValidity,
+		Addresses:     addresses,
+	}
+}
+
+// startupCheck checks key material before it is served, logging the
+// problems found. Errors fail the startup with --startup-check=enforce.
+func startupCheck(name string, m *pki.Material, addresses []string) error {
+	if *startupCheckMode == "off" {
+		return nil
+	}
+
+	report := m.Check(checkOptions(addresses))
+
+	for _, f := range report.Problems() {
+		level := slog.LevelWarn
+		if f.Severity == pki.SeverityError {
+			level = slog.LevelError
+		}
+
+		slog.Log(context.Background(), level, "startup check found a problem", "name", name, "subject", f.Subject, "finding", f.Message)
+	}
+
+	if report.Failed() && *startupCheckMode == "enforce" {
+		return fmt.Errorf("%s: startup check failed, see the errors above or run the check command", name)
+	}
+
+	return nil
+}
+
+// runCheck implements the check command: it checks the key material
+// configured by the same flags as serve, or every tenant with --tenants-dir,
+// prints the findings and fails if any of them is an error.
+func runCheck() error {
+	if *tenantsDir != "" {
+		return checkTenants()
+	}
+
+	if *caCert == "" && *caDir == "" && *serverCert == "" && *acceptedCAs == "" {
+		return fmt.Errorf("--ca-cert, --ca-dir, --accepted-cas or --server-cert is required")
+	}
+
+	caSigner, caKeyFile, closeCAKey, err := openCAKey()
+	if err != nil {
+		return err
+	}
+	defer closeCAKey()
+
+	if !printCheck("key material", func() (*pki.Store, error) {
+		return pki.Load(keyMaterialFiles(caSigner, caKeyFile))
+	}, splitList(*advertiseAddresses)) {
+		return errCheckFailed
+	}
+
+	return nil
+}
+
+// checkTenants checks the fallback server certificate and every tenant.
+func checkTenants() error {
+	if err := validateTenantFlags(); err != nil {
+		return err
+	}
+
+	ok := true
+
+	if *serverCert != "" || *clientCAs != "" {
+		ok = printCheck("fallback server certificate", func() (*pki.Store, error) {
+			return pki.Load(pki.Files{ServerCert: *serverCert, ServerKey: *serverKey, ClientCAs: *clientCAs})
+		}, splitList(*advertiseAddresses))
+	}
+
+	configs, err := tenant.LoadDir(*tenantsDir)
+	if err != nil {
+		if configs == nil {
+			return err
+		}
+
+		fmt.Printf("ERROR   tenants: %v\n", err)
+
+		ok = false
+	}
+
+	for _, cfg := range configs {
+		ok = printCheck("tenant "+cfg.Name, func() (*pki.Store, error) {
+			store, closeKey, err := loadTenantMaterial(cfg)
+			if err == nil {
+				closeKey()
+			}
+
+			return store, err
+		}, cfg.ServerNames) && ok
+	}
+
+	if !ok {
+		return errCheckFailed
+	}
+
+	return nil
+}
+
+// printCheck loads and checks key material, printing a section with the
+// findings. It reports whether the material is free of errors.
+func printCheck(name string, load func() (*pki.Store, error), addresses []string) bool {
+	fmt.Printf("== %s\n", name)
+
+	store, err := load()
+	if err != nil {
+		fmt.Printf("ERROR   %s: %v\n\n", name, err)
+
+		return false
+	}
+
+	report := store.Current().Check(checkOptions(addresses))
+
+	report.WriteTo(os.Stdout)
+	fmt.Println()
+
+	return !report.Failed()
+}
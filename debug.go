@@ -0,0 +1,138 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+
+	"github.com/cozystack/standalone-trustd/internal/logging"
+	"github.com/cozystack/standalone-trustd/internal/metrics"
+)
+
+// version is set at build time with -ldflags "-X main.version=...", the
+// module version from the build info is used otherwise.
+var version string
+
+// readiness tracks what /readyz waits for.
+type readiness struct {
+	keyMaterial atomic.Bool
+	serving     atomic.Bool
+}
+
+// ServeHTTP implements /readyz: ready once the key material is loaded and the
+// gRPC server is serving, and no longer once it shuts down.
+func (r *readiness) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	switch {
+	case !r.keyMaterial.Load():
+		http.Error(w, "key material not loaded", http.StatusServiceUnavailable)
+	case !r.serving.Load():
+		http.Error(w, "gRPC server not serving", http.StatusServiceUnavailable)
+	default:
+		fmt.Fprintln(w, "ok")
+	}
+}
+
+// buildInfo is the response of /version.
+type buildInfo struct {
+	Version   string `json:"version"`
+	GoVersion string `json:"goVersion"`
+	Platform  string `json:"platform"`
+	Revision  string `json:"revision,omitempty"`
+	Time      string `json:"time,omitempty"`
+	Modified  bool   `json:"modified,omitempty"`
+}
+
+// readBuildInfo returns the build metadata of the binary.
+func readBuildInfo() buildInfo {
+	info := buildInfo{
+		Version:   version,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+	}
+
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+
+	if info.Version == "" {
+		info.Version = bi.Main.Version
+	}
+
+	for _, setting := range bi.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			info.Revision = setting.Value
+		case "vcs.time":
+			info.Time = setting.Value
+		case "vcs.modified":
+			info.Modified = setting.Value == "true"
+		}
+	}
+
+	return info
+}
+
+// registerDebugHandlers adds the health, readiness, metrics and build info
+// endpoints to the debug server, which relying parties reach for the CRL and
+// OCSP as well.
+func registerDebugHandlers(mux *http.ServeMux, ready *readiness) {
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.Handle("/readyz", ready)
+
+	mux.HandleFunc("/version", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(readBuildInfo())
+	})
+
+	mux.Handle("/metrics", metrics.Handler())
+}
+
+// registerAdminHandlers adds the log level and profiling endpoints to the
+// admin server. The command line isn't served, as it may hold a token.
+func registerAdminHandlers(mux *http.ServeMux) {
+	mux.Handle("/loglevel", logging.LevelHandler())
+
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+}
+
+// startHTTPServer serves plain HTTP endpoints (health, CRL, pprof, ...) on
+// addr. A failure to listen is returned, a later failure is sent to errChan.
+func startHTTPServer(name, addr string, handler http.Handler, errChan chan<- error) (*http.Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s listener: %w", name, err)
+	}
+
+	srv := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	slog.Debug(name+" server listening", "addr", listener.Addr().String())
+
+	go func() {
+		if err := srv.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			errChan <- fmt.Errorf("%s server failed: %w", name, err)
+		}
+	}()
+
+	return srv, nil
+}
@@ -0,0 +1,108 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+
+	securityapi "github.com/siderolabs/talos/pkg/machinery/api/security"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+
+	"github.com/cozystack/standalone-trustd/internal/pki"
+)
+
+// healthCheckInterval is how often the key material is checked for the
+// status of the SecurityService.
+const healthCheckInterval = 10 * time.Second
+
+// isHealthCheck reports whether a method belongs to the health service.
+func isHealthCheck(fullMethod string) bool {
+	return strings.HasPrefix(fullMethod, "/"+healthpb.Health_ServiceDesc.ServiceName+"/")
+}
+
+// watchHealth sets the status of the SecurityService in the health server
+// every healthCheckInterval, until the context is canceled: serving while
+// the key material of at least one of stores, keyed by tenant, is free of
+// errors. The overall status, the empty service name, stays serving until
+// shutdown.
+func watchHealth(ctx context.Context, hs *health.Server, stores map[string]*pki.Store) {
+	service := securityapi.SecurityService_ServiceDesc.ServiceName
+
+	hs.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+
+	ticker := time.NewTicker(healthCheckInterval)
+	defer ticker.Stop()
+
+	var last healthpb.HealthCheckResponse_ServingStatus
+
+	for {
+		status := keyMaterialStatus(stores)
+		if status != last {
+			slog.Info("health status changed", "service", service, "status", status.String())
+
+			hs.SetServingStatus(service, status)
+			last = status
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// keyMaterialStatus checks the current key material of stores, logging the
+// errors found.
+func keyMaterialStatus(stores map[string]*pki.Store) healthpb.HealthCheckResponse_ServingStatus {
+	status := healthpb.HealthCheckResponse_NOT_SERVING
+
+	for name, store := range stores {
+		report := store.Current().Check(checkOptions(nil))
+		if !report.Failed() {
+			status = healthpb.HealthCheckResponse_SERVING
+
+			continue
+		}
+
+		for _, f := range report.Problems() {
+			if f.Severity == pki.SeverityError {
+				slog.Debug("key material not valid", "tenant", name, "subject", f.Subject, "finding", f.Message)
+			}
+		}
+	}
+
+	return status
+}
+
+// startHealthServer serves the health service without TLS on port, for
+// Kubernetes gRPC probes which can't use TLS. A failure to listen is
+// returned, a later failure is sent to errChan.
+func startHealthServer(port int, hs *health.Server, errChan chan<- error) (*grpc.Server, error) {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create health listener: %w", err)
+	}
+
+	srv := grpc.NewServer()
+	healthpb.RegisterHealthServer(srv, hs)
+
+	slog.Debug("health server listening", "port", port)
+
+	go func() {
+		if err := srv.Serve(listener); err != nil {
+			errChan <- fmt.Errorf("health server failed: %w", err)
+		}
+	}()
+
+	return srv, nil
+}
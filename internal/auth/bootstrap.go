@@ -0,0 +1,155 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"regexp"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Bootstrap token Secret layout, see
+// https://kubernetes.io/docs/reference/access-authn-authz/bootstrap-tokens/.
+const (
+	BootstrapTokenNamespace  = metav1.NamespaceSystem
+	BootstrapTokenSecretType = corev1.SecretType("bootstrap.kubernetes.io/token")
+
+	bootstrapTokenSecretPrefix  = "bootstrap-token-"
+	bootstrapTokenIDKey         = "token-id"
+	bootstrapTokenSecretKey     = "token-secret"
+	bootstrapTokenExpirationKey = "expiration"
+	bootstrapTokenUsageAuthKey  = "usage-bootstrap-authentication"
+)
+
+// DefaultBootstrapTokenCacheTTL is used when BootstrapTokens.CacheTTL is zero.
+const DefaultBootstrapTokenCacheTTL = 30 * time.Second
+
+var bootstrapTokenRE = regexp.MustCompile(`^([a-z0-9]{6})\.([a-z0-9]{16})$`)
+
+// BootstrapTokens authenticates clients against Kubernetes bootstrap tokens,
+// so that trustd tokens share the lifecycle of `kubeadm token create`.
+//
+// A token `<id>.<secret>` is accepted if the Secret bootstrap-token-<id>
+// exists, matches the secret, has not expired and is marked for
+// authentication usage.
+type BootstrapTokens struct {
+	Client kubernetes.Interface
+	// Namespace holding the token Secrets, BootstrapTokenNamespace if empty.
+	Namespace string
+	// CacheTTL is how long a Secret lookup, including a missing Secret, is
+	// reused; DefaultBootstrapTokenCacheTTL if zero.
+	CacheTTL time.Duration
+
+	mu    sync.Mutex
+	cache map[string]bootstrapTokenEntry
+}
+
+type bootstrapTokenEntry struct {
+	secret  *corev1.Secret // nil if the Secret does not exist
+	fetched time.Time
+}
+
+// Authenticate implements Authenticator.
+func (b *BootstrapTokens) Authenticate(ctx context.Context, token string, _ net.Addr) (*Identity, error) {
+	m := bootstrapTokenRE.FindStringSubmatch(token)
+	if m == nil {
+		return nil, ErrInvalidToken
+	}
+
+	id, tokenSecret := m[1], m[2]
+	name := bootstrapTokenSecretPrefix + id
+
+	secret, err := b.lookup(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if secret == nil || secret.Type != BootstrapTokenSecretType || secret.DeletionTimestamp != nil {
+		return nil, ErrInvalidToken
+	}
+
+	if string(secret.Data[bootstrapTokenIDKey]) != id ||
+		subtle.ConstantTimeCompare(secret.Data[bootstrapTokenSecretKey], []byte(tokenSecret)) != 1 {
+		return nil, ErrInvalidToken
+	}
+
+	if expiration := secret.Data[bootstrapTokenExpirationKey]; len(expiration) > 0 {
+		expires, err := time.Parse(time.RFC3339, string(expiration))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s has an invalid expiration %q", ErrInvalidToken, name, expiration)
+		}
+
+		if time.Now().After(expires) {
+			return nil, fmt.Errorf("%w: %s", ErrTokenExpired, name)
+		}
+	}
+
+	if string(secret.Data[bootstrapTokenUsageAuthKey]) != "true" {
+		return nil, fmt.Errorf("%w: %s is not usable for authentication", ErrInvalidToken, name)
+	}
+
+	return &Identity{TokenName: name}, nil
+}
+
+// lookup returns the named Secret, or nil if it does not exist, going to the
+// API server at most once per CacheTTL.
+func (b *BootstrapTokens) lookup(ctx context.Context, name string) (*corev1.Secret, error) {
+	ttl := b.CacheTTL
+	if ttl == 0 {
+		ttl = DefaultBootstrapTokenCacheTTL
+	}
+
+	now := time.Now()
+
+	b.mu.Lock()
+
+	if entry, ok := b.cache[name]; ok && now.Sub(entry.fetched) < ttl {
+		b.mu.Unlock()
+
+		return entry.secret, nil
+	}
+
+	b.mu.Unlock()
+
+	namespace := b.Namespace
+	if namespace == "" {
+		namespace = BootstrapTokenNamespace
+	}
+
+	secret, err := b.Client.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+	switch {
+	case apierrors.IsNotFound(err):
+		secret = nil
+	case err != nil:
+		return nil, fmt.Errorf("failed to get bootstrap token %s/%s: %w", namespace, name, err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.cache == nil {
+		b.cache = map[string]bootstrapTokenEntry{}
+	}
+
+	// drop stale entries, lookups of unknown token IDs are cached as well
+	for key, entry := range b.cache {
+		if now.Sub(entry.fetched) >= ttl {
+			delete(b.cache, key)
+		}
+	}
+
+	b.cache[name] = bootstrapTokenEntry{secret: secret, fetched: now}
+
+	return secret, nil
+}
@@ -0,0 +1,105 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package auth_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/cozystack/standalone-trustd/internal/auth"
+)
+
+func bootstrapTokenSecret(id, secret string, extra map[string]string) *corev1.Secret {
+	data := map[string][]byte{
+		"token-id":                       []byte(id),
+		"token-secret":                   []byte(secret),
+		"usage-bootstrap-authentication": []byte("true"),
+	}
+
+	for k, v := range extra {
+		data[k] = []byte(v)
+	}
+
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "bootstrap-token-" + id,
+			Namespace: auth.BootstrapTokenNamespace,
+		},
+		Type: auth.BootstrapTokenSecretType,
+		Data: data,
+	}
+}
+
+func TestBootstrapTokens(t *testing.T) {
+	ctx := context.Background()
+
+	client := fake.NewClientset(
+		bootstrapTokenSecret("2k882v", "z2vi7kefznukil1o", nil),
+		bootstrapTokenSecret("expird", "0123456789abcdef", map[string]string{
+			"expiration": time.Now().Add(-time.Hour).Format(time.RFC3339),
+		}),
+		bootstrapTokenSecret("future", "0123456789abcdef", map[string]string{
+			"expiration": time.Now().Add(time.Hour).Format(time.RFC3339),
+		}),
+		bootstrapTokenSecret("nousag", "0123456789abcdef", map[string]string{
+			"usage-bootstrap-authentication": "false",
+		}),
+	)
+
+	authenticator := &auth.BootstrapTokens{Client: client}
+
+	id, err := authenticator.Authenticate(ctx, "2k882v.z2vi7kefznukil1o", workerAddr)
+	require.NoError(t, err)
+	assert.Equal(t, "bootstrap-token-2k882v", id.TokenName)
+
+	_, err = authenticator.Authenticate(ctx, "future.0123456789abcdef", workerAddr)
+	assert.NoError(t, err)
+
+	for _, token := range []string{
+		"2k882v.wrongwrongwrongw",
+		"abcdef.0123456789abcdef", // no such secret
+		"nousag.0123456789abcdef",
+		"2k882v",
+		"2K882V.Z2VI7KEFZNUKIL1O",
+	} {
+		_, err = authenticator.Authenticate(ctx, token, workerAddr)
+		assert.ErrorIs(t, err, auth.ErrInvalidToken, token)
+	}
+
+	_, err = authenticator.Authenticate(ctx, "expird.0123456789abcdef", workerAddr)
+	assert.ErrorIs(t, err, auth.ErrTokenExpired)
+}
+
+func TestBootstrapTokensCache(t *testing.T) {
+	ctx := context.Background()
+
+	client := fake.NewClientset(bootstrapTokenSecret("2k882v", "z2vi7kefznukil1o", nil))
+	authenticator := &auth.BootstrapTokens{Client: client, CacheTTL: time.Hour}
+
+	for range 3 {
+		_, err := authenticator.Authenticate(ctx, "2k882v.z2vi7kefznukil1o", workerAddr)
+		require.NoError(t, err)
+	}
+
+	assert.Len(t, client.Actions(), 1)
+
+	// a deleted token keeps working until the cache entry expires
+	require.NoError(t, client.CoreV1().Secrets(auth.BootstrapTokenNamespace).Delete(ctx, "bootstrap-token-2k882v", metav1.DeleteOptions{}))
+
+	_, err := authenticator.Authenticate(ctx, "2k882v.z2vi7kefznukil1o", workerAddr)
+	require.NoError(t, err)
+
+	authenticator = &auth.BootstrapTokens{Client: client, CacheTTL: time.Nanosecond}
+
+	_, err = authenticator.Authenticate(ctx, "2k882v.z2vi7kefznukil1o", workerAddr)
+	assert.ErrorIs(t, err, auth.ErrInvalidToken)
+}
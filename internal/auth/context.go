@@ -0,0 +1,50 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package auth authenticates trustd clients and carries their identity in request contexts.
+package auth
+
+import (
+	"context"
+	"time"
+
+	"github.com/cozystack/standalone-trustd/internal/policy"
+)
+
+// Identity describes the credentials an RPC was authenticated with.
+type Identity struct {
+	// TokenName is the name of the token which authenticated the call.
+	// It never contains the token value.
+	TokenName string
+	// Tenant is the tenant the call was routed to in multi-tenant mode.
+	Tenant string
+	// Policy, if set, further restricts the CSRs the client may submit.
+	Policy *policy.Policy
+	// CertValidity, if non-zero, overrides the validity of issued certificates.
+	CertValidity time.Duration
+}
+
+type identityKey struct{}
+
+// NewContext returns a context carrying the identity.
+func NewContext(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+// FromContext returns the identity stored in the context, if any.
+func FromContext(ctx context.Context) (*Identity, bool) {
+	id, ok := ctx.Value(identityKey{}).(*Identity)
+
+	return id, ok
+}
+
+// TokenName returns the name of the token which authenticated the call, or
+// an empty string for unauthenticated contexts.
+func TokenName(ctx context.Context) string {
+	if id, ok := FromContext(ctx); ok {
+		return id.TokenName
+	}
+
+	return ""
+}
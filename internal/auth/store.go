@@ -0,0 +1,306 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/cozystack/standalone-trustd/internal/policy"
+)
+
+// Authentication failures.
+var (
+	ErrInvalidToken     = errors.New("invalid token")
+	ErrTokenExpired     = errors.New("token expired")
+	ErrSourceNotAllowed = errors.New("source address not allowed for token")
+)
+
+// Authenticator validates the token presented by a client.
+type Authenticator interface {
+	Authenticate(ctx context.Context, token string, peer net.Addr) (*Identity, error)
+}
+
+// Token is a named client token and the restrictions attached to it.
+type Token struct {
+	Name   string `yaml:"name"`
+	Secret string `yaml:"token"`
+	// Expires, if set, is the time after which the token is rejected.
+	Expires time.Time `yaml:"expires"`
+	// AllowedCIDRs restricts the source addresses the token may be used from.
+	AllowedCIDRs []string `yaml:"allowedCIDRs"`
+	// AllowedIPSANs restricts the IP SANs of CSRs authenticated with the token.
+	AllowedIPSANs []string `yaml:"allowedIPSANs"`
+	// AllowedDNSSANs restricts the DNS SANs of CSRs authenticated with the
+	// token, using the patterns of policy.Config.AllowedDNSNames.
+	AllowedDNSSANs []string `yaml:"allowedDNSSANs"`
+	// CertValidity overrides the validity of certificates issued to the token.
+	CertValidity time.Duration `yaml:"certValidity"`
+}
+
+// tokensFile is the on-disk format of a token store.
+type tokensFile struct {
+	Tokens []Token `yaml:"tokens"`
+}
+
+// compiledToken is a validated Token.
+type compiledToken struct {
+	Token
+
+	digest [sha256.Size]byte
+	cidrs  []netip.Prefix
+	policy *policy.Policy
+}
+
+// Store authenticates clients against a set of named tokens.
+//
+// Stores loaded from a file pick up changes to the file on the next
+// authentication, so that tokens can be added and retired without a restart.
+type Store struct {
+	path   string
+	static []Token
+	prefix string
+
+	mu      sync.Mutex
+	modTime time.Time
+	tokens  []compiledToken
+}
+
+// NewStore creates a store holding a fixed set of tokens.
+func NewStore(tokens ...Token) (*Store, error) {
+	s := &Store{static: tokens}
+
+	compiled, err := compileTokens(tokens, "")
+	if err != nil {
+		return nil, err
+	}
+
+	s.tokens = compiled
+
+	return s, nil
+}
+
+// LoadStore creates a store from a YAML tokens file. Additional static
+// tokens (e.g. from --auth-token) are merged with the file contents.
+func LoadStore(path string, static ...Token) (*Store, error) {
+	s := &Store{path: path, static: static}
+
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Authenticate implements Authenticator.
+func (s *Store) Authenticate(_ context.Context, token string, peer net.Addr) (*Identity, error) {
+	digest := sha256.Sum256([]byte(token))
+
+	s.mu.Lock()
+
+	if s.path != "" {
+		if err := s.reloadIfChangedLocked(); err != nil {
+			slog.Warn("failed to reload tokens, keeping previous tokens", "path", s.path, "error", err)
+		}
+	}
+
+	tokens := s.tokens
+	s.mu.Unlock()
+
+	var match *compiledToken
+
+	// compare against every token to keep the timing independent of the match
+	for i := range tokens {
+		if subtle.ConstantTimeCompare(digest[:], tokens[i].digest[:]) == 1 {
+			match = &tokens[i]
+		}
+	}
+
+	if match == nil {
+		return nil, ErrInvalidToken
+	}
+
+	if !match.Expires.IsZero() && time.Now().After(match.Expires) {
+		return nil, fmt.Errorf("%w: %s", ErrTokenExpired, match.Name)
+	}
+
+	if len(match.cidrs) > 0 {
+		addr, ok := PeerAddr(peer)
+		if !ok || !slices.ContainsFunc(match.cidrs, func(p netip.Prefix) bool { return p.Contains(addr) }) {
+			return nil, fmt.Errorf("%w: %s from %v", ErrSourceNotAllowed, match.Name, peer)
+		}
+	}
+
+	return &Identity{
+		TokenName:    match.Name,
+		Policy:       match.policy,
+		CertValidity: match.CertValidity,
+	}, nil
+}
+
+func (s *Store) reload() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.reloadIfChangedLocked()
+}
+
+func (s *Store) reloadIfChangedLocked() error {
+	fi, err := os.Stat(s.path)
+	if err != nil {
+		return fmt.Errorf("failed to stat tokens file: %w", err)
+	}
+
+	if s.tokens != nil && fi.ModTime().Equal(s.modTime) {
+		return nil
+	}
+
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return fmt.Errorf("failed to read tokens file: %w", err)
+	}
+
+	var f tokensFile
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+
+	if err = dec.Decode(&f); err != nil {
+		return fmt.Errorf("failed to parse tokens file %s: %w", s.path, err)
+	}
+
+	compiled, err := compileTokens(append(slices.Clone(s.static), f.Tokens...), s.prefix)
+	if err != nil {
+		return fmt.Errorf("invalid tokens file %s: %w", s.path, err)
+	}
+
+	s.tokens = compiled
+	s.modTime = fi.ModTime()
+
+	return nil
+}
+
+// RequirePrefix rejects tokens not starting with prefix, now and on every
+// reload: a tenant selected by token prefix wouldn't receive the requests of
+// any other token.
+func (s *Store) RequirePrefix(prefix string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, token := range s.tokens {
+		if err := checkPrefix(token.Token, prefix); err != nil {
+			return err
+		}
+	}
+
+	s.prefix = prefix
+
+	return nil
+}
+
+func checkPrefix(token Token, prefix string) error {
+	if !strings.HasPrefix(token.Secret, prefix) {
+		return fmt.Errorf("token %q doesn't start with the prefix %q", token.Name, prefix)
+	}
+
+	return nil
+}
+
+func compileTokens(tokens []Token, prefix string) ([]compiledToken, error) {
+	compiled := make([]compiledToken, 0, len(tokens))
+	names := map[string]struct{}{}
+	digests := map[[sha256.Size]byte]string{}
+
+	for _, token := range tokens {
+		if token.Name == "" {
+			return nil, fmt.Errorf("token without a name")
+		}
+
+		if _, dup := names[token.Name]; dup {
+			return nil, fmt.Errorf("duplicate token name %q", token.Name)
+		}
+
+		names[token.Name] = struct{}{}
+
+		if token.Secret == "" {
+			return nil, fmt.Errorf("token %q has an empty value", token.Name)
+		}
+
+		if err := checkPrefix(token, prefix); err != nil {
+			return nil, err
+		}
+
+		ct := compiledToken{
+			Token:  token,
+			digest: sha256.Sum256([]byte(token.Secret)),
+		}
+
+		// the first match would win, so the identity of a request would depend on the order
+		if other, dup := digests[ct.digest]; dup {
+			return nil, fmt.Errorf("token %q has the same value as token %q", token.Name, other)
+		}
+
+		digests[ct.digest] = token.Name
+
+		for _, cidr := range token.AllowedCIDRs {
+			prefix, err := netip.ParsePrefix(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("token %q: invalid CIDR %q: %w", token.Name, cidr, err)
+			}
+
+			ct.cidrs = append(ct.cidrs, prefix.Masked())
+		}
+
+		if len(token.AllowedIPSANs) > 0 || len(token.AllowedDNSSANs) > 0 {
+			p, err := policy.New(policy.Config{
+				AllowedIPCIDRs:  token.AllowedIPSANs,
+				AllowedDNSNames: token.AllowedDNSSANs,
+			})
+			if err != nil {
+				return nil, fmt.Errorf("token %q: %w", token.Name, err)
+			}
+
+			ct.policy = p
+		}
+
+		compiled = append(compiled, ct)
+	}
+
+	return compiled, nil
+}
+
+// PeerAddr extracts the IP address of a peer network address.
+func PeerAddr(a net.Addr) (netip.Addr, bool) {
+	if a == nil {
+		return netip.Addr{}, false
+	}
+
+	if tcp, ok := a.(*net.TCPAddr); ok {
+		addr, ok := netip.AddrFromSlice(tcp.IP)
+
+		return addr.Unmap(), ok
+	}
+
+	addrPort, err := netip.ParseAddrPort(a.String())
+	if err != nil {
+		return netip.Addr{}, false
+	}
+
+	return addrPort.Addr().Unmap(), true
+}
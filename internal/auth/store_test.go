@@ -0,0 +1,140 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package auth_test
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cozystack/standalone-trustd/internal/auth"
+)
+
+var workerAddr = &net.TCPAddr{IP: net.ParseIP("10.5.0.4"), Port: 30000}
+
+func TestStore(t *testing.T) {
+	ctx := context.Background()
+
+	store, err := auth.NewStore(
+		auth.Token{Name: "default", Secret: "s3cret"},
+		auth.Token{Name: "expired", Secret: "old", Expires: time.Now().Add(-time.Minute)},
+		auth.Token{Name: "restricted", Secret: "net", AllowedCIDRs: []string{"10.5.0.0/24"}},
+		auth.Token{Name: "short", Secret: "short", CertValidity: time.Hour, AllowedDNSSANs: []string{"*.nodes.local"}},
+	)
+	require.NoError(t, err)
+
+	id, err := store.Authenticate(ctx, "s3cret", workerAddr)
+	require.NoError(t, err)
+	assert.Equal(t, "default", id.TokenName)
+	assert.Nil(t, id.Policy)
+
+	_, err = store.Authenticate(ctx, "wrong", workerAddr)
+	assert.ErrorIs(t, err, auth.ErrInvalidToken)
+
+	_, err = store.Authenticate(ctx, "old", workerAddr)
+	assert.ErrorIs(t, err, auth.ErrTokenExpired)
+
+	id, err = store.Authenticate(ctx, "net", workerAddr)
+	require.NoError(t, err)
+	assert.Equal(t, "restricted", id.TokenName)
+
+	_, err = store.Authenticate(ctx, "net", &net.TCPAddr{IP: net.ParseIP("10.6.0.4"), Port: 30000})
+	assert.ErrorIs(t, err, auth.ErrSourceNotAllowed)
+
+	id, err = store.Authenticate(ctx, "short", workerAddr)
+	require.NoError(t, err)
+	assert.Equal(t, time.Hour, id.CertValidity)
+	assert.NotNil(t, id.Policy)
+
+	_, err = auth.NewStore(auth.Token{Name: "a", Secret: "x"}, auth.Token{Name: "a", Secret: "y"})
+	assert.Error(t, err)
+
+	_, err = auth.NewStore(auth.Token{Name: "a", Secret: "x"}, auth.Token{Name: "b", Secret: "x"})
+	assert.ErrorContains(t, err, `token "b" has the same value as token "a"`)
+
+	_, err = auth.NewStore(auth.Token{Name: "a"})
+	assert.Error(t, err)
+}
+
+func TestLoadStoreReload(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "tokens.yaml")
+
+	require.NoError(t, os.WriteFile(path, []byte(`
+tokens:
+  - name: old
+    token: old-secret
+`), 0644))
+
+	store, err := auth.LoadStore(path, auth.Token{Name: "default", Secret: "static"})
+	require.NoError(t, err)
+
+	id, err := store.Authenticate(ctx, "old-secret", workerAddr)
+	require.NoError(t, err)
+	assert.Equal(t, "old", id.TokenName)
+
+	id, err = store.Authenticate(ctx, "static", workerAddr)
+	require.NoError(t, err)
+	assert.Equal(t, "default", id.TokenName)
+
+	// rotate: introduce the new token and retire the old one
+	require.NoError(t, os.WriteFile(path, []byte(`
+tokens:
+  - name: new
+    token: new-secret
+    expires: 2999-01-01T00:00:00Z
+`), 0644))
+	require.NoError(t, os.Chtimes(path, time.Now(), time.Now().Add(time.Second)))
+
+	id, err = store.Authenticate(ctx, "new-secret", workerAddr)
+	require.NoError(t, err)
+	assert.Equal(t, "new", id.TokenName)
+
+	_, err = store.Authenticate(ctx, "old-secret", workerAddr)
+	assert.ErrorIs(t, err, auth.ErrInvalidToken)
+
+	// a broken file keeps the previous tokens
+	require.NoError(t, os.WriteFile(path, []byte("tokens: [{name: x}]\n"), 0644))
+	require.NoError(t, os.Chtimes(path, time.Now(), time.Now().Add(2*time.Second)))
+
+	_, err = store.Authenticate(ctx, "new-secret", workerAddr)
+	assert.NoError(t, err)
+
+	// a file token can't reuse the value of a static one
+	require.NoError(t, os.WriteFile(path, []byte("tokens: [{name: copy, token: static}]\n"), 0644))
+
+	_, err = auth.LoadStore(path, auth.Token{Name: "default", Secret: "static"})
+	assert.ErrorContains(t, err, "same value")
+}
+
+func TestStoreRequirePrefix(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "tokens.yaml")
+
+	require.NoError(t, os.WriteFile(path, []byte("tokens: [{name: worker, token: foo-worker}]\n"), 0644))
+
+	store, err := auth.LoadStore(path, auth.Token{Name: "default", Secret: "foo-static"})
+	require.NoError(t, err)
+	require.NoError(t, store.RequirePrefix("foo-"))
+
+	assert.ErrorContains(t, store.RequirePrefix("bar-"), `token "default" doesn't start with the prefix "bar-"`)
+
+	// a reload with a token of another prefix keeps the previous tokens
+	require.NoError(t, os.WriteFile(path, []byte("tokens: [{name: worker, token: bar-worker}]\n"), 0644))
+	require.NoError(t, os.Chtimes(path, time.Now(), time.Now().Add(time.Second)))
+
+	_, err = store.Authenticate(ctx, "bar-worker", workerAddr)
+	assert.ErrorIs(t, err, auth.ErrInvalidToken)
+
+	id, err := store.Authenticate(ctx, "foo-worker", workerAddr)
+	require.NoError(t, err)
+	assert.Equal(t, "worker", id.TokenName)
+}
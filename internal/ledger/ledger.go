@@ -0,0 +1,334 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package ledger keeps an on-disk record of every certificate issued by trustd.
+package ledger
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite" // registers the "sqlite" driver
+)
+
+const schema = `
+CREATE TABLE IF NOT EXISTS certificates (
+	serial             TEXT PRIMARY KEY,
+	subject            TEXT NOT NULL,
+	dns_names          TEXT NOT NULL,
+	ip_addresses       TEXT NOT NULL,
+	peer               TEXT NOT NULL,
+	token              TEXT NOT NULL,
+	not_before         INTEGER NOT NULL,
+	not_after          INTEGER NOT NULL,
+	public_key_sha256  TEXT NOT NULL,
+	issuer_sha256      TEXT NOT NULL,
+	issued_at          INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS certificates_not_after ON certificates (not_after);
+CREATE TABLE IF NOT EXISTS revocations (
+	serial      TEXT PRIMARY KEY REFERENCES certificates (serial) ON DELETE CASCADE,
+	reason      INTEGER NOT NULL,
+	revoked_at  INTEGER NOT NULL
+);
+`
+
+// ErrNotFound is returned when a serial number is not in the ledger.
+var ErrNotFound = errors.New("certificate not found in ledger")
+
+// ErrAlreadyRevoked is returned when revoking a certificate twice.
+var ErrAlreadyRevoked = errors.New("certificate already revoked")
+
+const recordColumns = `serial, subject, dns_names, ip_addresses, peer, token, not_before, not_after, public_key_sha256, issuer_sha256, issued_at`
+
+// Record describes a single issued certificate.
+type Record struct {
+	Serial               string    `json:"serial"`
+	Subject              string    `json:"subject"`
+	DNSNames             []string  `json:"dnsNames"`
+	IPAddresses          []string  `json:"ipAddresses"`
+	Peer                 string    `json:"peer"`
+	Token                string    `json:"token"`
+	NotBefore            time.Time `json:"notBefore"`
+	NotAfter             time.Time `json:"notAfter"`
+	PublicKeyFingerprint string    `json:"publicKeySHA256"`
+	IssuerFingerprint    string    `json:"issuerSHA256"`
+	IssuedAt             time.Time `json:"issuedAt"`
+}
+
+// NewRecord builds a record for a certificate signed by issuer.
+func NewRecord(cert, issuer *x509.Certificate, peer, token string) Record {
+	ips := make([]string, 0, len(cert.IPAddresses))
+	for _, ip := range cert.IPAddresses {
+		ips = append(ips, ip.String())
+	}
+
+	dnsNames := cert.DNSNames
+	if dnsNames == nil {
+		dnsNames = []string{}
+	}
+
+	return Record{
+		Serial:               SerialString(cert),
+		Subject:              cert.Subject.String(),
+		DNSNames:             dnsNames,
+		IPAddresses:          ips,
+		Peer:                 peer,
+		Token:                token,
+		NotBefore:            cert.NotBefore.UTC(),
+		NotAfter:             cert.NotAfter.UTC(),
+		PublicKeyFingerprint: fingerprint(cert.RawSubjectPublicKeyInfo),
+		IssuerFingerprint:    fingerprint(issuer.Raw),
+		IssuedAt:             time.Now().UTC(),
+	}
+}
+
+// SerialString formats the serial number of a certificate the way the ledger stores it.
+func SerialString(cert *x509.Certificate) string {
+	return FormatSerial(cert.SerialNumber)
+}
+
+// FormatSerial formats a serial number the way the ledger stores it.
+func FormatSerial(serial *big.Int) string {
+	return serial.Text(16)
+}
+
+// ParseSerial normalizes a hexadecimal serial number, optionally colon
+// separated as printed by openssl, to the ledger format.
+func ParseSerial(s string) (string, error) {
+	n, ok := new(big.Int).SetString(strings.ReplaceAll(strings.TrimPrefix(strings.ToLower(s), "0x"), ":", ""), 16)
+	if !ok || n.Sign() <= 0 {
+		return "", fmt.Errorf("invalid serial number %q", s)
+	}
+
+	return n.Text(16), nil
+}
+
+func fingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+
+	return hex.EncodeToString(sum[:])
+}
+
+// Ledger is an SQLite-backed issuance ledger.
+//
+// The database may be opened by several processes at once, e.g. the server and
+// an export command.
+type Ledger struct {
+	db *sql.DB
+}
+
+// Open opens (creating if needed) the ledger at path.
+func Open(path string) (*Ledger, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=foreign_keys(1)")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open ledger %s: %w", path, err)
+	}
+
+	if _, err = db.Exec(schema); err != nil {
+		db.Close()
+
+		return nil, fmt.Errorf("failed to initialize ledger %s: %w", path, err)
+	}
+
+	return &Ledger{db: db}, nil
+}
+
+// Close closes the ledger.
+func (l *Ledger) Close() error {
+	return l.db.Close()
+}
+
+// Add stores an issuance record.
+func (l *Ledger) Add(ctx context.Context, rec Record) error {
+	dnsNames, err := json.Marshal(rec.DNSNames)
+	if err != nil {
+		return err
+	}
+
+	ips, err := json.Marshal(rec.IPAddresses)
+	if err != nil {
+		return err
+	}
+
+	_, err = l.db.ExecContext(ctx,
+		`INSERT INTO certificates (`+recordColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		rec.Serial, rec.Subject, string(dnsNames), string(ips), rec.Peer, rec.Token,
+		rec.NotBefore.Unix(), rec.NotAfter.Unix(), rec.PublicKeyFingerprint, rec.IssuerFingerprint, rec.IssuedAt.Unix(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to record certificate %s: %w", rec.Serial, err)
+	}
+
+	return nil
+}
+
+// Prune removes records of certificates which expired before the cutoff and
+// returns the number of removed records.
+func (l *Ledger) Prune(ctx context.Context, cutoff time.Time) (int64, error) {
+	res, err := l.db.ExecContext(ctx, `DELETE FROM certificates WHERE not_after < ?`, cutoff.Unix())
+	if err != nil {
+		return 0, fmt.Errorf("failed to prune ledger: %w", err)
+	}
+
+	return res.RowsAffected()
+}
+
+// Get returns the record for a serial number.
+func (l *Ledger) Get(ctx context.Context, serial string) (Record, error) {
+	rec, err := scanRecord(l.db.QueryRowContext(ctx, `SELECT `+recordColumns+` FROM certificates WHERE serial = ?`, serial))
+	if errors.Is(err, sql.ErrNoRows) {
+		return rec, fmt.Errorf("%w: %s", ErrNotFound, serial)
+	}
+
+	return rec, err
+}
+
+// Revocation describes a revoked certificate.
+type Revocation struct {
+	Serial    string
+	Reason    int
+	RevokedAt time.Time
+	NotAfter  time.Time
+}
+
+// Revoke marks a recorded certificate as revoked with an RFC 5280 reason code.
+func (l *Ledger) Revoke(ctx context.Context, serial string, reason int, at time.Time) error {
+	if _, err := l.Get(ctx, serial); err != nil {
+		return err
+	}
+
+	res, err := l.db.ExecContext(ctx,
+		`INSERT INTO revocations (serial, reason, revoked_at) VALUES (?, ?, ?) ON CONFLICT (serial) DO NOTHING`,
+		serial, reason, at.Unix())
+	if err != nil {
+		return fmt.Errorf("failed to revoke certificate %s: %w", serial, err)
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("%w: %s", ErrAlreadyRevoked, serial)
+	}
+
+	return nil
+}
+
+// RevocationOf returns the revocation of a serial number, or nil if the
+// certificate has not been revoked.
+func (l *Ledger) RevocationOf(ctx context.Context, serial string) (*Revocation, error) {
+	var (
+		rev                 Revocation
+		revokedAt, notAfter int64
+	)
+
+	err := l.db.QueryRowContext(ctx,
+		`SELECT r.serial, r.reason, r.revoked_at, c.not_after
+		FROM revocations r JOIN certificates c ON c.serial = r.serial
+		WHERE r.serial = ?`, serial).Scan(&rev.Serial, &rev.Reason, &revokedAt, &notAfter)
+
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return nil, nil
+	case err != nil:
+		return nil, fmt.Errorf("failed to query revocation of %s: %w", serial, err)
+	}
+
+	rev.RevokedAt = time.Unix(revokedAt, 0).UTC()
+	rev.NotAfter = time.Unix(notAfter, 0).UTC()
+
+	return &rev, nil
+}
+
+// Revocations lists revoked certificates which have not expired at now.
+func (l *Ledger) Revocations(ctx context.Context, now time.Time) ([]Revocation, error) {
+	rows, err := l.db.QueryContext(ctx,
+		`SELECT r.serial, r.reason, r.revoked_at, c.not_after
+		FROM revocations r JOIN certificates c ON c.serial = r.serial
+		WHERE c.not_after >= ? ORDER BY r.revoked_at, r.serial`, now.Unix())
+	if err != nil {
+		return nil, fmt.Errorf("failed to query revocations: %w", err)
+	}
+	defer rows.Close()
+
+	var revocations []Revocation
+
+	for rows.Next() {
+		var (
+			rev                 Revocation
+			revokedAt, notAfter int64
+		)
+
+		if err = rows.Scan(&rev.Serial, &rev.Reason, &revokedAt, &notAfter); err != nil {
+			return nil, fmt.Errorf("failed to read revocations: %w", err)
+		}
+
+		rev.RevokedAt = time.Unix(revokedAt, 0).UTC()
+		rev.NotAfter = time.Unix(notAfter, 0).UTC()
+
+		revocations = append(revocations, rev)
+	}
+
+	return revocations, rows.Err()
+}
+
+// Export writes all records as JSON lines, ordered by issuance time.
+func (l *Ledger) Export(ctx context.Context, w io.Writer) error {
+	rows, err := l.db.QueryContext(ctx, `SELECT `+recordColumns+` FROM certificates ORDER BY issued_at, serial`)
+	if err != nil {
+		return fmt.Errorf("failed to query ledger: %w", err)
+	}
+	defer rows.Close()
+
+	enc := json.NewEncoder(w)
+
+	for rows.Next() {
+		rec, err := scanRecord(rows)
+		if err != nil {
+			return err
+		}
+
+		if err = enc.Encode(rec); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// scanRecord reads a record selected with recordColumns.
+func scanRecord(row interface{ Scan(...any) error }) (Record, error) {
+	var (
+		rec                           Record
+		dnsNames, ips                 string
+		notBefore, notAfter, issuedAt int64
+	)
+
+	if err := row.Scan(&rec.Serial, &rec.Subject, &dnsNames, &ips, &rec.Peer, &rec.Token,
+		&notBefore, &notAfter, &rec.PublicKeyFingerprint, &rec.IssuerFingerprint, &issuedAt); err != nil {
+		return rec, fmt.Errorf("failed to read ledger: %w", err)
+	}
+
+	if err := json.Unmarshal([]byte(dnsNames), &rec.DNSNames); err != nil {
+		return rec, fmt.Errorf("corrupt record %s: %w", rec.Serial, err)
+	}
+
+	if err := json.Unmarshal([]byte(ips), &rec.IPAddresses); err != nil {
+		return rec, fmt.Errorf("corrupt record %s: %w", rec.Serial, err)
+	}
+
+	rec.NotBefore = time.Unix(notBefore, 0).UTC()
+	rec.NotAfter = time.Unix(notAfter, 0).UTC()
+	rec.IssuedAt = time.Unix(issuedAt, 0).UTC()
+
+	return rec, nil
+}
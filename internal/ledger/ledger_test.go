@@ -0,0 +1,161 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package ledger_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/siderolabs/crypto/x509"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cozystack/standalone-trustd/internal/ledger"
+)
+
+func TestLedger(t *testing.T) {
+	ctx := context.Background()
+
+	ca, err := x509.NewSelfSignedCertificateAuthority(
+		x509.Organization("test-ca"),
+		x509.NotAfter(time.Now().Add(time.Hour)),
+	)
+	require.NoError(t, err)
+
+	issue := func(cn string, notAfter time.Time) ledger.Record {
+		csr, _, err := x509.NewEd25519CSRAndIdentity(
+			x509.CommonName(cn),
+			x509.DNSNames([]string{cn}),
+			x509.IPAddresses([]net.IP{net.ParseIP("10.5.0.4")}),
+		)
+		require.NoError(t, err)
+
+		signed, err := x509.NewCertificateFromCSRBytes(ca.CrtPEM, ca.KeyPEM, csr.X509CertificateRequestPEM,
+			x509.NotBefore(notAfter.Add(-time.Hour)),
+			x509.NotAfter(notAfter),
+		)
+		require.NoError(t, err)
+
+		return ledger.NewRecord(signed.X509Certificate, ca.Crt, "10.5.0.4:30000", "default")
+	}
+
+	path := filepath.Join(t.TempDir(), "ledger.db")
+
+	l, err := ledger.Open(path)
+	require.NoError(t, err)
+
+	t.Cleanup(func() { l.Close() })
+
+	current := issue("current", time.Now().Add(time.Hour))
+	expired := issue("expired", time.Now().Add(-48*time.Hour))
+
+	require.NoError(t, l.Add(ctx, current))
+	require.NoError(t, l.Add(ctx, expired))
+	assert.Error(t, l.Add(ctx, current), "duplicate serials must be rejected")
+
+	// a second handle (e.g. the export command) sees the same data
+	other, err := ledger.Open(path)
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	require.NoError(t, other.Export(ctx, &buf))
+	require.NoError(t, other.Close())
+
+	var exported []ledger.Record
+
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		var rec ledger.Record
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &rec))
+
+		exported = append(exported, rec)
+	}
+
+	require.Len(t, exported, 2)
+
+	got := map[string]ledger.Record{}
+	for _, rec := range exported {
+		got[rec.Serial] = rec
+	}
+
+	rec := got[current.Serial]
+	assert.Equal(t, "CN=current", rec.Subject)
+	assert.Equal(t, []string{"current"}, rec.DNSNames)
+	assert.Equal(t, []string{"10.5.0.4"}, rec.IPAddresses)
+	assert.Equal(t, "10.5.0.4:30000", rec.Peer)
+	assert.Equal(t, "default", rec.Token)
+	assert.Equal(t, current.PublicKeyFingerprint, rec.PublicKeyFingerprint)
+	assert.Equal(t, current.IssuerFingerprint, rec.IssuerFingerprint)
+	assert.True(t, current.NotAfter.Truncate(time.Second).Equal(rec.NotAfter))
+
+	n, err := l.Prune(ctx, time.Now().Add(-24*time.Hour))
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, n)
+
+	buf.Reset()
+	require.NoError(t, l.Export(ctx, &buf))
+	assert.Contains(t, buf.String(), current.Serial)
+	assert.NotContains(t, buf.String(), expired.Serial)
+}
+
+func TestRevoke(t *testing.T) {
+	ctx := context.Background()
+
+	ca, err := x509.NewSelfSignedCertificateAuthority(
+		x509.Organization("test-ca"),
+		x509.NotAfter(time.Now().Add(time.Hour)),
+	)
+	require.NoError(t, err)
+
+	csr, _, err := x509.NewEd25519CSRAndIdentity(x509.CommonName("worker"))
+	require.NoError(t, err)
+
+	signed, err := x509.NewCertificateFromCSRBytes(ca.CrtPEM, ca.KeyPEM, csr.X509CertificateRequestPEM)
+	require.NoError(t, err)
+
+	l, err := ledger.Open(filepath.Join(t.TempDir(), "ledger.db"))
+	require.NoError(t, err)
+
+	t.Cleanup(func() { l.Close() })
+
+	serial := ledger.SerialString(signed.X509Certificate)
+
+	assert.ErrorIs(t, l.Revoke(ctx, serial, 1, time.Now()), ledger.ErrNotFound)
+
+	require.NoError(t, l.Add(ctx, ledger.NewRecord(signed.X509Certificate, ca.Crt, "peer", "default")))
+	require.NoError(t, l.Revoke(ctx, serial, 1, time.Now()))
+	assert.ErrorIs(t, l.Revoke(ctx, serial, 1, time.Now()), ledger.ErrAlreadyRevoked)
+
+	revocations, err := l.Revocations(ctx, time.Now())
+	require.NoError(t, err)
+	require.Len(t, revocations, 1)
+	assert.Equal(t, serial, revocations[0].Serial)
+	assert.Equal(t, 1, revocations[0].Reason)
+
+	// expired certificates drop off the list
+	revocations, err = l.Revocations(ctx, signed.X509Certificate.NotAfter.Add(time.Hour))
+	require.NoError(t, err)
+	assert.Empty(t, revocations)
+
+	// pruning the certificate removes its revocation as well
+	_, err = l.Prune(ctx, signed.X509Certificate.NotAfter.Add(time.Hour))
+	require.NoError(t, err)
+	assert.ErrorIs(t, l.Revoke(ctx, serial, 1, time.Now()), ledger.ErrNotFound)
+}
+
+func TestParseSerial(t *testing.T) {
+	serial, err := ledger.ParseSerial("0A:1B:FF")
+	require.NoError(t, err)
+	assert.Equal(t, "a1bff", serial)
+
+	_, err = ledger.ParseSerial("xyz")
+	assert.Error(t, err)
+}
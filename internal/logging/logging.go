@@ -0,0 +1,269 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package logging sets up structured logging with redaction of secrets.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// LevelTrace is below debug and logs request and response payloads.
+const LevelTrace = slog.LevelDebug - 4
+
+// Redacted replaces secrets in log records.
+const Redacted = "[REDACTED]"
+
+// sensitiveKeys are attribute and metadata keys whose values are secrets.
+var sensitiveKeys = map[string]bool{
+	"token":         true,
+	"authorization": true,
+	"password":      true,
+	"passphrase":    true,
+	"private_key":   true,
+}
+
+// privateKeyPEM matches PEM private keys, encrypted or not.
+var privateKeyPEM = regexp.MustCompile(`(?s)-----BEGIN [A-Z0-9 ]*PRIVATE KEY-----.*?(-----END [A-Z0-9 ]*PRIVATE KEY-----|$)`)
+
+// level is the level of the default logger, adjustable at runtime.
+var level = new(slog.LevelVar)
+
+// ParseLevel parses a level name: trace, debug, info, warn or error.
+func ParseLevel(s string) (slog.Level, error) {
+	if strings.EqualFold(s, "trace") {
+		return LevelTrace, nil
+	}
+
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(s)); err != nil {
+		return 0, fmt.Errorf("unknown log level %q", s)
+	}
+
+	return l, nil
+}
+
+// LevelString formats a level, naming LevelTrace.
+func LevelString(l slog.Level) string {
+	if l == LevelTrace {
+		return "TRACE"
+	}
+
+	return l.String()
+}
+
+// Setup installs the default logger, writing text or JSON records at the
+// level to w. The standard log package is routed through it as well.
+func Setup(w io.Writer, format string, l slog.Level) error {
+	opts := &slog.HandlerOptions{
+		AddSource:   true,
+		Level:       level,
+		ReplaceAttr: replaceAttr,
+	}
+
+	var handler slog.Handler
+
+	switch format {
+	case "text":
+		handler = slog.NewTextHandler(w, opts)
+	case "json":
+		handler = slog.NewJSONHandler(w, opts)
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+
+	level.Set(l)
+	slog.SetDefault(slog.New(&redactingHandler{handler}))
+
+	// slog.SetDefault routes the log package at info level
+	log.SetFlags(0)
+
+	return nil
+}
+
+// ToggleDebugOnSignal switches between the configured level and debug on
+// every SIGUSR1, until the context is canceled.
+func ToggleDebugOnSignal(ctx context.Context) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGUSR1)
+
+	defer signal.Stop(sig)
+
+	configured := level.Level()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sig:
+		}
+
+		if level.Level() == slog.LevelDebug {
+			level.Set(configured)
+		} else {
+			configured = level.Level()
+			level.Set(slog.LevelDebug)
+		}
+
+		slog.Info("log level changed by SIGUSR1", "level", LevelString(level.Level()))
+	}
+}
+
+// LevelHandler serves the level of the default logger: GET returns it, PUT
+// sets it from the body or the level query parameter.
+func LevelHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut, http.MethodPost:
+			value := r.URL.Query().Get("level")
+			if value == "" {
+				body, err := io.ReadAll(io.LimitReader(r.Body, 64))
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+
+					return
+				}
+
+				value = strings.TrimSpace(string(body))
+			}
+
+			l, err := ParseLevel(value)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+
+				return
+			}
+
+			// logged before, so that it isn't filtered by a higher level
+			slog.Info("changing log level", "level", LevelString(l), "remote", r.RemoteAddr)
+			level.Set(l)
+		default:
+			w.Header().Set("Allow", "GET, PUT")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+
+			return
+		}
+
+		fmt.Fprintln(w, LevelString(level.Level()))
+	})
+}
+
+// RedactString masks PEM private keys in s.
+func RedactString(s string) string {
+	if !strings.Contains(s, "PRIVATE KEY-----") {
+		return s
+	}
+
+	return privateKeyPEM.ReplaceAllString(s, Redacted)
+}
+
+// replaceAttr redacts secrets in attributes, names the trace level and
+// shortens the source to file:line.
+func replaceAttr(groups []string, a slog.Attr) slog.Attr {
+	if len(groups) == 0 {
+		switch a.Key {
+		case slog.LevelKey:
+			if l, ok := a.Value.Any().(slog.Level); ok {
+				return slog.String(slog.LevelKey, LevelString(l))
+			}
+		case slog.SourceKey:
+			if src, ok := a.Value.Any().(*slog.Source); ok {
+				return slog.String(slog.SourceKey, fmt.Sprintf("%s:%d", filepath.Base(src.File), src.Line))
+			}
+		}
+	}
+
+	if sensitiveKeys[strings.ToLower(a.Key)] {
+		return slog.String(a.Key, Redacted)
+	}
+
+	a.Value = redactValue(a.Value)
+
+	return a
+}
+
+// redactValue masks private keys in strings and errors, and secrets in gRPC
+// metadata.
+func redactValue(v slog.Value) slog.Value {
+	switch v.Kind() {
+	case slog.KindString:
+		return slog.StringValue(RedactString(v.String()))
+	case slog.KindAny:
+		switch x := v.Any().(type) {
+		case error:
+			return slog.StringValue(RedactString(x.Error()))
+		case metadata.MD:
+			return slog.AnyValue(redactMetadata(x))
+		case map[string][]string:
+			return slog.AnyValue(redactMetadata(x))
+		case []byte:
+			return slog.StringValue(RedactString(string(x)))
+		}
+	}
+
+	return v
+}
+
+// redactMetadata returns a copy of metadata with secret values masked.
+func redactMetadata(md map[string][]string) map[string][]string {
+	redacted := make(map[string][]string, len(md))
+
+	for k, values := range md {
+		if sensitiveKeys[strings.ToLower(k)] {
+			redacted[k] = []string{Redacted}
+
+			continue
+		}
+
+		redacted[k] = values
+	}
+
+	return redacted
+}
+
+// redactingHandler masks private keys in messages, which ReplaceAttr
+// doesn't see.
+type redactingHandler struct {
+	slog.Handler
+}
+
+// Handle implements slog.Handler.
+func (h *redactingHandler) Handle(ctx context.Context, r slog.Record) error {
+	if msg := RedactString(r.Message); msg != r.Message {
+		redacted := slog.NewRecord(r.Time, r.Level, msg, r.PC)
+		r.Attrs(func(a slog.Attr) bool {
+			redacted.AddAttrs(a)
+
+			return true
+		})
+
+		r = redacted
+	}
+
+	return h.Handler.Handle(ctx, r)
+}
+
+// WithAttrs implements slog.Handler.
+func (h *redactingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &redactingHandler{h.Handler.WithAttrs(attrs)}
+}
+
+// WithGroup implements slog.Handler.
+func (h *redactingHandler) WithGroup(name string) slog.Handler {
+	return &redactingHandler{h.Handler.WithGroup(name)}
+}
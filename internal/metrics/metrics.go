@@ -0,0 +1,203 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package metrics exports the Prometheus metrics of trustd.
+package metrics
+
+import (
+	"context"
+	stdx509 "crypto/x509"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+
+	"github.com/cozystack/standalone-trustd/internal/pki"
+)
+
+// Reasons of AuthFailures.
+const (
+	AuthMissingMetadata  = "missing_metadata"
+	AuthMissingToken     = "missing_token"
+	AuthInvalidToken     = "invalid_token"
+	AuthTokenExpired     = "token_expired"
+	AuthSourceNotAllowed = "source_not_allowed"
+	AuthUnknownMethod    = "unknown_method"
+	AuthError            = "error"
+)
+
+// Reasons of CSRsRejected.
+const (
+	RejectInvalidCSR  = "invalid_csr"
+	RejectPeerIP      = "peer_ip"
+	RejectPolicy      = "policy"
+	RejectTokenPolicy = "token_policy"
+	RejectCAExpiry    = "ca_expiry"
+)
+
+var (
+	// RPCs counts handled RPCs by method and status code.
+	RPCs = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "trustd_grpc_requests_total",
+		Help: "gRPC requests handled, by method and status code.",
+	}, []string{"method", "code"})
+
+	// RPCDuration observes the latency of RPCs by method.
+	RPCDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "trustd_grpc_request_duration_seconds",
+		Help:    "Latency of gRPC requests, by method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method"})
+
+	// AuthFailures counts rejected credentials by reason.
+	AuthFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "trustd_auth_failures_total",
+		Help: "Requests rejected by authentication, by reason.",
+	}, []string{"reason"})
+
+	// CSRsRejected counts CSRs refused before signing, by tenant and reason.
+	CSRsRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "trustd_csr_rejected_total",
+		Help: "CSRs rejected before signing, by tenant and reason.",
+	}, []string{"tenant", "reason"})
+
+	// CertificatesIssued counts issued certificates by tenant.
+	CertificatesIssued = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "trustd_certificates_issued_total",
+		Help: "Certificates issued, by tenant.",
+	}, []string{"tenant"})
+
+	// SigningDuration observes the latency of signing by tenant, with the CA
+	// or a backend.
+	SigningDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "trustd_signing_duration_seconds",
+		Help:    "Latency of signing a certificate, by tenant.",
+		Buckets: []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	}, []string{"tenant"})
+
+	expiry = &expiryCollector{stores: map[string]*pki.Store{}}
+)
+
+// Registry holds the metrics of trustd, and of the Go runtime and process.
+var Registry = prometheus.NewRegistry()
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		RPCs, RPCDuration, AuthFailures, CSRsRejected, CertificatesIssued, SigningDuration,
+		expiry,
+	)
+}
+
+// Handler serves the metrics in the Prometheus exposition format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// UnaryServerInterceptor counts RPCs and observes their latency.
+func UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		start := time.Now()
+
+		resp, err := handler(ctx, req)
+
+		RPCDuration.WithLabelValues(info.FullMethod).Observe(time.Since(start).Seconds())
+		RPCs.WithLabelValues(info.FullMethod, status.Code(err).String()).Inc()
+
+		return resp, err
+	}
+}
+
+// StreamServerInterceptor counts streaming RPCs and observes their latency.
+// Calls to unknown services are labeled with the method "unknown", so that
+// scanners don't add a series per probed method.
+func StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		start := time.Now()
+
+		err := handler(srv, ss)
+
+		// srv is nil for the UnknownServiceHandler
+		method := info.FullMethod
+		if srv == nil {
+			method = "unknown"
+		}
+
+		RPCDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+		RPCs.WithLabelValues(method, status.Code(err).String()).Inc()
+
+		return err
+	}
+}
+
+// AddKeyMaterial exports the expiry of the certificates in a store as
+// gauges, read from its current material on every scrape. tenant is empty
+// outside multi-tenant mode.
+func AddKeyMaterial(tenant string, store *pki.Store) {
+	expiry.mu.Lock()
+	defer expiry.mu.Unlock()
+
+	expiry.stores[tenant] = store
+}
+
+var expiryDesc = prometheus.NewDesc(
+	"trustd_certificate_expiry_timestamp_seconds",
+	"NotAfter of the certificates in the key material, by tenant and kind (ca, chain, next_ca, previous_ca, accepted_ca, client_ca, server).",
+	[]string{"tenant", "kind", "subject", "serial"}, nil,
+)
+
+// expiryCollector exports the expiry of key material.
+type expiryCollector struct {
+	mu     sync.Mutex
+	stores map[string]*pki.Store
+}
+
+// Describe implements prometheus.Collector.
+func (c *expiryCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- expiryDesc
+}
+
+// Collect implements prometheus.Collector.
+func (c *expiryCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for tenant, store := range c.stores {
+		m := store.Current()
+
+		emit := func(kind string, cert *stdx509.Certificate) {
+			if cert != nil {
+				ch <- prometheus.MustNewConstMetric(expiryDesc, prometheus.GaugeValue, float64(cert.NotAfter.Unix()),
+					tenant, kind, cert.Subject.String(), cert.SerialNumber.String())
+			}
+		}
+
+		emit("ca", m.CA)
+
+		for _, cert := range m.Chain {
+			emit("chain", cert)
+		}
+
+		emit("next_ca", m.Next)
+		emit("previous_ca", m.Previous)
+
+		for _, cert := range m.AcceptedCACerts {
+			emit("accepted_ca", cert)
+		}
+
+		for _, cert := range m.ClientCACerts {
+			emit("client_ca", cert)
+		}
+
+		if m.ServerCert != nil {
+			emit("server", m.ServerCert.Leaf)
+		}
+	}
+}
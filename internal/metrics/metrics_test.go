@@ -0,0 +1,97 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package metrics_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/siderolabs/crypto/x509"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/cozystack/standalone-trustd/internal/metrics"
+	"github.com/cozystack/standalone-trustd/internal/pki"
+)
+
+func TestUnaryServerInterceptor(t *testing.T) {
+	interceptor := metrics.UnaryServerInterceptor()
+	info := &grpc.UnaryServerInfo{FullMethod: "/test.Service/Method"}
+
+	for _, err := range []error{nil, status.Error(codes.Unauthenticated, "invalid token"), nil} {
+		_, _ = interceptor(context.Background(), nil, info, func(context.Context, any) (any, error) {
+			return nil, err
+		})
+	}
+
+	assert.EqualValues(t, 2, testutil.ToFloat64(metrics.RPCs.WithLabelValues(info.FullMethod, "OK")))
+	assert.EqualValues(t, 1, testutil.ToFloat64(metrics.RPCs.WithLabelValues(info.FullMethod, "Unauthenticated")))
+	assert.Equal(t, 1, testutil.CollectAndCount(metrics.RPCDuration, "trustd_grpc_request_duration_seconds"))
+}
+
+func TestStreamServerInterceptor(t *testing.T) {
+	interceptor := metrics.StreamServerInterceptor()
+	info := &grpc.StreamServerInfo{FullMethod: "/test.Service/Stream"}
+	handler := func(any, grpc.ServerStream) error { return nil }
+
+	require.NoError(t, interceptor(struct{}{}, nil, info, handler))
+	assert.EqualValues(t, 1, testutil.ToFloat64(metrics.RPCs.WithLabelValues(info.FullMethod, "OK")))
+
+	// calls to unknown services share a series
+	for _, method := range []string{"/machine.MachineService/Version", "/machine.MachineService/Reboot"} {
+		_ = interceptor(nil, nil, &grpc.StreamServerInfo{FullMethod: method}, func(any, grpc.ServerStream) error {
+			return status.Error(codes.Unimplemented, "unknown method")
+		})
+	}
+
+	assert.EqualValues(t, 2, testutil.ToFloat64(metrics.RPCs.WithLabelValues("unknown", "Unimplemented")))
+
+	families, err := metrics.Registry.Gather()
+	require.NoError(t, err)
+
+	for _, family := range families {
+		for _, m := range family.GetMetric() {
+			for _, label := range m.GetLabel() {
+				assert.NotContains(t, label.GetValue(), "MachineService", family.GetName())
+			}
+		}
+	}
+}
+
+func TestKeyMaterialExpiry(t *testing.T) {
+	notAfter := time.Now().Add(time.Hour).Truncate(time.Second)
+
+	ca, err := x509.NewSelfSignedCertificateAuthority(x509.NotAfter(notAfter))
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	caCert, caKey := filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ca.key")
+	require.NoError(t, os.WriteFile(caCert, ca.CrtPEM, 0644))
+	require.NoError(t, os.WriteFile(caKey, ca.KeyPEM, 0600))
+
+	store, err := pki.Load(pki.Files{CACert: caCert, CAKey: caKey, IncludeSigningCA: true})
+	require.NoError(t, err)
+
+	metrics.AddKeyMaterial("foo", store)
+
+	serial := ca.Crt.SerialNumber.String()
+
+	expected := fmt.Sprintf(`# HELP trustd_certificate_expiry_timestamp_seconds NotAfter of the certificates in the key material, by tenant and kind (ca, chain, next_ca, previous_ca, accepted_ca, client_ca, server).
+# TYPE trustd_certificate_expiry_timestamp_seconds gauge
+trustd_certificate_expiry_timestamp_seconds{kind="accepted_ca",serial="%[1]s",subject="",tenant="foo"} %[2]d
+trustd_certificate_expiry_timestamp_seconds{kind="ca",serial="%[1]s",subject="",tenant="foo"} %[2]d
+`, serial, notAfter.Unix())
+
+	assert.NoError(t, testutil.GatherAndCompare(metrics.Registry, strings.NewReader(expected), "trustd_certificate_expiry_timestamp_seconds"))
+}
@@ -0,0 +1,182 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package pki
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/sha256"
+	stdx509 "crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+)
+
+// bundleEntry is a certificate proposed for the accepted CAs.
+type bundleEntry struct {
+	cert   *stdx509.Certificate
+	origin string
+}
+
+// Fingerprint returns the hex SHA-256 fingerprint of a certificate.
+func Fingerprint(cert *stdx509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+
+	return hex.EncodeToString(sum[:])
+}
+
+// parseBundle parses the certificates of a PEM file. Other PEM blocks are
+// skipped, but data which is not PEM at all is rejected.
+func parseBundle(origin string, data []byte) ([]bundleEntry, error) {
+	var entries []bundleEntry
+
+	for rest := bytes.TrimSpace(data); len(rest) > 0; rest = bytes.TrimSpace(rest) {
+		var block *pem.Block
+
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			return nil, errors.New("trailing data is not PEM")
+		}
+
+		if block.Type != "CERTIFICATE" {
+			slog.Warn("accepted CAs: skipping PEM block", "type", block.Type, "origin", origin)
+
+			continue
+		}
+
+		cert, err := stdx509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, bundleEntry{cert: cert, origin: origin})
+	}
+
+	return entries, nil
+}
+
+// assembleBundle de-duplicates the certificates by fingerprint, drops
+// expired and non-CA certificates with a warning, and orders the rest by
+// subject and fingerprint, so that the bundle doesn't depend on the order
+// of its sources.
+func assembleBundle(entries []bundleEntry, now time.Time) ([]*stdx509.Certificate, []byte) {
+	seen := map[string]struct{}{}
+
+	var certs []*stdx509.Certificate
+
+	for _, entry := range entries {
+		fingerprint := Fingerprint(entry.cert)
+
+		if _, dup := seen[fingerprint]; dup {
+			continue
+		}
+
+		seen[fingerprint] = struct{}{}
+
+		switch {
+		case !entry.cert.IsCA:
+			slog.Warn("accepted CAs: dropping non-CA certificate", "subject", entry.cert.Subject.String(), "fingerprint", fingerprint, "origin", entry.origin)
+
+			continue
+		case now.After(entry.cert.NotAfter):
+			slog.Warn("accepted CAs: dropping expired certificate", "subject", entry.cert.Subject.String(), "fingerprint", fingerprint,
+				"origin", entry.origin, "not_after", entry.cert.NotAfter.UTC().Format(time.RFC3339))
+
+			continue
+		}
+
+		certs = append(certs, entry.cert)
+	}
+
+	slices.SortFunc(certs, func(a, b *stdx509.Certificate) int {
+		return cmp.Or(
+			cmp.Compare(a.Subject.String(), b.Subject.String()),
+			cmp.Compare(Fingerprint(a), Fingerprint(b)),
+		)
+	})
+
+	var bundle []byte
+
+	for _, cert := range certs {
+		bundle = append(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+	}
+
+	return certs, bundle
+}
+
+// parseChain parses a CA chain file, which must hold CA certificates only.
+func parseChain(data []byte) ([]*stdx509.Certificate, error) {
+	entries, err := parseBundle("CA chain", data)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(entries) == 0 {
+		return nil, errors.New("no certificates found")
+	}
+
+	chain := make([]*stdx509.Certificate, 0, len(entries))
+
+	for _, entry := range entries {
+		if !entry.cert.IsCA {
+			return nil, fmt.Errorf("certificate %q is not a CA", entry.cert.Subject)
+		}
+
+		chain = append(chain, entry.cert)
+	}
+
+	return chain, nil
+}
+
+// verifyChainOrder checks that each certificate of the chain issues the one
+// before it, starting with the signing CA, as the chain is returned to
+// clients as is.
+func verifyChainOrder(ca *stdx509.Certificate, chain []*stdx509.Certificate) error {
+	child := ca
+
+	for _, cert := range chain {
+		if !bytes.Equal(child.RawIssuer, cert.RawSubject) || child.CheckSignatureFrom(cert) != nil {
+			return fmt.Errorf("certificate %q doesn't issue %q, the chain must go from the issuer of the CA towards the root", cert.Subject, child.Subject)
+		}
+
+		child = cert
+	}
+
+	return nil
+}
+
+// verifyCA checks that the signing CA chains, possibly through the
+// intermediates of its chain, to one of the accepted CAs, so that clients
+// can verify the certificates it issues.
+func verifyCA(ca *stdx509.Certificate, chain, accepted []*stdx509.Certificate) error {
+	roots, intermediates := stdx509.NewCertPool(), stdx509.NewCertPool()
+
+	for _, cert := range accepted {
+		roots.AddCert(cert)
+	}
+
+	for _, cert := range chain {
+		intermediates.AddCert(cert)
+	}
+
+	if _, err := ca.Verify(stdx509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []stdx509.ExtKeyUsage{stdx509.ExtKeyUsageAny},
+	}); err != nil {
+		return fmt.Errorf("no accepted CA verifies the signing CA %q: %w", ca.Subject, err)
+	}
+
+	return nil
+}
+
+// SelfSigned reports whether a certificate is a root.
+func SelfSigned(cert *stdx509.Certificate) bool {
+	return bytes.Equal(cert.RawIssuer, cert.RawSubject) && cert.CheckSignatureFrom(cert) == nil
+}
@@ -0,0 +1,259 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package pki
+
+import (
+	"crypto/tls"
+	stdx509 "crypto/x509"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Severity grades a Finding.
+type Severity int
+
+// Severities, from the least to the most severe.
+const (
+	SeverityOK Severity = iota
+	SeverityWarning
+	SeverityError
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityOK:
+		return "OK"
+	case SeverityWarning:
+		return "WARNING"
+	case SeverityError:
+		return "ERROR"
+	default:
+		return fmt.Sprintf("Severity(%d)", int(s))
+	}
+}
+
+// Finding is the outcome of a single check.
+type Finding struct {
+	Severity Severity
+	// Subject names the checked material, e.g. "signing CA".
+	Subject string
+	Message string
+}
+
+func (f Finding) String() string {
+	return fmt.Sprintf("%-7s %s: %s", f.Severity, f.Subject, f.Message)
+}
+
+// Report lists the findings of a check.
+type Report []Finding
+
+// Failed reports whether the report contains errors.
+func (r Report) Failed() bool {
+	return slices.ContainsFunc(r, func(f Finding) bool { return f.Severity == SeverityError })
+}
+
+// Problems returns the warnings and errors.
+func (r Report) Problems() Report {
+	return slices.DeleteFunc(slices.Clone(r), func(f Finding) bool { return f.Severity == SeverityOK })
+}
+
+// WriteTo writes the report, one finding per line.
+func (r Report) WriteTo(w io.Writer) (int64, error) {
+	var sb strings.Builder
+
+	for _, f := range r {
+		sb.WriteString(f.String())
+		sb.WriteByte('\n')
+	}
+
+	n, err := io.WriteString(w, sb.String())
+
+	return int64(n), err
+}
+
+// CheckOptions configures Material.Check.
+type CheckOptions struct {
+	// Now is the time to check against, time.Now() if zero.
+	Now time.Time
+	// ExpiryWarning warns about material expiring within this duration.
+	ExpiryWarning time.Duration
+	// CertValidity is the validity of issued certificates, which the
+	// signing CA should outlive.
+	CertValidity time.Duration
+	// Addresses are the IPs and DNS names clients use to reach trustd,
+	// which must be among the SANs of the server certificate.
+	Addresses []string
+}
+
+// Check validates the material beyond what loading it requires: CA
+// constraints, expiry horizons, the SANs of the server certificate and
+// whether the accepted CAs cover the certificates clients verify.
+//
+// Key and certificate pairing is verified when the material is loaded.
+func (m *Material) Check(opts CheckOptions) Report {
+	if opts.Now.IsZero() {
+		opts.Now = time.Now()
+	}
+
+	c := &checker{opts: opts}
+
+	if m.CA != nil {
+		c.ok("signing CA", "%q matches its private key", m.CA.Subject)
+		c.ca("signing CA", m.CA)
+
+		if opts.CertValidity > 0 && m.CA.NotAfter.Before(opts.Now.Add(opts.CertValidity)) {
+			c.warn("signing CA", "expires within the certificate validity of %s, issued certificates are clamped to it or refused", opts.CertValidity)
+		}
+
+		c.ok("accepted CAs", "verify the signing CA")
+	}
+
+	for _, cert := range m.Chain {
+		c.ca(fmt.Sprintf("chain certificate %q", cert.Subject), cert)
+	}
+
+	for _, rotated := range []struct {
+		subject string
+		cert    *stdx509.Certificate
+	}{
+		{"next CA", m.Next},
+		{"previous CA", m.Previous},
+		{"cross-signed CA", m.CrossSigned},
+	} {
+		if rotated.cert != nil {
+			c.validity(rotated.subject, rotated.cert)
+		}
+	}
+
+	for _, cert := range m.AcceptedCACerts {
+		c.validity(fmt.Sprintf("accepted CA %q", cert.Subject), cert)
+	}
+
+	for _, cert := range m.ClientCACerts {
+		c.validity(fmt.Sprintf("client CA %q", cert.Subject), cert)
+	}
+
+	if m.ServerCert != nil {
+		c.server(m.ServerCert, m.AcceptedCACerts)
+	}
+
+	return c.report
+}
+
+type checker struct {
+	opts   CheckOptions
+	report Report
+}
+
+func (c *checker) add(severity Severity, subject, format string, args ...any) {
+	c.report = append(c.report, Finding{Severity: severity, Subject: subject, Message: fmt.Sprintf(format, args...)})
+}
+
+func (c *checker) ok(subject, format string, args ...any) {
+	c.add(SeverityOK, subject, format, args...)
+}
+
+func (c *checker) warn(subject, format string, args ...any) {
+	c.add(SeverityWarning, subject, format, args...)
+}
+
+func (c *checker) fail(subject, format string, args ...any) {
+	c.add(SeverityError, subject, format, args...)
+}
+
+// ca checks the constraints and validity of a CA certificate.
+func (c *checker) ca(subject string, cert *stdx509.Certificate) {
+	switch {
+	case !cert.BasicConstraintsValid || !cert.IsCA:
+		c.fail(subject, "basic constraints don't mark it as a CA")
+	case cert.KeyUsage&stdx509.KeyUsageCertSign == 0:
+		c.fail(subject, "lacks the certSign key usage, clients reject the certificates it issues")
+	default:
+		c.ok(subject, "is a CA with the certSign key usage")
+	}
+
+	c.validity(subject, cert)
+}
+
+// validity checks that a certificate is valid now and for the expiry
+// warning horizon.
+func (c *checker) validity(subject string, cert *stdx509.Certificate) {
+	now := c.opts.Now
+	notAfter := cert.NotAfter.UTC().Format(time.RFC3339)
+
+	switch {
+	case now.Before(cert.NotBefore):
+		c.fail(subject, "not valid before %s", cert.NotBefore.UTC().Format(time.RFC3339))
+	case now.After(cert.NotAfter):
+		c.fail(subject, "expired at %s", notAfter)
+	case now.Add(c.opts.ExpiryWarning).After(cert.NotAfter):
+		c.warn(subject, "expires in %s, at %s", cert.NotAfter.Sub(now).Round(time.Minute), notAfter)
+	default:
+		c.ok(subject, "valid until %s", notAfter)
+	}
+}
+
+// server checks the server certificate.
+func (c *checker) server(cert *tls.Certificate, accepted []*stdx509.Certificate) {
+	const subject = "server certificate"
+
+	leaf := cert.Leaf
+
+	c.ok(subject, "%q matches its private key", leaf.Subject)
+	c.validity(subject, leaf)
+
+	if len(leaf.ExtKeyUsage) > 0 && !slices.Contains(leaf.ExtKeyUsage, stdx509.ExtKeyUsageServerAuth) &&
+		!slices.Contains(leaf.ExtKeyUsage, stdx509.ExtKeyUsageAny) {
+		c.fail(subject, "lacks the serverAuth extended key usage")
+	}
+
+	for _, addr := range c.opts.Addresses {
+		if err := leaf.VerifyHostname(addr); err != nil {
+			c.fail(subject, "no SAN for %s, clients connecting to it reject the certificate (SANs: %s)", addr, sans(leaf))
+		} else {
+			c.ok(subject, "has a SAN for %s", addr)
+		}
+	}
+
+	if len(accepted) == 0 {
+		return
+	}
+
+	roots, intermediates := stdx509.NewCertPool(), stdx509.NewCertPool()
+
+	for _, ca := range accepted {
+		roots.AddCert(ca)
+	}
+
+	for _, der := range cert.Certificate[1:] {
+		if ca, err := stdx509.ParseCertificate(der); err == nil {
+			intermediates.AddCert(ca)
+		}
+	}
+
+	if _, err := leaf.Verify(stdx509.VerifyOptions{Roots: roots, Intermediates: intermediates, CurrentTime: c.opts.Now}); err != nil {
+		c.warn(subject, "not verified by the accepted CAs, workers trusting only them can't connect: %s", err)
+	} else {
+		c.ok(subject, "verified by the accepted CAs")
+	}
+}
+
+// sans lists the DNS and IP SANs of a certificate.
+func sans(cert *stdx509.Certificate) string {
+	names := slices.Clone(cert.DNSNames)
+
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+
+	if len(names) == 0 {
+		return "none"
+	}
+
+	return strings.Join(names, ", ")
+}
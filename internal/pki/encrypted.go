@@ -0,0 +1,150 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package pki
+
+import (
+	"bytes"
+	"crypto"
+	stdx509 "crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/youmark/pkcs8"
+)
+
+// pemTypeEncryptedPKCS8 is the PEM type of an encrypted PKCS#8 key.
+const pemTypeEncryptedPKCS8 = "ENCRYPTED PRIVATE KEY"
+
+// ErrIncorrectPassphrase is returned when an encrypted key can't be
+// decrypted with the passphrase.
+var ErrIncorrectPassphrase = errors.New("incorrect passphrase")
+
+// ReadPassphrase reads a passphrase from a source:
+//
+//   - file:<path> reads a file,
+//   - env:<name> reads an environment variable and removes it from the
+//     environment, so that it isn't inherited by child processes,
+//   - credential:<name> reads a systemd credential from
+//     $CREDENTIALS_DIRECTORY.
+//
+// A trailing newline is removed.
+func ReadPassphrase(source string) ([]byte, error) {
+	kind, name, ok := strings.Cut(source, ":")
+	if !ok || name == "" {
+		return nil, fmt.Errorf("invalid passphrase source %q, expected file:<path>, env:<name> or credential:<name>", source)
+	}
+
+	var passphrase []byte
+
+	switch kind {
+	case "file":
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read passphrase: %w", err)
+		}
+
+		passphrase = data
+	case "env":
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return nil, fmt.Errorf("passphrase environment variable %s is not set", name)
+		}
+
+		os.Unsetenv(name)
+
+		passphrase = []byte(value)
+	case "credential":
+		dir := os.Getenv("CREDENTIALS_DIRECTORY")
+		if dir == "" {
+			return nil, fmt.Errorf("systemd credential %s requested, but CREDENTIALS_DIRECTORY is not set", name)
+		}
+
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read systemd credential: %w", err)
+		}
+
+		passphrase = data
+	default:
+		return nil, fmt.Errorf("unknown passphrase source %q", kind)
+	}
+
+	passphrase = bytes.TrimSuffix(bytes.TrimSuffix(passphrase, []byte("\n")), []byte("\r"))
+	if len(passphrase) == 0 {
+		return nil, fmt.Errorf("passphrase from %s is empty", source)
+	}
+
+	return passphrase, nil
+}
+
+// LoadEncryptedKey reads and decrypts a private key, either an encrypted
+// PKCS#8 key or a legacy PEM key with a DEK-Info header.
+func LoadEncryptedKey(path string, passphrase []byte) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key: %w", err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found in %s", path)
+	}
+
+	var key any
+
+	switch {
+	case block.Type == pemTypeEncryptedPKCS8:
+		if key, err = pkcs8.ParsePKCS8PrivateKey(block.Bytes, passphrase); err != nil {
+			// a wrong passphrase mostly fails the padding check, but
+			// sometimes yields garbage which doesn't parse
+			return nil, fmt.Errorf("failed to decrypt %s: %w (%w)", path, ErrIncorrectPassphrase, err)
+		}
+	case stdx509.IsEncryptedPEMBlock(block):
+		// deprecated as insecure, but still produced by openssl genrsa -aes256
+		// and friends
+		der, err := stdx509.DecryptPEMBlock(block, passphrase)
+		if err == nil {
+			key, err = parsePrivateKey(der)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt %s: %w (%w)", path, ErrIncorrectPassphrase, err)
+		}
+	default:
+		return nil, fmt.Errorf("%s is not an encrypted private key", path)
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+
+	return signer, nil
+}
+
+// parsePrivateKey parses a DER private key in any of the formats of PEM
+// keys.
+func parsePrivateKey(der []byte) (any, error) {
+	if key, err := stdx509.ParsePKCS8PrivateKey(der); err == nil {
+		return key, nil
+	}
+
+	if key, err := stdx509.ParseECPrivateKey(der); err == nil {
+		return key, nil
+	}
+
+	return stdx509.ParsePKCS1PrivateKey(der)
+}
+
+// isEncryptedKey reports whether PEM data holds an encrypted private key.
+func isEncryptedKey(data []byte) bool {
+	block, _ := pem.Decode(data)
+
+	return block != nil && (block.Type == pemTypeEncryptedPKCS8 || stdx509.IsEncryptedPEMBlock(block))
+}
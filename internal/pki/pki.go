@@ -0,0 +1,464 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package pki keeps the key material of trustd in memory and reloads it when
+// the files on disk change.
+package pki
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"crypto/tls"
+	stdx509 "crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/siderolabs/crypto/x509"
+)
+
+// Files lists the key material files. Empty paths are skipped, but a CA
+// (CACert and CAKey, or CADir) must come with accepted CAs, unless they are
+// implied by IncludeSigningCA or CADir.
+type Files struct {
+	CACert string
+	CAKey  string
+	// Signer, if set, replaces CAKey, e.g. a key kept in an HSM or an
+	// encrypted key decrypted at startup. CACert is still read from disk and
+	// must match it.
+	Signer crypto.Signer
+	// CAChain holds the intermediates between an intermediate CACert and
+	// the root, which stays in AcceptedCAs only.
+	CAChain string
+	// CADir holds a CA rotation (see Introduce) and replaces CACert and CAKey.
+	// All CAs of the rotation are added to the accepted CAs.
+	CADir string
+	// AcceptedCAs lists PEM files and directories (*.crt, *.pem) assembled
+	// into the accepted CAs bundle.
+	AcceptedCAs []string
+	// IncludeSigningCA adds the signing CA to the accepted CAs.
+	IncludeSigningCA bool
+	ServerCert       string
+	ServerKey        string
+	// ClientCAs is a PEM file with the CAs verifying TLS client
+	// certificates, separate from the accepted CAs.
+	ClientCAs string
+}
+
+// file is a key material file, optional files may be missing.
+type file struct {
+	path     string
+	optional bool
+	// accepted marks sources of the accepted CAs bundle.
+	accepted bool
+}
+
+// files lists the files to read, expanding accepted CAs directories.
+func (f Files) files() ([]file, error) {
+	files := []file{{path: f.CACert}, {path: f.CAKey}, {path: f.CAChain}}
+
+	if f.CADir != "" {
+		files = append(files,
+			file{path: filepath.Join(f.CADir, currentDir, caCertFile), optional: true},
+			file{path: filepath.Join(f.CADir, currentDir, caKeyFile), optional: true},
+			file{path: filepath.Join(f.CADir, nextDir, caCertFile), optional: true},
+			file{path: filepath.Join(f.CADir, previousDir, caCertFile), optional: true},
+			file{path: filepath.Join(f.CADir, currentNewDir, caCertFile), optional: true},
+			file{path: filepath.Join(f.CADir, currentNewDir, caKeyFile), optional: true},
+			file{path: filepath.Join(f.CADir, currentOldDir, caCertFile), optional: true},
+			file{path: filepath.Join(f.CADir, crossSignedFile), optional: true},
+		)
+	}
+
+	for _, path := range f.AcceptedCAs {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return nil, fmt.Errorf("accepted CAs: %w", err)
+		}
+
+		if !fi.IsDir() {
+			files = append(files, file{path: path, accepted: true})
+
+			continue
+		}
+
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, fmt.Errorf("accepted CAs: %w", err)
+		}
+
+		for _, entry := range entries {
+			if ext := filepath.Ext(entry.Name()); entry.IsDir() || (ext != ".crt" && ext != ".pem") {
+				continue
+			}
+
+			files = append(files, file{path: filepath.Join(path, entry.Name()), accepted: true})
+		}
+	}
+
+	return append(files, file{path: f.ServerCert}, file{path: f.ServerKey}, file{path: f.ClientCAs}), nil
+}
+
+// Material is a parsed and validated snapshot of the key material.
+type Material struct {
+	// CA and CAKey sign issued certificates; with a CA rotation, this is
+	// the current CA.
+	CA    *stdx509.Certificate
+	CAKey crypto.Signer
+	// Chain are the certificates from CAChain, ordered from the issuer of CA
+	// towards the root.
+	Chain []*stdx509.Certificate
+	// Next and Previous are the other CAs of a rotation, trusted alongside CA.
+	Next     *stdx509.Certificate
+	Previous *stdx509.Certificate
+	// CrossSigned, if set, is CA signed by the previous CA and is returned
+	// along with issued certificates, so that clients still trusting only
+	// the previous CA can verify them.
+	CrossSigned *stdx509.Certificate
+	// AcceptedCAs is the PEM bundle returned to clients, assembled from
+	// AcceptedCACerts.
+	AcceptedCAs     []byte
+	AcceptedCACerts []*stdx509.Certificate
+	// ServerCert is presented by the TLS listener.
+	ServerCert *tls.Certificate
+	// ClientCAs verifies TLS client certificates, nil without Files.ClientCAs.
+	ClientCAs     *stdx509.CertPool
+	ClientCACerts []*stdx509.Certificate
+}
+
+// Intermediates returns the certificates between an issued leaf and the
+// root: CA, unless it is self-signed, and its chain without any root.
+func (m *Material) Intermediates() []*stdx509.Certificate {
+	return Intermediates(append([]*stdx509.Certificate{m.CA}, m.Chain...))
+}
+
+// NotAfter returns the earliest expiry of CA and the intermediates of its
+// chain, which bounds the lifetime of the certificates it issues.
+func (m *Material) NotAfter() time.Time {
+	return ChainNotAfter(append([]*stdx509.Certificate{m.CA}, m.Chain...))
+}
+
+// ChainNotAfter returns the earliest expiry of the signing CA chain[0] and
+// the intermediates of chain, which bounds the lifetime of the certificates
+// it issues.
+func ChainNotAfter(chain []*stdx509.Certificate) time.Time {
+	notAfter := chain[0].NotAfter
+
+	for _, cert := range Intermediates(chain) {
+		if cert.NotAfter.Before(notAfter) {
+			notAfter = cert.NotAfter
+		}
+	}
+
+	return notAfter
+}
+
+// Intermediates returns the certificates of a chain which aren't roots.
+func Intermediates(chain []*stdx509.Certificate) []*stdx509.Certificate {
+	var intermediates []*stdx509.Certificate
+
+	for _, cert := range chain {
+		if !SelfSigned(cert) {
+			intermediates = append(intermediates, cert)
+		}
+	}
+
+	return intermediates
+}
+
+// Store holds the current Material and swaps it atomically on reload.
+type Store struct {
+	files Files
+
+	current  atomic.Pointer[Material]
+	failures atomic.Uint64
+
+	mu     sync.Mutex
+	digest [sha256.Size]byte
+}
+
+// Load reads the key material and returns a store holding it.
+func Load(files Files) (*Store, error) {
+	s := &Store{files: files}
+
+	if _, err := s.Reload(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Current returns the latest good key material.
+func (s *Store) Current() *Material {
+	return s.current.Load()
+}
+
+// ReloadFailures returns the number of failed reloads since startup.
+func (s *Store) ReloadFailures() uint64 {
+	return s.failures.Load()
+}
+
+// Reload re-reads the files and, if their contents changed, parses,
+// validates and swaps in the new material. On error the previous material
+// stays in use.
+func (s *Store) Reload() (changed bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	files, err := s.files.files()
+	if err != nil {
+		s.failures.Add(1)
+
+		return false, err
+	}
+
+	contents, digest, err := readFiles(files)
+	if err != nil {
+		s.failures.Add(1)
+
+		return false, err
+	}
+
+	if s.current.Load() != nil && digest == s.digest {
+		return false, nil
+	}
+
+	m, err := parse(s.files, files, contents)
+	if err != nil {
+		s.failures.Add(1)
+
+		return false, err
+	}
+
+	s.current.Store(m)
+	s.digest = digest
+
+	return true, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (s *Store) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if cert := s.Current().ServerCert; cert != nil {
+		return cert, nil
+	}
+
+	return nil, errors.New("no server certificate configured")
+}
+
+// LoadFiles reads and parses the key material without keeping a store.
+func LoadFiles(files Files) (*Material, error) {
+	list, err := files.files()
+	if err != nil {
+		return nil, err
+	}
+
+	contents, _, err := readFiles(list)
+	if err != nil {
+		return nil, err
+	}
+
+	return parse(files, list, contents)
+}
+
+// LoadCA loads and parses a certificate and its private key, e.g. a CA.
+func LoadCA(certPath, keyPath string) (*stdx509.Certificate, crypto.Signer, error) {
+	pemCA, err := x509.NewCertificateAndKeyFromFiles(certPath, keyPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read CA certificate and key: %w", err)
+	}
+
+	return parseCA(pemCA)
+}
+
+func parseCA(pemCA *x509.PEMEncodedCertificateAndKey) (*stdx509.Certificate, crypto.Signer, error) {
+	if isEncryptedKey(pemCA.Key) {
+		return nil, nil, errors.New("CA key is encrypted and requires a passphrase")
+	}
+
+	ca, err := x509.NewCertificateAuthorityFromCertificateAndKey(pemCA)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse CA certificate and key: %w", err)
+	}
+
+	signer, ok := ca.Key.(crypto.Signer)
+	if !ok {
+		return nil, nil, fmt.Errorf("unsupported CA key type %T", ca.Key)
+	}
+
+	return ca.Crt, signer, nil
+}
+
+// readFiles reads all files with a non-empty path, returning their contents
+// (nil for empty paths and missing optional files) and a digest over all of
+// them.
+func readFiles(files []file) (map[string][]byte, [sha256.Size]byte, error) {
+	h := sha256.New()
+	contents := make(map[string][]byte, len(files))
+
+	for _, f := range files {
+		if f.path == "" {
+			binary.Write(h, binary.BigEndian, int64(-1))
+
+			continue
+		}
+
+		h.Write([]byte(f.path))
+
+		data, err := os.ReadFile(f.path)
+		if err != nil && !(f.optional && errors.Is(err, fs.ErrNotExist)) {
+			return nil, [sha256.Size]byte{}, err
+		}
+
+		if err != nil {
+			binary.Write(h, binary.BigEndian, int64(-2))
+
+			continue
+		}
+
+		binary.Write(h, binary.BigEndian, int64(len(data)))
+		h.Write(data)
+
+		contents[f.path] = data
+	}
+
+	return contents, [sha256.Size]byte(h.Sum(nil)), nil
+}
+
+func parse(files Files, list []file, contents map[string][]byte) (*Material, error) {
+	m := &Material{}
+
+	switch {
+	case files.CADir != "" && (files.CACert != "" || files.CAKey != "" || files.Signer != nil):
+		return nil, errors.New("CA directory can't be combined with a CA certificate and key")
+	case files.CADir != "":
+		if err := parseRotation(m, files.CADir, contents); err != nil {
+			return nil, err
+		}
+	case files.CACert != "" || files.CAKey != "" || files.Signer != nil:
+		switch {
+		case files.CAKey != "" && files.Signer != nil:
+			return nil, errors.New("CA key can't be combined with a signer")
+		case files.CACert == "" || (files.CAKey == "" && files.Signer == nil):
+			return nil, errors.New("CA certificate and key must be set together")
+		case len(files.AcceptedCAs) == 0 && !files.IncludeSigningCA:
+			return nil, errors.New("CA requires accepted CAs")
+		}
+
+		var (
+			ca     *stdx509.Certificate
+			signer = files.Signer
+			err    error
+		)
+
+		if signer != nil {
+			if ca, err = parseCertificate(contents[files.CACert]); err != nil {
+				return nil, fmt.Errorf("failed to parse CA certificate: %w", err)
+			}
+		} else if ca, signer, err = parseCA(&x509.PEMEncodedCertificateAndKey{Crt: contents[files.CACert], Key: contents[files.CAKey]}); err != nil {
+			return nil, err
+		}
+
+		if err = validateCA(ca, signer); err != nil {
+			return nil, fmt.Errorf("invalid CA %s: %w", files.CACert, err)
+		}
+
+		m.CA, m.CAKey = ca, signer
+	}
+
+	if files.CAChain != "" {
+		if files.CADir != "" || m.CA == nil {
+			return nil, errors.New("CA chain requires a CA certificate and key")
+		}
+
+		chain, err := parseChain(contents[files.CAChain])
+		if err != nil {
+			return nil, fmt.Errorf("invalid CA chain %s: %w", files.CAChain, err)
+		}
+
+		if err = verifyChainOrder(m.CA, chain); err != nil {
+			return nil, fmt.Errorf("invalid CA chain %s: %w", files.CAChain, err)
+		}
+
+		m.Chain = chain
+	}
+
+	var entries []bundleEntry
+
+	for _, f := range list {
+		if !f.accepted {
+			continue
+		}
+
+		parsed, err := parseBundle(f.path, contents[f.path])
+		if err != nil {
+			return nil, fmt.Errorf("invalid accepted CAs %s: %w", f.path, err)
+		}
+
+		entries = append(entries, parsed...)
+	}
+
+	if files.CADir != "" {
+		// all CAs of the rotation are trusted
+		for _, ca := range []*stdx509.Certificate{m.CA, m.Next, m.Previous} {
+			if ca != nil {
+				entries = append(entries, bundleEntry{cert: ca, origin: files.CADir})
+			}
+		}
+	} else if files.IncludeSigningCA && m.CA != nil {
+		entries = append(entries, bundleEntry{cert: m.CA, origin: files.CACert})
+	}
+
+	if len(entries) > 0 || m.CA != nil {
+		m.AcceptedCACerts, m.AcceptedCAs = assembleBundle(entries, time.Now())
+	}
+
+	if m.CA != nil {
+		if err := verifyCA(m.CA, m.Chain, m.AcceptedCACerts); err != nil {
+			return nil, err
+		}
+	}
+
+	if files.ServerCert != "" || files.ServerKey != "" {
+		cert, err := tls.X509KeyPair(contents[files.ServerCert], contents[files.ServerKey])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse server certificate and key: %w", err)
+		}
+
+		m.ServerCert = &cert
+	}
+
+	if files.ClientCAs != "" {
+		certs, err := parseChain(contents[files.ClientCAs])
+		if err != nil {
+			return nil, fmt.Errorf("invalid client CAs %s: %w", files.ClientCAs, err)
+		}
+
+		m.ClientCAs, m.ClientCACerts = stdx509.NewCertPool(), certs
+
+		for _, cert := range certs {
+			m.ClientCAs.AddCert(cert)
+		}
+	}
+
+	return m, nil
+}
+
+func validateCA(ca *stdx509.Certificate, key crypto.Signer) error {
+	if !ca.IsCA {
+		return errors.New("certificate is not a CA")
+	}
+
+	pub, ok := key.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !pub.Equal(ca.PublicKey) {
+		return errors.New("private key does not match the certificate")
+	}
+
+	return nil
+}
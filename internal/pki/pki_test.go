@@ -0,0 +1,537 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package pki_test
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	stdx509 "crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/siderolabs/crypto/x509"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/youmark/pkcs8"
+
+	"github.com/cozystack/standalone-trustd/internal/pki"
+)
+
+func newCA(t *testing.T) *x509.CertificateAuthority {
+	t.Helper()
+
+	ca, err := x509.NewSelfSignedCertificateAuthority(x509.NotAfter(time.Now().Add(time.Hour)))
+	require.NoError(t, err)
+
+	return ca
+}
+
+// volume mimics a Kubernetes secret volume: the files are symlinks into
+// ..data, which is itself a symlink swapped atomically on update.
+type volume struct {
+	dir string
+	gen int
+}
+
+func newVolume(t *testing.T) *volume {
+	return &volume{dir: t.TempDir()}
+}
+
+func (v *volume) files() pki.Files {
+	return pki.Files{
+		CACert:      filepath.Join(v.dir, "ca.crt"),
+		CAKey:       filepath.Join(v.dir, "ca.key"),
+		AcceptedCAs: []string{filepath.Join(v.dir, "accepted-cas.crt")},
+		ServerCert:  filepath.Join(v.dir, "server.crt"),
+		ServerKey:   filepath.Join(v.dir, "server.key"),
+	}
+}
+
+func (v *volume) write(t *testing.T, caCert, caKey []byte) {
+	t.Helper()
+
+	v.gen++
+	gen := fmt.Sprintf("..%d", v.gen)
+
+	require.NoError(t, os.Mkdir(filepath.Join(v.dir, gen), 0755))
+
+	for name, data := range map[string][]byte{
+		"ca.crt":           caCert,
+		"ca.key":           caKey,
+		"accepted-cas.crt": caCert,
+		"server.crt":       caCert,
+		"server.key":       caKey,
+	} {
+		require.NoError(t, os.WriteFile(filepath.Join(v.dir, gen, name), data, 0600))
+
+		link := filepath.Join(v.dir, name)
+		if _, err := os.Lstat(link); os.IsNotExist(err) {
+			require.NoError(t, os.Symlink(filepath.Join("..data", name), link))
+		}
+	}
+
+	require.NoError(t, os.Symlink(gen, filepath.Join(v.dir, "..data_tmp")))
+	require.NoError(t, os.Rename(filepath.Join(v.dir, "..data_tmp"), filepath.Join(v.dir, "..data")))
+}
+
+func TestStoreReload(t *testing.T) {
+	first, second := newCA(t), newCA(t)
+
+	vol := newVolume(t)
+	vol.write(t, first.CrtPEM, first.KeyPEM)
+
+	store, err := pki.Load(vol.files())
+	require.NoError(t, err)
+
+	m := store.Current()
+	assert.Equal(t, first.Crt.SerialNumber, m.CA.SerialNumber)
+	assert.Equal(t, first.CrtPEM, m.AcceptedCAs)
+	require.NotNil(t, m.ServerCert)
+
+	changed, err := store.Reload()
+	require.NoError(t, err)
+	assert.False(t, changed)
+	assert.Same(t, m, store.Current())
+
+	// a certificate not matching its key is rejected, the old material stays
+	vol.write(t, second.CrtPEM, first.KeyPEM)
+
+	_, err = store.Reload()
+	assert.ErrorContains(t, err, "does not match")
+	assert.Same(t, m, store.Current())
+	assert.EqualValues(t, 1, store.ReloadFailures())
+
+	vol.write(t, second.CrtPEM, second.KeyPEM)
+
+	changed, err = store.Reload()
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, second.Crt.SerialNumber, store.Current().CA.SerialNumber)
+
+	cert, err := store.GetCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, second.Crt.Raw, cert.Certificate[0])
+}
+
+func TestStoreWatch(t *testing.T) {
+	first, second := newCA(t), newCA(t)
+
+	vol := newVolume(t)
+	vol.write(t, first.CrtPEM, first.KeyPEM)
+
+	store, err := pki.Load(vol.files())
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// no polling, the swap must be picked up by file notifications
+	go store.Watch(ctx, "test", 0)
+
+	time.Sleep(100 * time.Millisecond)
+
+	vol.write(t, second.CrtPEM, second.KeyPEM)
+
+	assert.Eventually(t, func() bool {
+		return store.Current().CA.SerialNumber.Cmp(second.Crt.SerialNumber) == 0
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestStoreWatchClientCAs(t *testing.T) {
+	now := time.Now()
+
+	vol := newVolume(t)
+	ca := newCA(t)
+	vol.write(t, ca.CrtPEM, ca.KeyPEM)
+
+	// the client CAs live in a directory of their own
+	files := vol.files()
+	files.ClientCAs = writeFile(t, "client-cas.crt", string(newCertificate(t, "first", true, now.Add(-time.Hour), now.Add(time.Hour))))
+
+	store, err := pki.Load(files)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go store.Watch(ctx, "test", 0)
+
+	time.Sleep(100 * time.Millisecond)
+
+	second := newCertificate(t, "second", true, now.Add(-time.Hour), now.Add(time.Hour))
+	require.NoError(t, os.WriteFile(files.ClientCAs, second, 0600))
+
+	assert.Eventually(t, func() bool {
+		return store.Current().ClientCACerts[0].Subject.CommonName == "second"
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestLoadInvalid(t *testing.T) {
+	ca := newCA(t)
+
+	vol := newVolume(t)
+	vol.write(t, ca.CrtPEM, ca.KeyPEM)
+
+	files := vol.files()
+	files.AcceptedCAs = []string{filepath.Join(vol.dir, "ca.key")}
+
+	_, err := pki.Load(files)
+	assert.ErrorContains(t, err, "no accepted CA verifies the signing CA")
+
+	files = vol.files()
+	files.CAKey = ""
+
+	_, err = pki.Load(files)
+	assert.Error(t, err)
+}
+
+// newCertificate returns a self-signed certificate valid in [notBefore, notAfter).
+func newCertificate(t *testing.T, cn string, isCA bool, notBefore, notAfter time.Time) []byte {
+	t.Helper()
+
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	der, err := stdx509.CreateCertificate(rand.Reader, &stdx509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+		KeyUsage:              stdx509.KeyUsageCertSign | stdx509.KeyUsageDigitalSignature,
+	}, &stdx509.Certificate{Subject: pkix.Name{CommonName: cn}}, pub, key)
+	require.NoError(t, err)
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func TestAcceptedCAsBundle(t *testing.T) {
+	now := time.Now()
+
+	signing := newCA(t)
+	other := newCertificate(t, "other-ca", true, now.Add(-time.Hour), now.Add(time.Hour))
+	expired := newCertificate(t, "expired-ca", true, now.Add(-2*time.Hour), now.Add(-time.Hour))
+	leaf := newCertificate(t, "leaf", false, now.Add(-time.Hour), now.Add(time.Hour))
+
+	dir := t.TempDir()
+	caCert, caKey := filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ca.key")
+	require.NoError(t, os.WriteFile(caCert, signing.CrtPEM, 0644))
+	require.NoError(t, os.WriteFile(caKey, signing.KeyPEM, 0600))
+
+	bundleDir := filepath.Join(dir, "bundle")
+	require.NoError(t, os.Mkdir(bundleDir, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(bundleDir, "a.crt"), slices.Concat(other, expired), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(bundleDir, "b.pem"), slices.Concat(leaf, other), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(bundleDir, "README"), []byte("not a certificate"), 0644))
+
+	extra := filepath.Join(dir, "extra.crt")
+	require.NoError(t, os.WriteFile(extra, slices.Concat(signing.CrtPEM, other), 0644))
+
+	m, err := pki.LoadFiles(pki.Files{CACert: caCert, CAKey: caKey, AcceptedCAs: []string{bundleDir, extra}})
+	require.NoError(t, err)
+
+	// de-duplicated, without the expired and non-CA certificates, ordered by
+	// subject (the signing CA has an empty one)
+	require.Len(t, m.AcceptedCACerts, 2)
+	assert.Equal(t, signing.Crt.Raw, m.AcceptedCACerts[0].Raw)
+	assert.Equal(t, "other-ca", m.AcceptedCACerts[1].Subject.CommonName)
+	assert.Equal(t, slices.Concat(signing.CrtPEM, other), m.AcceptedCAs)
+
+	// the order doesn't depend on the sources
+	reordered, err := pki.LoadFiles(pki.Files{CACert: caCert, CAKey: caKey, AcceptedCAs: []string{extra, bundleDir}})
+	require.NoError(t, err)
+	assert.Equal(t, m.AcceptedCAs, reordered.AcceptedCAs)
+
+	// the signing CA must be verifiable by the bundle
+	_, err = pki.LoadFiles(pki.Files{CACert: caCert, CAKey: caKey, AcceptedCAs: []string{bundleDir}})
+	assert.ErrorContains(t, err, "no accepted CA verifies the signing CA")
+
+	m, err = pki.LoadFiles(pki.Files{CACert: caCert, CAKey: caKey, AcceptedCAs: []string{bundleDir}, IncludeSigningCA: true})
+	require.NoError(t, err)
+	assert.Len(t, m.AcceptedCACerts, 2)
+
+	// garbage is rejected
+	require.NoError(t, os.WriteFile(filepath.Join(bundleDir, "c.crt"), []byte("garbage"), 0644))
+
+	_, err = pki.LoadFiles(pki.Files{CACert: caCert, CAKey: caKey, AcceptedCAs: []string{bundleDir}, IncludeSigningCA: true})
+	assert.ErrorContains(t, err, "not PEM")
+}
+
+func TestClientCAs(t *testing.T) {
+	now := time.Now()
+
+	clientCA := newCertificate(t, "client-ca", true, now.Add(-time.Hour), now.Add(time.Hour))
+	leaf := newCertificate(t, "leaf", false, now.Add(-time.Hour), now.Add(time.Hour))
+
+	// separate from the accepted CAs
+	m, err := pki.LoadFiles(pki.Files{ClientCAs: writeFile(t, "client-cas.crt", string(clientCA))})
+	require.NoError(t, err)
+	require.NotNil(t, m.ClientCAs)
+	require.Len(t, m.ClientCACerts, 1)
+	assert.Equal(t, "client-ca", m.ClientCACerts[0].Subject.CommonName)
+	assert.Empty(t, m.AcceptedCACerts)
+
+	_, err = pki.LoadFiles(pki.Files{ClientCAs: writeFile(t, "client-cas.crt", string(leaf))})
+	assert.ErrorContains(t, err, "invalid client CAs")
+
+	m, err = pki.LoadFiles(pki.Files{})
+	require.NoError(t, err)
+	assert.Nil(t, m.ClientCAs)
+}
+
+func TestLoadEncryptedKey(t *testing.T) {
+	ca := newCA(t)
+
+	block, _ := pem.Decode(ca.KeyPEM)
+	require.NotNil(t, block)
+
+	key, err := stdx509.ParsePKCS8PrivateKey(block.Bytes)
+	require.NoError(t, err)
+
+	pkcs8DER, err := pkcs8.MarshalPrivateKey(key, []byte("s3cret"), nil)
+	require.NoError(t, err)
+
+	legacy, err := stdx509.EncryptPEMBlock(rand.Reader, block.Type, block.Bytes, []byte("s3cret"), stdx509.PEMCipherAES256)
+	require.NoError(t, err)
+
+	for name, keyPEM := range map[string][]byte{
+		"PKCS#8":     pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: pkcs8DER}),
+		"legacy PEM": pem.EncodeToMemory(legacy),
+	} {
+		t.Run(name, func(t *testing.T) {
+			vol := newVolume(t)
+			vol.write(t, ca.CrtPEM, keyPEM)
+
+			// the volume reuses the CA key as the server key
+			files := vol.files()
+			files.ServerCert, files.ServerKey = "", ""
+			keyPath := files.CAKey
+
+			_, err := pki.Load(files)
+			assert.ErrorContains(t, err, "encrypted and requires a passphrase")
+
+			_, err = pki.LoadEncryptedKey(keyPath, []byte("wrong"))
+			assert.ErrorIs(t, err, pki.ErrIncorrectPassphrase)
+
+			signer, err := pki.LoadEncryptedKey(keyPath, []byte("s3cret"))
+			require.NoError(t, err)
+
+			files.CAKey, files.Signer = "", signer
+
+			store, err := pki.Load(files)
+			require.NoError(t, err)
+			assert.Equal(t, ca.Crt.Raw, store.Current().CA.Raw)
+		})
+	}
+
+	_, err = pki.LoadEncryptedKey(writeFile(t, "plain.key", string(ca.KeyPEM)), []byte("s3cret"))
+	assert.ErrorContains(t, err, "not an encrypted private key")
+}
+
+func TestReadPassphrase(t *testing.T) {
+	passphrase, err := pki.ReadPassphrase("file:" + writeFile(t, "passphrase", "s3cret\n"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("s3cret"), passphrase)
+
+	t.Setenv("TRUSTD_TEST_PASSPHRASE", "s3cret")
+
+	passphrase, err = pki.ReadPassphrase("env:TRUSTD_TEST_PASSPHRASE")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("s3cret"), passphrase)
+
+	// removed from the environment once read
+	_, ok := os.LookupEnv("TRUSTD_TEST_PASSPHRASE")
+	assert.False(t, ok)
+
+	t.Setenv("CREDENTIALS_DIRECTORY", filepath.Dir(writeFile(t, "ca-passphrase", "s3cret")))
+
+	passphrase, err = pki.ReadPassphrase("credential:ca-passphrase")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("s3cret"), passphrase)
+
+	for _, source := range []string{"s3cret", "file:", "vault:secret", "file:" + writeFile(t, "empty", "\n")} {
+		_, err = pki.ReadPassphrase(source)
+		assert.Error(t, err, source)
+	}
+}
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+
+	return path
+}
+
+func TestCheck(t *testing.T) {
+	now := time.Now()
+	ca := newCA(t)
+
+	// a server certificate issued by the CA for trustd.example.com, expiring
+	// in a day
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	der, err := stdx509.CreateCertificate(rand.Reader, &stdx509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "trustd"},
+		DNSNames:     []string{"trustd.example.com"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(24 * time.Hour),
+		ExtKeyUsage:  []stdx509.ExtKeyUsage{stdx509.ExtKeyUsageServerAuth},
+	}, ca.Crt, pub, ca.Key)
+	require.NoError(t, err)
+
+	leaf, err := stdx509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	m := &pki.Material{
+		CA:              ca.Crt,
+		AcceptedCACerts: []*stdx509.Certificate{ca.Crt},
+		ServerCert:      &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf},
+	}
+
+	report := m.Check(pki.CheckOptions{Now: now, ExpiryWarning: time.Minute, Addresses: []string{"trustd.example.com"}})
+	assert.False(t, report.Failed())
+	assert.Empty(t, report.Problems())
+
+	// the server certificate expires within the warning horizon and lacks a
+	// SAN for an address, the CA expires before issued certificates would
+	report = m.Check(pki.CheckOptions{
+		Now:           now,
+		ExpiryWarning: 48 * time.Hour,
+		CertValidity:  2 * time.Hour,
+		Addresses:     []string{"trustd.example.com", "192.0.2.1"},
+	})
+	assert.True(t, report.Failed())
+
+	problems := report.Problems()
+	require.Len(t, problems, 5)
+	assert.Equal(t, pki.Finding{Severity: pki.SeverityWarning, Subject: "signing CA", Message: problems[0].Message}, problems[0])
+	assert.Contains(t, problems[0].Message, "expires in")
+	assert.Contains(t, problems[1].Message, "certificate validity of 2h0m0s")
+	assert.Equal(t, pki.SeverityWarning, problems[2].Severity)
+	assert.Equal(t, `accepted CA ""`, problems[2].Subject)
+	assert.Equal(t, pki.SeverityWarning, problems[3].Severity)
+	assert.Equal(t, "server certificate", problems[3].Subject)
+	assert.Equal(t, pki.SeverityError, problems[4].Severity)
+	assert.Contains(t, problems[4].Message, "no SAN for 192.0.2.1")
+
+	var sb strings.Builder
+
+	_, err = report.WriteTo(&sb)
+	require.NoError(t, err)
+	assert.Contains(t, sb.String(), "ERROR   server certificate: no SAN for 192.0.2.1")
+
+	// a CA without the certSign key usage, and accepted CAs which don't
+	// verify the server certificate
+	other, err := stdx509.ParseCertificate(pemBytes(t, newCertificate(t, "other-ca", true, now.Add(-time.Hour), now.Add(time.Hour))))
+	require.NoError(t, err)
+
+	noCertSign := *ca.Crt
+	noCertSign.KeyUsage = stdx509.KeyUsageDigitalSignature
+	m.CA = &noCertSign
+	m.AcceptedCACerts = []*stdx509.Certificate{other}
+
+	report = m.Check(pki.CheckOptions{Now: now})
+	assert.True(t, report.Failed())
+
+	problems = report.Problems()
+	require.Len(t, problems, 2)
+	assert.Equal(t, pki.SeverityError, problems[0].Severity)
+	assert.Contains(t, problems[0].Message, "certSign")
+	assert.Equal(t, pki.SeverityWarning, problems[1].Severity)
+	assert.Contains(t, problems[1].Message, "not verified by the accepted CAs")
+}
+
+// pemBytes returns the DER bytes of a PEM block.
+func pemBytes(t *testing.T, data []byte) []byte {
+	t.Helper()
+
+	block, _ := pem.Decode(data)
+	require.NotNil(t, block)
+
+	return block.Bytes
+}
+
+func TestActivateInterrupted(t *testing.T) {
+	oldCA, nextCA := newCA(t), newCA(t)
+
+	// steps are the renames and removals of an activation, in order.
+	steps := []func(dir string) error{
+		func(dir string) error {
+			return os.Rename(filepath.Join(dir, "next"), filepath.Join(dir, "current.new"))
+		},
+		func(dir string) error {
+			return os.Rename(filepath.Join(dir, "current"), filepath.Join(dir, "current.old"))
+		},
+		func(dir string) error {
+			return os.Rename(filepath.Join(dir, "current.new"), filepath.Join(dir, "current"))
+		},
+		func(dir string) error { return os.Remove(filepath.Join(dir, "current.old", "ca.key")) },
+	}
+
+	for done := range len(steps) + 1 {
+		t.Run(fmt.Sprintf("after %d steps", done), func(t *testing.T) {
+			dir := t.TempDir()
+			require.NoError(t, os.Mkdir(filepath.Join(dir, "current"), 0755))
+			require.NoError(t, os.WriteFile(filepath.Join(dir, "current", "ca.crt"), oldCA.CrtPEM, 0644))
+			require.NoError(t, os.WriteFile(filepath.Join(dir, "current", "ca.key"), oldCA.KeyPEM, 0600))
+			require.NoError(t, pki.Introduce(dir, nextCA.CrtPEM, nextCA.KeyPEM, false))
+
+			for _, step := range steps[:done] {
+				require.NoError(t, step(dir))
+			}
+
+			assert.Equal(t, done > 0, pki.ActivationPending(dir))
+
+			// the server keeps loading the rotation, with both CAs trusted
+			store, err := pki.Load(pki.Files{CADir: dir})
+			require.NoError(t, err)
+
+			m := store.Current()
+			if done < 2 {
+				assert.Equal(t, oldCA.Crt.Raw, m.CA.Raw)
+				require.NotNil(t, m.Next)
+				assert.Equal(t, nextCA.Crt.Raw, m.Next.Raw)
+			} else {
+				assert.Equal(t, nextCA.Crt.Raw, m.CA.Raw)
+				require.NotNil(t, m.Previous)
+				assert.Equal(t, oldCA.Crt.Raw, m.Previous.Raw)
+			}
+
+			if done > 0 {
+				assert.Error(t, pki.Introduce(dir, nextCA.CrtPEM, nextCA.KeyPEM, false))
+				assert.Error(t, pki.Retire(dir))
+			}
+
+			require.NoError(t, pki.Activate(dir))
+			assert.False(t, pki.ActivationPending(dir))
+			assert.NoFileExists(t, filepath.Join(dir, "previous", "ca.key"))
+			assert.Error(t, pki.Activate(dir))
+
+			_, err = store.Reload()
+			require.NoError(t, err)
+
+			m = store.Current()
+			assert.Equal(t, nextCA.Crt.Raw, m.CA.Raw)
+			assert.Nil(t, m.Next)
+			require.NotNil(t, m.Previous)
+			assert.Equal(t, oldCA.Crt.Raw, m.Previous.Raw)
+		})
+	}
+}
@@ -0,0 +1,308 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package pki
+
+import (
+	"bytes"
+	"crypto/rand"
+	stdx509 "crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/siderolabs/crypto/x509"
+)
+
+// Layout of a CA rotation directory:
+//
+//	<dir>/current/ca.crt, ca.key  signs issued certificates
+//	<dir>/next/ca.crt, ca.key     trusted, becomes current on activation
+//	<dir>/previous/ca.crt         trusted until retired
+//	<dir>/cross-signed.crt        the next (later current) CA signed by the
+//	                              current (later previous) CA
+//
+// An activation moves next to current.new and current to current.old before
+// renaming current.new to current, so that an interrupted activation leaves
+// either directory behind. Until it is resumed, current.new is read as the
+// current CA if current is missing and as the next CA otherwise, and
+// current.old is read as the previous CA.
+const (
+	currentDir      = "current"
+	nextDir         = "next"
+	previousDir     = "previous"
+	currentNewDir   = "current.new"
+	currentOldDir   = "current.old"
+	caCertFile      = "ca.crt"
+	caKeyFile       = "ca.key"
+	crossSignedFile = "cross-signed.crt"
+)
+
+// parseRotation fills in the CAs of the rotation in dir.
+func parseRotation(m *Material, dir string, contents map[string][]byte) error {
+	current, next := currentDir, nextDir
+
+	if _, ok := contents[filepath.Join(dir, currentDir, caCertFile)]; !ok {
+		current = currentNewDir
+	}
+
+	if _, ok := contents[filepath.Join(dir, nextDir, caCertFile)]; !ok && current == currentDir {
+		next = currentNewDir
+	}
+
+	previous := previousDir
+	if _, ok := contents[filepath.Join(dir, previousDir, caCertFile)]; !ok {
+		previous = currentOldDir
+	}
+
+	for _, name := range []string{caCertFile, caKeyFile} {
+		if _, ok := contents[filepath.Join(dir, current, name)]; !ok {
+			return fmt.Errorf("current CA: %s is missing", filepath.Join(dir, currentDir, name))
+		}
+	}
+
+	var err error
+
+	m.CA, m.CAKey, err = parseCA(&x509.PEMEncodedCertificateAndKey{
+		Crt: contents[filepath.Join(dir, current, caCertFile)],
+		Key: contents[filepath.Join(dir, current, caKeyFile)],
+	})
+	if err != nil {
+		return fmt.Errorf("current CA: %w", err)
+	}
+
+	if err = validateCA(m.CA, m.CAKey); err != nil {
+		return fmt.Errorf("invalid current CA: %w", err)
+	}
+
+	for _, slot := range []struct {
+		name string
+		dir  string
+		cert **stdx509.Certificate
+	}{
+		{nextDir, next, &m.Next},
+		{previousDir, previous, &m.Previous},
+	} {
+		data, ok := contents[filepath.Join(dir, slot.dir, caCertFile)]
+		if !ok {
+			continue
+		}
+
+		if *slot.cert, err = parseCertificate(data); err != nil {
+			return fmt.Errorf("%s CA: %w", slot.name, err)
+		}
+
+		if !(*slot.cert).IsCA {
+			return fmt.Errorf("%s CA: certificate is not a CA", slot.name)
+		}
+	}
+
+	data, ok := contents[filepath.Join(dir, crossSignedFile)]
+	if !ok {
+		return nil
+	}
+
+	cross, err := parseCertificate(data)
+	if err != nil {
+		return fmt.Errorf("cross-signed CA: %w", err)
+	}
+
+	// before activation, the cross-signed certificate is for the next CA
+	if bytes.Equal(cross.RawSubject, m.CA.RawSubject) && bytes.Equal(cross.RawSubjectPublicKeyInfo, m.CA.RawSubjectPublicKeyInfo) {
+		m.CrossSigned = cross
+	}
+
+	return nil
+}
+
+func parseCertificate(data []byte) (*stdx509.Certificate, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("no PEM certificate found")
+	}
+
+	return stdx509.ParseCertificate(block.Bytes)
+}
+
+// Introduce adds a new CA as the next CA of the rotation in dir: it is
+// trusted by clients, but doesn't sign yet. With crossSign, the new CA is
+// also signed by the current CA, so that certificates issued after
+// activation verify against the current CA as well.
+func Introduce(dir string, certPEM, keyPEM []byte, crossSign bool) error {
+	if ActivationPending(dir) {
+		return errors.New("an interrupted activation must be finished first")
+	}
+
+	if exists(filepath.Join(dir, nextDir)) {
+		return errors.New("a next CA was already introduced")
+	}
+
+	next, nextKey, err := parseCA(&x509.PEMEncodedCertificateAndKey{Crt: certPEM, Key: keyPEM})
+	if err != nil {
+		return err
+	}
+
+	if err = validateCA(next, nextKey); err != nil {
+		return fmt.Errorf("invalid new CA: %w", err)
+	}
+
+	current, currentKey, err := LoadCA(filepath.Join(dir, currentDir, caCertFile), filepath.Join(dir, currentDir, caKeyFile))
+	if err != nil {
+		return fmt.Errorf("current CA: %w", err)
+	}
+
+	if bytes.Equal(next.RawSubjectPublicKeyInfo, current.RawSubjectPublicKeyInfo) {
+		return errors.New("the new CA uses the key of the current CA")
+	}
+
+	if crossSign {
+		serial, err := x509.NewSerialNumber()
+		if err != nil {
+			return err
+		}
+
+		notAfter := next.NotAfter
+		if current.NotAfter.Before(notAfter) {
+			notAfter = current.NotAfter
+		}
+
+		der, err := stdx509.CreateCertificate(rand.Reader, &stdx509.Certificate{
+			SerialNumber:          serial,
+			RawSubject:            next.RawSubject,
+			SubjectKeyId:          next.SubjectKeyId,
+			NotBefore:             next.NotBefore,
+			NotAfter:              notAfter,
+			KeyUsage:              next.KeyUsage,
+			ExtKeyUsage:           next.ExtKeyUsage,
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+			MaxPathLen:            next.MaxPathLen,
+			MaxPathLenZero:        next.MaxPathLenZero,
+		}, current, next.PublicKey, currentKey)
+		if err != nil {
+			return fmt.Errorf("failed to cross-sign the new CA: %w", err)
+		}
+
+		if err = writeFileAtomic(filepath.Join(dir, crossSignedFile), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+			return err
+		}
+	}
+
+	tmp, err := os.MkdirTemp(dir, ".next-")
+	if err != nil {
+		return err
+	}
+
+	defer os.RemoveAll(tmp)
+
+	if err = os.WriteFile(filepath.Join(tmp, caCertFile), certPEM, 0644); err != nil {
+		return err
+	}
+
+	if err = os.WriteFile(filepath.Join(tmp, caKeyFile), keyPEM, 0600); err != nil {
+		return err
+	}
+
+	if err = os.Chmod(tmp, 0755); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, filepath.Join(dir, nextDir))
+}
+
+// Activate makes the next CA current, so that it signs new certificates, and
+// keeps the current CA trusted as the previous one. An interrupted activation
+// is finished by calling Activate again.
+func Activate(dir string) error {
+	if !ActivationPending(dir) {
+		if !exists(filepath.Join(dir, nextDir)) {
+			return errors.New("no next CA was introduced")
+		}
+
+		if exists(filepath.Join(dir, previousDir)) {
+			return errors.New("the previous CA must be retired first")
+		}
+
+		if err := os.Rename(filepath.Join(dir, nextDir), filepath.Join(dir, currentNewDir)); err != nil {
+			return err
+		}
+	}
+
+	if exists(filepath.Join(dir, currentNewDir)) {
+		if exists(filepath.Join(dir, currentDir)) {
+			if err := os.Rename(filepath.Join(dir, currentDir), filepath.Join(dir, currentOldDir)); err != nil {
+				return err
+			}
+		}
+
+		if err := os.Rename(filepath.Join(dir, currentNewDir), filepath.Join(dir, currentDir)); err != nil {
+			return err
+		}
+	}
+
+	// the previous CA doesn't sign anything anymore
+	if err := os.Remove(filepath.Join(dir, currentOldDir, caKeyFile)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	return os.Rename(filepath.Join(dir, currentOldDir), filepath.Join(dir, previousDir))
+}
+
+// ActivationPending reports whether an activation of the rotation in dir was
+// interrupted and has to be finished with Activate.
+func ActivationPending(dir string) bool {
+	return exists(filepath.Join(dir, currentNewDir)) || exists(filepath.Join(dir, currentOldDir))
+}
+
+// Retire stops trusting the previous CA and drops the cross-signed CA.
+func Retire(dir string) error {
+	if ActivationPending(dir) {
+		return errors.New("an interrupted activation must be finished first")
+	}
+
+	if !exists(filepath.Join(dir, previousDir)) {
+		return errors.New("there is no previous CA")
+	}
+
+	if err := os.Remove(filepath.Join(dir, crossSignedFile)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	return os.RemoveAll(filepath.Join(dir, previousDir))
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+
+	return err == nil
+}
+
+// writeFileAtomic replaces a file without exposing partial contents.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+
+		return err
+	}
+
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	if err = os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,121 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package pki
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// reloadDelay batches the events of a single update, e.g. a certificate and
+// its key written one after the other.
+const reloadDelay = 250 * time.Millisecond
+
+// Watch reloads the store whenever the files change, until the context is
+// canceled. name identifies the store in log messages.
+//
+// Changes are detected with inotify on the directories holding the files,
+// which catches Kubernetes volumes swapping a ..data symlink, and by polling
+// every interval as a fallback for file systems without notifications. A
+// zero interval disables polling.
+func (s *Store) Watch(ctx context.Context, name string, interval time.Duration) {
+	var events <-chan fsnotify.Event
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		slog.Warn("file notifications unavailable, relying on polling", "name", name, "error", err)
+	} else {
+		defer watcher.Close()
+
+		for _, dir := range s.dirs() {
+			if err = watcher.Add(dir); err != nil {
+				slog.Warn("failed to watch directory, relying on polling", "name", name, "dir", dir, "error", err)
+			}
+		}
+
+		events = watcher.Events
+
+		go func() {
+			for err := range watcher.Errors {
+				slog.Warn("file watcher error", "name", name, "error", err)
+			}
+		}()
+	}
+
+	var poll <-chan time.Time
+
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		poll = ticker.C
+	}
+
+	debounce := time.NewTimer(reloadDelay)
+	debounce.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case _, ok := <-events:
+			if !ok {
+				events = nil
+
+				continue
+			}
+
+			debounce.Reset(reloadDelay)
+
+			continue
+		case <-poll:
+		case <-debounce.C:
+		}
+
+		changed, err := s.Reload()
+
+		switch {
+		case err != nil:
+			slog.Error("reloading key material failed, keeping the previous material", "name", name, "error", err)
+		case changed:
+			slog.Info("reloaded key material", "name", name)
+		}
+	}
+}
+
+// dirs returns the directories holding the files, and the accepted CAs
+// directories. For a CA rotation, its top directory is watched, where the
+// phase changes rename subdirectories.
+func (s *Store) dirs() []string {
+	var dirs []string
+
+	if s.files.CADir != "" {
+		dirs = append(dirs, s.files.CADir)
+	}
+
+	for _, path := range []string{s.files.CACert, s.files.CAKey, s.files.CAChain, s.files.ServerCert, s.files.ServerKey, s.files.ClientCAs} {
+		if path != "" {
+			dirs = append(dirs, filepath.Dir(path))
+		}
+	}
+
+	for _, path := range s.files.AcceptedCAs {
+		if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+			dirs = append(dirs, path)
+		} else {
+			dirs = append(dirs, filepath.Dir(path))
+		}
+	}
+
+	slices.Sort(dirs)
+
+	return slices.Compact(dirs)
+}
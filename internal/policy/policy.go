@@ -0,0 +1,391 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package policy implements declarative checks applied to CSRs before they are signed.
+package policy
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"fmt"
+	"net/netip"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"gopkg.in/yaml.v3"
+)
+
+// Rule names reported in violations.
+const (
+	RuleMaxSANs                 = "maxSANs"
+	RuleAllowedIPCIDRs          = "allowedIPCIDRs"
+	RuleAllowedDNSNames         = "allowedDNSNames"
+	RuleRequireCommonNameInSANs = "requireCommonNameInSANs"
+	RuleRejectWildcards         = "rejectWildcards"
+	RuleAllowedKeyTypes         = "allowedKeyTypes"
+	RuleMinRSAKeyBits           = "minRSAKeyBits"
+	RuleRequireClientCert       = "requireClientCertificate"
+	RuleClientCertSANs          = "clientCertificateSANs"
+)
+
+// Config is the on-disk representation of a policy.
+//
+// Empty fields disable the corresponding rule.
+type Config struct {
+	// MaxSANs caps the total number of DNS and IP SANs.
+	MaxSANs int `yaml:"maxSANs"`
+	// AllowedIPCIDRs restricts IP SANs to the listed prefixes.
+	AllowedIPCIDRs []string `yaml:"allowedIPCIDRs"`
+	// AllowedDNSNames restricts DNS SANs to names matching one of the glob
+	// patterns (matched label by label, e.g. "*.nodes.example.local") or, when
+	// the pattern is wrapped in slashes ("/node-[0-9]+/"), the regular expression,
+	// which must match the whole name.
+	AllowedDNSNames []string `yaml:"allowedDNSNames"`
+	// RequireCommonNameInSANs requires the subject CN to equal one of the SANs.
+	RequireCommonNameInSANs bool `yaml:"requireCommonNameInSANs"`
+	// RejectWildcards rejects wildcard DNS SANs and common names.
+	RejectWildcards bool `yaml:"rejectWildcards"`
+	// AllowedKeyTypes restricts the CSR public key type (ed25519, ecdsa, rsa).
+	AllowedKeyTypes []string `yaml:"allowedKeyTypes"`
+	// MinRSAKeyBits is the minimum size of RSA keys.
+	MinRSAKeyBits int `yaml:"minRSAKeyBits"`
+	// RequireClientCertificate requires the caller to present a verified
+	// TLS client certificate (see --client-auth).
+	RequireClientCertificate bool `yaml:"requireClientCertificate"`
+	// ClientCertificateSANs restricts the DNS and IP SANs of the CSR to the
+	// SANs of the verified client certificate, so that a node only obtains
+	// certificates for its own names. It implies RequireClientCertificate.
+	ClientCertificateSANs bool `yaml:"clientCertificateSANs"`
+}
+
+// Violation describes a failed policy rule.
+type Violation struct {
+	Rule    string
+	Code    codes.Code
+	Message string
+}
+
+// Error implements error.
+func (v *Violation) Error() string {
+	return fmt.Sprintf("policy rule %s violated: %s", v.Rule, v.Message)
+}
+
+// Policy is a compiled CSR policy.
+type Policy struct {
+	cfg      Config
+	ipCIDRs  []netip.Prefix
+	dnsGlobs []string
+	dnsRegex []*regexp.Regexp
+}
+
+// Load reads and compiles a policy from a YAML file.
+func Load(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read policy: %w", err)
+	}
+
+	var cfg Config
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+
+	if err = dec.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse policy %s: %w", path, err)
+	}
+
+	return New(cfg)
+}
+
+// New compiles a policy from its configuration.
+func New(cfg Config) (*Policy, error) {
+	p := &Policy{cfg: cfg}
+
+	for _, cidr := range cfg.AllowedIPCIDRs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s entry %q: %w", RuleAllowedIPCIDRs, cidr, err)
+		}
+
+		p.ipCIDRs = append(p.ipCIDRs, prefix.Masked())
+	}
+
+	for _, pattern := range cfg.AllowedDNSNames {
+		if len(pattern) > 1 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+			// anchored, so that the pattern can't be embedded in a longer name
+			re, err := regexp.Compile("^(?:" + pattern[1:len(pattern)-1] + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s regexp %q: %w", RuleAllowedDNSNames, pattern, err)
+			}
+
+			p.dnsRegex = append(p.dnsRegex, re)
+
+			continue
+		}
+
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid %s pattern %q: %w", RuleAllowedDNSNames, pattern, err)
+		}
+
+		p.dnsGlobs = append(p.dnsGlobs, strings.ToLower(pattern))
+	}
+
+	for _, keyType := range cfg.AllowedKeyTypes {
+		switch keyType {
+		case "ed25519", "ecdsa", "rsa":
+		default:
+			return nil, fmt.Errorf("invalid %s entry %q", RuleAllowedKeyTypes, keyType)
+		}
+	}
+
+	return p, nil
+}
+
+// RequiresClientCertificate reports whether the policy only accepts CSRs of
+// callers presenting a verified TLS client certificate.
+func (p *Policy) RequiresClientCertificate() bool {
+	return p != nil && (p.cfg.RequireClientCertificate || p.cfg.ClientCertificateSANs)
+}
+
+// Evaluate checks the CSR against all configured rules and returns the first
+// violation, or nil if the CSR is acceptable. client is the verified TLS
+// client certificate of the caller, nil if it presented none.
+func (p *Policy) Evaluate(csr *x509.CertificateRequest, client *x509.Certificate) *Violation {
+	if p == nil {
+		return nil
+	}
+
+	checks := []func(*x509.CertificateRequest) *Violation{
+		p.checkKeyType,
+		p.checkMaxSANs,
+		p.checkWildcards,
+		p.checkCommonName,
+		p.checkIPAddresses,
+		p.checkDNSNames,
+	}
+
+	for _, check := range checks {
+		if v := check(csr); v != nil {
+			return v
+		}
+	}
+
+	return p.checkClientCertificate(csr, client)
+}
+
+func (p *Policy) checkKeyType(csr *x509.CertificateRequest) *Violation {
+	var keyType string
+
+	switch key := csr.PublicKey.(type) {
+	case ed25519.PublicKey:
+		keyType = "ed25519"
+	case *ecdsa.PublicKey:
+		keyType = "ecdsa"
+	case *rsa.PublicKey:
+		keyType = "rsa"
+
+		if p.cfg.MinRSAKeyBits > 0 && key.N.BitLen() < p.cfg.MinRSAKeyBits {
+			return &Violation{
+				Rule:    RuleMinRSAKeyBits,
+				Code:    codes.InvalidArgument,
+				Message: fmt.Sprintf("RSA key has %d bits, at least %d required", key.N.BitLen(), p.cfg.MinRSAKeyBits),
+			}
+		}
+	default:
+		keyType = fmt.Sprintf("%T", key)
+	}
+
+	if len(p.cfg.AllowedKeyTypes) > 0 && !slices.Contains(p.cfg.AllowedKeyTypes, keyType) {
+		return &Violation{
+			Rule:    RuleAllowedKeyTypes,
+			Code:    codes.InvalidArgument,
+			Message: fmt.Sprintf("key type %s is not allowed", keyType),
+		}
+	}
+
+	return nil
+}
+
+func (p *Policy) checkMaxSANs(csr *x509.CertificateRequest) *Violation {
+	n := len(csr.DNSNames) + len(csr.IPAddresses)
+
+	if p.cfg.MaxSANs > 0 && n > p.cfg.MaxSANs {
+		return &Violation{
+			Rule:    RuleMaxSANs,
+			Code:    codes.InvalidArgument,
+			Message: fmt.Sprintf("CSR requests %d SANs, at most %d allowed", n, p.cfg.MaxSANs),
+		}
+	}
+
+	return nil
+}
+
+func (p *Policy) checkWildcards(csr *x509.CertificateRequest) *Violation {
+	if !p.cfg.RejectWildcards {
+		return nil
+	}
+
+	for _, name := range append([]string{csr.Subject.CommonName}, csr.DNSNames...) {
+		if strings.Contains(name, "*") {
+			return &Violation{
+				Rule:    RuleRejectWildcards,
+				Code:    codes.InvalidArgument,
+				Message: fmt.Sprintf("wildcard name %q is not allowed", name),
+			}
+		}
+	}
+
+	return nil
+}
+
+func (p *Policy) checkCommonName(csr *x509.CertificateRequest) *Violation {
+	if !p.cfg.RequireCommonNameInSANs {
+		return nil
+	}
+
+	cn := csr.Subject.CommonName
+
+	for _, name := range csr.DNSNames {
+		if strings.EqualFold(name, cn) {
+			return nil
+		}
+	}
+
+	if addr, err := netip.ParseAddr(cn); err == nil {
+		for _, ip := range csr.IPAddresses {
+			if sanAddr, ok := netip.AddrFromSlice(ip); ok && sanAddr.Unmap() == addr.Unmap() {
+				return nil
+			}
+		}
+	}
+
+	return &Violation{
+		Rule:    RuleRequireCommonNameInSANs,
+		Code:    codes.InvalidArgument,
+		Message: fmt.Sprintf("common name %q is not among the requested SANs", cn),
+	}
+}
+
+func (p *Policy) checkIPAddresses(csr *x509.CertificateRequest) *Violation {
+	if len(p.ipCIDRs) == 0 {
+		return nil
+	}
+
+	for _, ip := range csr.IPAddresses {
+		addr, _ := netip.AddrFromSlice(ip)
+		addr = addr.Unmap()
+
+		if !slices.ContainsFunc(p.ipCIDRs, func(prefix netip.Prefix) bool { return prefix.Contains(addr) }) {
+			return &Violation{
+				Rule:    RuleAllowedIPCIDRs,
+				Code:    codes.PermissionDenied,
+				Message: fmt.Sprintf("IP SAN %s is outside the allowed CIDRs", ip),
+			}
+		}
+	}
+
+	return nil
+}
+
+func (p *Policy) checkDNSNames(csr *x509.CertificateRequest) *Violation {
+	if len(p.dnsGlobs) == 0 && len(p.dnsRegex) == 0 {
+		return nil
+	}
+
+	for _, name := range csr.DNSNames {
+		if !p.dnsNameAllowed(name) {
+			return &Violation{
+				Rule:    RuleAllowedDNSNames,
+				Code:    codes.PermissionDenied,
+				Message: fmt.Sprintf("DNS SAN %q does not match any allowed pattern", name),
+			}
+		}
+	}
+
+	return nil
+}
+
+func (p *Policy) checkClientCertificate(csr *x509.CertificateRequest, client *x509.Certificate) *Violation {
+	if !p.RequiresClientCertificate() {
+		return nil
+	}
+
+	if client == nil {
+		return &Violation{
+			Rule:    RuleRequireClientCert,
+			Code:    codes.PermissionDenied,
+			Message: "a verified client certificate is required",
+		}
+	}
+
+	if !p.cfg.ClientCertificateSANs {
+		return nil
+	}
+
+	for _, name := range csr.DNSNames {
+		if !slices.ContainsFunc(client.DNSNames, func(n string) bool { return strings.EqualFold(n, name) }) {
+			return &Violation{
+				Rule:    RuleClientCertSANs,
+				Code:    codes.PermissionDenied,
+				Message: fmt.Sprintf("DNS SAN %q is not among the SANs of the client certificate %q", name, client.Subject),
+			}
+		}
+	}
+
+	for _, ip := range csr.IPAddresses {
+		if !slices.ContainsFunc(client.IPAddresses, ip.Equal) {
+			return &Violation{
+				Rule:    RuleClientCertSANs,
+				Code:    codes.PermissionDenied,
+				Message: fmt.Sprintf("IP SAN %s is not among the SANs of the client certificate %q", ip, client.Subject),
+			}
+		}
+	}
+
+	return nil
+}
+
+func (p *Policy) dnsNameAllowed(name string) bool {
+	name = strings.ToLower(name)
+
+	for _, glob := range p.dnsGlobs {
+		if matchLabels(glob, name) {
+			return true
+		}
+	}
+
+	for _, re := range p.dnsRegex {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchLabels matches a DNS name against a glob pattern label by label, so
+// that "*" never spans a dot.
+func matchLabels(pattern, name string) bool {
+	patternLabels := strings.Split(pattern, ".")
+	nameLabels := strings.Split(name, ".")
+
+	if len(patternLabels) != len(nameLabels) {
+		return false
+	}
+
+	for i := range patternLabels {
+		if ok, _ := path.Match(patternLabels[i], nameLabels[i]); !ok {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,236 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package policy_test
+
+import (
+	stdx509 "crypto/x509"
+	"encoding/pem"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/siderolabs/crypto/x509"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+
+	"github.com/cozystack/standalone-trustd/internal/policy"
+)
+
+func newCSR(t *testing.T, cn string, dnsNames []string, ips ...string) *stdx509.CertificateRequest {
+	t.Helper()
+
+	var parsedIPs []net.IP
+	for _, ip := range ips {
+		parsedIPs = append(parsedIPs, net.ParseIP(ip))
+	}
+
+	csr, _, err := x509.NewEd25519CSRAndIdentity(
+		x509.CommonName(cn),
+		x509.DNSNames(dnsNames),
+		x509.IPAddresses(parsedIPs),
+	)
+	require.NoError(t, err)
+
+	block, _ := pem.Decode(csr.X509CertificateRequestPEM)
+	require.NotNil(t, block)
+
+	request, err := stdx509.ParseCertificateRequest(block.Bytes)
+	require.NoError(t, err)
+
+	return request
+}
+
+func TestEvaluate(t *testing.T) {
+	workerCert := &stdx509.Certificate{
+		DNSNames:    []string{"worker-1.example.com"},
+		IPAddresses: []net.IP{net.ParseIP("10.0.0.1")},
+	}
+
+	for _, tc := range []struct {
+		name   string
+		cfg    policy.Config
+		csr    *stdx509.CertificateRequest
+		client *stdx509.Certificate
+		rule   string
+		code   codes.Code
+	}{
+		{
+			name: "empty policy",
+			csr:  newCSR(t, "*", []string{"*.example.com"}, "1.2.3.4"),
+		},
+		{
+			name: "max SANs",
+			cfg:  policy.Config{MaxSANs: 2},
+			csr:  newCSR(t, "node", []string{"node", "node.local"}, "10.0.0.1"),
+			rule: policy.RuleMaxSANs,
+			code: codes.InvalidArgument,
+		},
+		{
+			name: "IP inside CIDR",
+			cfg:  policy.Config{AllowedIPCIDRs: []string{"10.0.0.0/8"}},
+			csr:  newCSR(t, "node", nil, "10.1.2.3"),
+		},
+		{
+			name: "IP outside CIDR",
+			cfg:  policy.Config{AllowedIPCIDRs: []string{"10.0.0.0/8"}},
+			csr:  newCSR(t, "node", nil, "10.1.2.3", "192.168.0.1"),
+			rule: policy.RuleAllowedIPCIDRs,
+			code: codes.PermissionDenied,
+		},
+		{
+			name: "DNS glob match",
+			cfg:  policy.Config{AllowedDNSNames: []string{"*.nodes.tenant-foo.local"}},
+			csr:  newCSR(t, "node", []string{"worker-1.nodes.tenant-foo.local"}),
+		},
+		{
+			name: "DNS glob does not span labels",
+			cfg:  policy.Config{AllowedDNSNames: []string{"*.nodes.tenant-foo.local"}},
+			csr:  newCSR(t, "node", []string{"a.worker-1.nodes.tenant-foo.local"}),
+			rule: policy.RuleAllowedDNSNames,
+			code: codes.PermissionDenied,
+		},
+		{
+			name: "DNS regexp match",
+			cfg:  policy.Config{AllowedDNSNames: []string{"/^worker-[0-9]+$/"}},
+			csr:  newCSR(t, "node", []string{"worker-12"}),
+		},
+		{
+			name: "DNS regexp matches the whole name",
+			cfg:  policy.Config{AllowedDNSNames: []string{"/worker-[0-9]+/"}},
+			csr:  newCSR(t, "node", []string{"worker-1.attacker.example"}),
+			rule: policy.RuleAllowedDNSNames,
+			code: codes.PermissionDenied,
+		},
+		{
+			name: "DNS regexp with a prefix",
+			cfg:  policy.Config{AllowedDNSNames: []string{"/worker-[0-9]+|node/"}},
+			csr:  newCSR(t, "node", []string{"evil-worker-1"}),
+			rule: policy.RuleAllowedDNSNames,
+			code: codes.PermissionDenied,
+		},
+		{
+			name: "CN in SANs",
+			cfg:  policy.Config{RequireCommonNameInSANs: true},
+			csr:  newCSR(t, "10.0.0.1", []string{"worker"}, "10.0.0.1"),
+		},
+		{
+			name: "CN not in SANs",
+			cfg:  policy.Config{RequireCommonNameInSANs: true},
+			csr:  newCSR(t, "other", []string{"worker"}, "10.0.0.1"),
+			rule: policy.RuleRequireCommonNameInSANs,
+			code: codes.InvalidArgument,
+		},
+		{
+			name: "wildcard SAN",
+			cfg:  policy.Config{RejectWildcards: true},
+			csr:  newCSR(t, "node", []string{"*.example.com"}),
+			rule: policy.RuleRejectWildcards,
+			code: codes.InvalidArgument,
+		},
+		{
+			name: "key type allowed",
+			cfg:  policy.Config{AllowedKeyTypes: []string{"ed25519"}},
+			csr:  newCSR(t, "node", nil),
+		},
+		{
+			name: "key type rejected",
+			cfg:  policy.Config{AllowedKeyTypes: []string{"rsa", "ecdsa"}},
+			csr:  newCSR(t, "node", nil),
+			rule: policy.RuleAllowedKeyTypes,
+			code: codes.InvalidArgument,
+		},
+		{
+			name: "client certificate missing",
+			cfg:  policy.Config{RequireClientCertificate: true},
+			csr:  newCSR(t, "node", nil),
+			rule: policy.RuleRequireClientCert,
+			code: codes.PermissionDenied,
+		},
+		{
+			name:   "client certificate present",
+			cfg:    policy.Config{RequireClientCertificate: true},
+			csr:    newCSR(t, "node", []string{"other"}),
+			client: workerCert,
+		},
+		{
+			name: "client certificate SANs without certificate",
+			cfg:  policy.Config{ClientCertificateSANs: true},
+			csr:  newCSR(t, "node", nil),
+			rule: policy.RuleRequireClientCert,
+			code: codes.PermissionDenied,
+		},
+		{
+			name:   "client certificate SANs match",
+			cfg:    policy.Config{ClientCertificateSANs: true},
+			csr:    newCSR(t, "node", []string{"Worker-1.example.com"}, "10.0.0.1"),
+			client: workerCert,
+		},
+		{
+			name:   "client certificate SANs DNS mismatch",
+			cfg:    policy.Config{ClientCertificateSANs: true},
+			csr:    newCSR(t, "node", []string{"worker-2.example.com"}, "10.0.0.1"),
+			client: workerCert,
+			rule:   policy.RuleClientCertSANs,
+			code:   codes.PermissionDenied,
+		},
+		{
+			name:   "client certificate SANs IP mismatch",
+			cfg:    policy.Config{ClientCertificateSANs: true},
+			csr:    newCSR(t, "node", []string{"worker-1.example.com"}, "10.0.0.2"),
+			client: workerCert,
+			rule:   policy.RuleClientCertSANs,
+			code:   codes.PermissionDenied,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := policy.New(tc.cfg)
+			require.NoError(t, err)
+
+			v := p.Evaluate(tc.csr, tc.client)
+			if tc.rule == "" {
+				assert.Nil(t, v)
+
+				return
+			}
+
+			require.NotNil(t, v)
+			assert.Equal(t, tc.rule, v.Rule)
+			assert.Equal(t, tc.code, v.Code)
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+
+	path := filepath.Join(dir, "policy.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+maxSANs: 8
+allowedIPCIDRs: [10.0.0.0/8]
+allowedDNSNames: ["*.nodes.example.local"]
+rejectWildcards: true
+`), 0644))
+
+	p, err := policy.Load(path)
+	require.NoError(t, err)
+	assert.NotNil(t, p.Evaluate(newCSR(t, "node", []string{"node.other.local"}), nil))
+	assert.False(t, p.RequiresClientCertificate())
+
+	require.NoError(t, os.WriteFile(path, []byte("clientCertificateSANs: true\n"), 0644))
+
+	p, err = policy.Load(path)
+	require.NoError(t, err)
+	assert.True(t, p.RequiresClientCertificate())
+
+	require.NoError(t, os.WriteFile(path, []byte("maxSans: 8\n"), 0644))
+
+	_, err = policy.Load(path)
+	assert.Error(t, err)
+
+	_, err = policy.New(policy.Config{AllowedIPCIDRs: []string{"nope"}})
+	assert.Error(t, err)
+}
@@ -0,0 +1,105 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package registrator
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"time"
+
+	"github.com/siderolabs/crypto/x509"
+)
+
+// CAExpiryPolicy controls what happens when an issued certificate would
+// outlive the signing CA.
+type CAExpiryPolicy int
+
+// CA expiry policies.
+const (
+	// CAExpiryClamp shortens the certificate to end with the CA.
+	CAExpiryClamp CAExpiryPolicy = iota
+	// CAExpiryRefuse rejects the request with FailedPrecondition.
+	CAExpiryRefuse
+)
+
+// ParseCAExpiryPolicy parses a CA expiry policy name (clamp, refuse).
+func ParseCAExpiryPolicy(s string) (CAExpiryPolicy, error) {
+	switch strings.ToLower(s) {
+	case "", "clamp":
+		return CAExpiryClamp, nil
+	case "refuse":
+		return CAExpiryRefuse, nil
+	default:
+		return CAExpiryClamp, fmt.Errorf("unknown CA expiry policy %q", s)
+	}
+}
+
+// String implements fmt.Stringer.
+func (p CAExpiryPolicy) String() string {
+	switch p {
+	case CAExpiryClamp:
+		return "clamp"
+	case CAExpiryRefuse:
+		return "refuse"
+	default:
+		return fmt.Sprintf("CAExpiryPolicy(%d)", int(p))
+	}
+}
+
+// Lifetime configures the validity window of issued certificates.
+type Lifetime struct {
+	// Validity is the nominal lifetime, x509.DefaultCertificateValidityDuration if zero.
+	Validity time.Duration
+	// Backdate moves NotBefore into the past to tolerate clock skew on workers.
+	Backdate time.Duration
+	// Jitter shortens each certificate by a random amount in [0, Jitter) to
+	// spread renewals.
+	Jitter time.Duration
+	// CAExpiry decides what to do when the certificate would outlive the CA.
+	CAExpiry CAExpiryPolicy
+}
+
+// validityWindow is the outcome of applying Lifetime to a single request.
+type validityWindow struct {
+	notBefore time.Time
+	notAfter  time.Time
+	clamped   bool
+}
+
+// window computes the validity window for a certificate issued at now by a
+// CA expiring at caNotAfter.
+func (l Lifetime) window(now, caNotAfter time.Time) (validityWindow, error) {
+	validity := l.Validity
+	if validity <= 0 {
+		validity = x509.DefaultCertificateValidityDuration
+	}
+
+	// a token may shorten the validity below the jitter, skip it then
+	if l.Jitter > 0 && l.Jitter < validity {
+		validity -= rand.N(l.Jitter)
+	}
+
+	w := validityWindow{
+		notBefore: now.Add(-l.Backdate),
+		notAfter:  now.Add(validity),
+	}
+
+	if w.notAfter.After(caNotAfter) {
+		if l.CAExpiry == CAExpiryRefuse {
+			return w, fmt.Errorf("certificate would expire at %s, after the signing CA (%s)",
+				w.notAfter.UTC().Format(time.RFC3339), caNotAfter.UTC().Format(time.RFC3339))
+		}
+
+		w.notAfter = caNotAfter
+		w.clamped = true
+	}
+
+	if !w.notAfter.After(now) {
+		return w, fmt.Errorf("signing CA expired at %s", caNotAfter.UTC().Format(time.RFC3339))
+	}
+
+	return w, nil
+}
@@ -0,0 +1,136 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package registrator
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+
+	"github.com/cozystack/standalone-trustd/internal/auth"
+)
+
+// PeerIPVerification controls how the address of the caller is checked against
+// the IP SANs requested in the CSR.
+type PeerIPVerification int
+
+// Peer IP verification modes.
+const (
+	// PeerIPVerificationOff disables the check.
+	PeerIPVerificationOff PeerIPVerification = iota
+	// PeerIPVerificationWarn logs mismatches but still signs the CSR.
+	PeerIPVerificationWarn
+	// PeerIPVerificationEnforce rejects mismatching CSRs with PermissionDenied.
+	PeerIPVerificationEnforce
+)
+
+// ParsePeerIPVerification parses a verification mode name (off, warn, enforce).
+func ParsePeerIPVerification(s string) (PeerIPVerification, error) {
+	switch strings.ToLower(s) {
+	case "", "off":
+		return PeerIPVerificationOff, nil
+	case "warn":
+		return PeerIPVerificationWarn, nil
+	case "enforce":
+		return PeerIPVerificationEnforce, nil
+	default:
+		return PeerIPVerificationOff, fmt.Errorf("unknown peer IP verification mode %q", s)
+	}
+}
+
+// String implements fmt.Stringer.
+func (m PeerIPVerification) String() string {
+	switch m {
+	case PeerIPVerificationOff:
+		return "off"
+	case PeerIPVerificationWarn:
+		return "warn"
+	case PeerIPVerificationEnforce:
+		return "enforce"
+	default:
+		return fmt.Sprintf("PeerIPVerification(%d)", int(m))
+	}
+}
+
+// ParseCIDRs parses a comma-separated list of CIDRs. Bare addresses are
+// treated as single-host prefixes, IPv4-mapped addresses and prefixes as IPv4.
+func ParseCIDRs(s string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+
+		if !strings.Contains(field, "/") {
+			addr, err := netip.ParseAddr(field)
+			if err != nil {
+				return nil, fmt.Errorf("invalid address %q: %w", field, err)
+			}
+
+			addr = addr.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", field, err)
+		}
+
+		if addr := prefix.Addr(); addr.Is4In6() && prefix.Bits() >= 96 {
+			prefix = netip.PrefixFrom(addr.Unmap(), prefix.Bits()-96)
+		}
+
+		prefixes = append(prefixes, prefix.Masked())
+	}
+
+	return prefixes, nil
+}
+
+// verifyPeerIP checks that the caller connects from one of the IP addresses
+// declared in the CSR, or from one of the always permitted prefixes, and that
+// every requested IP address is either the caller's or permitted as well.
+func verifyPeerIP(peer net.Addr, requested []net.IP, allowed []netip.Prefix) error {
+	addr, ok := auth.PeerAddr(peer)
+	if !ok {
+		return fmt.Errorf("cannot determine IP address of peer %v", peer)
+	}
+
+	isAllowed := func(a netip.Addr) bool {
+		for _, prefix := range allowed {
+			if prefix.Contains(a) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	peerMatched := isAllowed(addr)
+
+	for _, ip := range requested {
+		reqAddr, ok := netip.AddrFromSlice(ip)
+		if !ok {
+			return fmt.Errorf("invalid requested IP SAN %v", ip)
+		}
+
+		switch reqAddr = reqAddr.Unmap(); {
+		case reqAddr == addr:
+			peerMatched = true
+		case !isAllowed(reqAddr):
+			return fmt.Errorf("requested IP SAN %s is neither the peer address %s nor in an allowed CIDR", reqAddr, addr)
+		}
+	}
+
+	if !peerMatched {
+		return fmt.Errorf("peer address %s is not among the requested IP SANs and not in an allowed CIDR", addr)
+	}
+
+	return nil
+}
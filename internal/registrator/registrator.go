@@ -7,22 +7,35 @@ package registrator
 import (
 	"context"
 	stdx509 "crypto/x509"
-	"crypto/x509/pkix"
 	"encoding/pem"
-	"fmt"
-	"log"
-	"os"
+	"log/slog"
+	"net"
+	"net/netip"
+	"slices"
 	"time"
 
 	"github.com/siderolabs/crypto/x509"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
 
 	securityapi "github.com/siderolabs/talos/pkg/machinery/api/security"
+
+	"github.com/cozystack/standalone-trustd/internal/auth"
+	"github.com/cozystack/standalone-trustd/internal/ledger"
+	"github.com/cozystack/standalone-trustd/internal/metrics"
+	"github.com/cozystack/standalone-trustd/internal/pki"
+	"github.com/cozystack/standalone-trustd/internal/policy"
+	"github.com/cozystack/standalone-trustd/internal/tlsconfig"
+	"github.com/cozystack/standalone-trustd/internal/tracing"
 )
 
+// endOfTime is later than any certificate expiry.
+var endOfTime = time.Date(9999, time.December, 31, 23, 59, 59, 0, time.UTC)
+
 // Registrator implements the SecurityServiceServer interface.
 type Registrator struct {
 	securityapi.UnimplementedSecurityServiceServer
@@ -31,6 +44,45 @@ type Registrator struct {
 	CAKey       string
 	AcceptedCAs string
 	AuthToken   string
+
+	// PKI, if set, provides the CA and accepted CAs from memory instead of
+	// reading CACert, CAKey and AcceptedCAs on every request. It is required
+	// for CA rotations.
+	PKI *pki.Store
+
+	// Backend, if set, signs certificates instead of the CA. The local
+	// checks still run first.
+	Backend Backend
+
+	// OmitChain returns only the leaf in Crt, instead of the leaf followed
+	// by the intermediates up to the root.
+	OmitChain bool
+
+	// Tenant names the tenant served by this registrator in multi-tenant
+	// mode; it prefixes all log messages.
+	Tenant string
+
+	// PeerIPVerification controls whether the caller address must match one
+	// of the IP SANs in the CSR.
+	PeerIPVerification PeerIPVerification
+	// PeerIPAllowedCIDRs lists addresses (VIPs, NAT ranges) which are
+	// permitted by the peer IP verification, as the peer address or as any
+	// requested IP SAN.
+	PeerIPAllowedCIDRs []netip.Prefix
+
+	// Policy restricts the SANs, subject and key type a CSR may request.
+	Policy *policy.Policy
+
+	// Lifetime configures the validity window of issued certificates.
+	Lifetime Lifetime
+
+	// Ledger, if set, records every issued certificate.
+	Ledger *ledger.Ledger
+
+	// CRLDistributionPoints are embedded into issued certificates.
+	CRLDistributionPoints []string
+	// OCSPServers are embedded into the AIA extension of issued certificates.
+	OCSPServers []string
 }
 
 // Register implements the gRPC service registration.
@@ -48,35 +100,96 @@ func (r *Registrator) Certificate(ctx context.Context, in *securityapi.Certifica
 		return nil, status.Error(codes.PermissionDenied, "peer not found")
 	}
 
-	// Load CA certificate and key
-	caCert, caKey, err := r.loadCACertificate()
-	if err != nil {
-		return nil, status.Errorf(codes.Internal, "failed to load CA certificate: %v", err)
+	span := trace.SpanFromContext(ctx)
+	if r.Tenant != "" {
+		span.SetAttributes(attribute.String("trustd.tenant", r.Tenant))
 	}
 
-	// Load accepted CAs
-	acceptedCAs, err := r.loadAcceptedCAs()
+	// Load CA certificate, key and accepted CAs
+	_, loadSpan := tracing.Start(ctx, "trustd.load_key_material")
+	material, err := r.material()
+	tracing.End(loadSpan, err)
+
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "failed to load accepted CAs: %v", err)
+		return nil, status.Errorf(codes.Internal, "failed to load CA certificate: %v", err)
 	}
 
+	acceptedCAs := material.AcceptedCAs
+
 	// decode and validate CSR
 	csrPemBlock, _ := pem.Decode(in.Csr)
 	if csrPemBlock == nil {
-		return nil, status.Errorf(codes.InvalidArgument, "failed to decode CSR")
+		return nil, r.reject(metrics.RejectInvalidCSR, status.Errorf(codes.InvalidArgument, "failed to decode CSR"))
 	}
 
 	request, err := stdx509.ParseCertificateRequest(csrPemBlock.Bytes)
 	if err != nil {
-		return nil, status.Errorf(codes.InvalidArgument, "failed to parse CSR: %s", err)
+		return nil, r.reject(metrics.RejectInvalidCSR, status.Errorf(codes.InvalidArgument, "failed to parse CSR: %s", err))
 	}
 
-	log.Printf("received CSR from %s: subject %s dns %s ips %s", remotePeer.Addr, request.Subject, request.DNSNames, request.IPAddresses)
+	if err = request.CheckSignature(); err != nil {
+		return nil, r.reject(metrics.RejectInvalidCSR, status.Errorf(codes.InvalidArgument, "failed to verify CSR signature: %s", err))
+	}
 
-	// allow only server auth certificates
-	x509Opts := []x509.Option{
-		x509.KeyUsage(stdx509.KeyUsageDigitalSignature),
-		x509.ExtKeyUsage([]stdx509.ExtKeyUsage{stdx509.ExtKeyUsageServerAuth}),
+	span.SetAttributes(
+		attribute.String("trustd.csr.subject", request.Subject.String()),
+		attribute.Int("trustd.csr.dns_names", len(request.DNSNames)),
+		attribute.Int("trustd.csr.ip_addresses", len(request.IPAddresses)),
+	)
+
+	logger := r.logger().With("peer", remotePeer.Addr.String(), "token_name", auth.TokenName(ctx), "subject", request.Subject.String())
+
+	// the verified TLS client certificate, with --client-auth, if the client
+	// CAs of this registrator vouch for it
+	client := tlsconfig.ClientCertificate(ctx, material.ClientCACerts)
+	if client != nil {
+		logger = logger.With("client_cert", client.Subject.String())
+		span.SetAttributes(attribute.String("trustd.client_cert.subject", client.Subject.String()))
+	}
+	sans := []any{"dns", request.DNSNames, "ips", request.IPAddresses}
+
+	logger.Info("received CSR", sans...)
+
+	lifetime, err := r.evaluatePolicy(ctx, logger, remotePeer.Addr, request, client)
+	if err != nil {
+		return nil, err
+	}
+
+	// a backend building the certificate enforces the lifetime of its own CA
+	caNotAfter := endOfTime
+	switch backend := r.Backend.(type) {
+	case nil:
+		caNotAfter = material.NotAfter()
+	case IssuerExpiry:
+		if caNotAfter, err = backend.IssuerNotAfter(ctx); err != nil {
+			logger.Error("backend failed to return its issuer", "error", err)
+
+			if _, ok := status.FromError(err); ok {
+				return nil, err
+			}
+
+			return nil, status.Errorf(codes.Unavailable, "failed to get the signing CA: %s", err)
+		}
+	}
+
+	window, err := lifetime.window(time.Now(), caNotAfter)
+	if err != nil {
+		logger.Warn("refusing CSR", "error", err)
+
+		return nil, r.reject(metrics.RejectCAExpiry, status.Errorf(codes.FailedPrecondition, "cannot issue certificate: %s", err))
+	}
+
+	template := &stdx509.Certificate{
+		Subject:   request.Subject,
+		NotBefore: window.notBefore,
+		NotAfter:  window.notAfter,
+		// allow only server auth certificates
+		KeyUsage:              stdx509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []stdx509.ExtKeyUsage{stdx509.ExtKeyUsageServerAuth},
+		IPAddresses:           request.IPAddresses,
+		DNSNames:              request.DNSNames,
+		CRLDistributionPoints: r.CRLDistributionPoints,
+		OCSPServer:            r.OCSPServers,
 	}
 
 	// don't allow any certificates which can be used for client authentication
@@ -86,63 +199,193 @@ func (r *Registrator) Certificate(ctx context.Context, in *securityapi.Certifica
 	//
 	// instead, the returned certificate will be rejected when being used
 	if len(request.Subject.Organization) > 0 {
-		log.Printf("removing client auth organization from CSR: %s", request.Subject.Organization)
+		logger.Info("removing client auth organization from CSR", "organization", request.Subject.Organization)
 
-		x509Opts = append(x509Opts, x509.OverrideSubject(func(subject *pkix.Name) {
-			subject.Organization = nil
-		}))
+		template.Subject.Organization = nil
 	}
 
-	// TODO: Verify that the request is coming from the IP address declared in
-	// the CSR.
-	signed, err := x509.NewCertificateFromCSRBytes(
-		caCert,
-		caKey,
-		in.Csr,
-		x509Opts...,
-	)
+	signingStart := time.Now()
+
+	issued, err := r.sign(ctx, logger, request, template, material)
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "failed to sign CSR: %s", err)
+		return nil, err
+	}
+
+	metrics.SigningDuration.WithLabelValues(r.Tenant).Observe(time.Since(signingStart).Seconds())
+
+	signed := &x509.Certificate{
+		X509Certificate:    issued.Certificate,
+		X509CertificatePEM: pem.EncodeToMemory(&pem.Block{Type: x509.PEMTypeCertificate, Bytes: issued.Certificate.Raw}),
+	}
+	issuer, chain := issued.Chain[0], pki.Intermediates(issued.Chain)
+
+	if len(acceptedCAs) == 0 {
+		acceptedCAs = issued.CAs
+	}
+
+	span.SetAttributes(attribute.String("trustd.serial", ledger.SerialString(signed.X509Certificate)))
+
+	if r.Ledger != nil {
+		rec := ledger.NewRecord(signed.X509Certificate, issuer, remotePeer.Addr.String(), auth.TokenName(ctx))
+
+		if err = r.Ledger.Add(ctx, rec); err != nil {
+			logger.Error("failed to record certificate", "serial", rec.Serial, "error", err)
+
+			return nil, status.Errorf(codes.Internal, "failed to record issued certificate: %s", err)
+		}
+	}
+
+	crt := signed.X509CertificatePEM
+
+	// let clients build the path from the leaf to a root in the accepted CAs
+	if len(chain) > 0 && !r.OmitChain {
+		crt = slices.Clone(crt)
+
+		for _, cert := range chain {
+			crt = append(crt, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+		}
+	}
+
+	// during a CA rotation, let clients still trusting only the previous CA
+	// build a path to it
+	if material.CrossSigned != nil {
+		crt = append(slices.Clone(crt), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: material.CrossSigned.Raw})...)
 	}
 
 	resp = &securityapi.CertificateResponse{
 		Ca:  acceptedCAs,
-		Crt: signed.X509CertificatePEM,
+		Crt: crt,
 	}
 
+	metrics.CertificatesIssued.WithLabelValues(r.Tenant).Inc()
+
 	// Log successful certificate issuance without dumping full certificate
-	log.Printf("issued certificate for %s to %s: notBefore=%s notAfter=%s sanDNS=%v sanIP=%v",
-		signed.X509Certificate.Subject, remotePeer.Addr,
-		signed.X509Certificate.NotBefore.UTC().Format(time.RFC3339),
-		signed.X509Certificate.NotAfter.UTC().Format(time.RFC3339),
-		signed.X509Certificate.DNSNames,
-		signed.X509Certificate.IPAddresses,
+	logger.Info("issued certificate",
+		"serial", ledger.SerialString(signed.X509Certificate),
+		"not_before", signed.X509Certificate.NotBefore.UTC().Format(time.RFC3339),
+		"not_after", signed.X509Certificate.NotAfter.UTC().Format(time.RFC3339),
+		"validity", signed.X509Certificate.NotAfter.Sub(signed.X509Certificate.NotBefore).Round(time.Second).String(),
+		"clamped_to_ca", window.clamped,
+		"dns", signed.X509Certificate.DNSNames,
+		"ips", signed.X509Certificate.IPAddresses,
 	)
 
 	return resp, nil
 }
 
-// loadCACertificate loads the CA certificate and key from files.
-func (r *Registrator) loadCACertificate() ([]byte, []byte, error) {
-	caCert, err := os.ReadFile(r.CACert)
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to read CA certificate: %w", err)
+// evaluatePolicy checks the CSR against the peer IP verification, the CSR
+// policy and the restrictions of the token, and returns the lifetime of the
+// certificate.
+func (r *Registrator) evaluatePolicy(ctx context.Context, logger *slog.Logger, addr net.Addr, request *stdx509.CertificateRequest, client *stdx509.Certificate) (_ Lifetime, err error) {
+	_, span := tracing.Start(ctx, "trustd.evaluate_policy")
+	defer func() { tracing.End(span, err) }()
+
+	sans := []any{"dns", request.DNSNames, "ips", request.IPAddresses}
+
+	if r.PeerIPVerification != PeerIPVerificationOff {
+		if err := verifyPeerIP(addr, request.IPAddresses, r.PeerIPAllowedCIDRs); err != nil {
+			logger.Warn("peer IP verification failed", append(sans, "mode", r.PeerIPVerification.String(), "error", err)...)
+
+			if r.PeerIPVerification == PeerIPVerificationEnforce {
+				return Lifetime{}, r.reject(metrics.RejectPeerIP, status.Errorf(codes.PermissionDenied, "peer IP verification failed: %s", err))
+			}
+		}
 	}
 
-	caKey, err := os.ReadFile(r.CAKey)
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to read CA key: %w", err)
+	if v := r.Policy.Evaluate(request, client); v != nil {
+		logger.Warn("CSR rejected by policy", append(sans, "error", v)...)
+
+		return Lifetime{}, r.reject(metrics.RejectPolicy, status.Errorf(v.Code, "CSR rejected: %s", v))
+	}
+
+	lifetime := r.Lifetime
+
+	if id, ok := auth.FromContext(ctx); ok {
+		span.SetAttributes(attribute.String("trustd.token_name", id.TokenName))
+
+		if v := id.Policy.Evaluate(request, client); v != nil {
+			logger.Warn("CSR rejected by token restrictions", append(sans, "error", v)...)
+
+			return Lifetime{}, r.reject(metrics.RejectTokenPolicy, status.Errorf(codes.PermissionDenied, "CSR rejected for token %q: %s", id.TokenName, v))
+		}
+
+		if id.CertValidity > 0 {
+			lifetime.Validity = id.CertValidity
+		}
 	}
 
-	return caCert, caKey, nil
+	return lifetime, nil
 }
 
-// loadAcceptedCAs loads the accepted CA certificates from file.
-func (r *Registrator) loadAcceptedCAs() ([]byte, error) {
-	acceptedCAs, err := os.ReadFile(r.AcceptedCAs)
+// sign signs the certificate with the backend, or the CA of the material.
+func (r *Registrator) sign(ctx context.Context, logger *slog.Logger, request *stdx509.CertificateRequest, template *stdx509.Certificate, material *pki.Material) (_ *Issued, err error) {
+	ctx, span := tracing.Start(ctx, "trustd.sign")
+	defer func() { tracing.End(span, err) }()
+
+	if r.Backend == nil {
+		span.SetAttributes(attribute.String("trustd.signer", "ca"))
+
+		signed, err := signCertificate(template, material.CA, request.PublicKey, material.CAKey)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to sign CSR: %s", err)
+		}
+
+		return &Issued{
+			Certificate: signed.X509Certificate,
+			Chain:       append([]*stdx509.Certificate{material.CA}, material.Chain...),
+		}, nil
+	}
+
+	span.SetAttributes(attribute.String("trustd.signer", "backend"))
+
+	issued, err := r.Backend.Sign(ctx, request, template)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read accepted CAs: %w", err)
+		logger.Error("backend failed to sign CSR", "error", err)
+
+		if _, ok := status.FromError(err); ok {
+			return nil, err
+		}
+
+		return nil, status.Errorf(codes.Unavailable, "failed to sign CSR: %s", err)
+	}
+
+	if len(issued.Chain) == 0 {
+		return nil, status.Error(codes.Internal, "failed to sign CSR: backend returned no issuer")
+	}
+
+	return issued, nil
+}
+
+// reject counts a CSR rejected for reason and returns err.
+func (r *Registrator) reject(reason string, err error) error {
+	metrics.CSRsRejected.WithLabelValues(r.Tenant, reason).Inc()
+
+	return err
+}
+
+// logger returns the logger of the registrator, with the tenant name if
+// set.
+func (r *Registrator) logger() *slog.Logger {
+	if r.Tenant != "" {
+		return slog.With("tenant", r.Tenant)
+	}
+
+	return slog.Default()
+}
+
+// material returns the in-memory key material, or loads it from files if
+// no store is configured.
+func (r *Registrator) material() (*pki.Material, error) {
+	switch {
+	case r.PKI != nil:
+		return r.PKI.Current(), nil
+	case r.Backend != nil:
+		return &pki.Material{}, nil
 	}
 
-	return acceptedCAs, nil
+	return pki.LoadFiles(pki.Files{
+		CACert:      r.CACert,
+		CAKey:       r.CAKey,
+		AcceptedCAs: []string{r.AcceptedCAs},
+	})
 }
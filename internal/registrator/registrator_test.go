@@ -6,20 +6,41 @@ package registrator_test
 
 import (
 	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
 	stdx509 "crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/pem"
+	"errors"
 	"net"
 	"net/netip"
 	"os"
 	"path/filepath"
+	"slices"
 	"testing"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/siderolabs/crypto/x509"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
 
+	"github.com/cozystack/standalone-trustd/internal/auth"
+	"github.com/cozystack/standalone-trustd/internal/ledger"
+	"github.com/cozystack/standalone-trustd/internal/metrics"
+	"github.com/cozystack/standalone-trustd/internal/pki"
+	"github.com/cozystack/standalone-trustd/internal/policy"
 	"github.com/cozystack/standalone-trustd/internal/registrator"
 	securityapi "github.com/siderolabs/talos/pkg/machinery/api/security"
 )
@@ -156,3 +177,759 @@ func TestCertificateWithClientAuthOrganization(t *testing.T) {
 	assert.Equal(t, []string(nil), cert.Subject.Organization)
 	assert.Equal(t, "test-server", cert.Subject.CommonName)
 }
+
+func TestCertificatePeerIPVerification(t *testing.T) {
+	tempDir := t.TempDir()
+
+	ca, err := x509.NewSelfSignedCertificateAuthority(
+		x509.Organization("test-ca"),
+		x509.NotAfter(time.Now().Add(time.Hour)),
+	)
+	require.NoError(t, err)
+
+	caCertPath := filepath.Join(tempDir, "ca.crt")
+	caKeyPath := filepath.Join(tempDir, "ca.key")
+
+	require.NoError(t, os.WriteFile(caCertPath, ca.CrtPEM, 0644))
+	require.NoError(t, os.WriteFile(caKeyPath, ca.KeyPEM, 0644))
+
+	serverCSR, _, err := x509.NewEd25519CSRAndIdentity(
+		x509.IPAddresses([]net.IP{netip.MustParseAddr("10.5.0.4").AsSlice()}),
+		x509.DNSNames([]string{"test-server"}),
+		x509.CommonName("test-server"),
+	)
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		name    string
+		mode    registrator.PeerIPVerification
+		allowed []netip.Prefix
+		peer    string
+		extraIP string
+		code    codes.Code
+	}{
+		{name: "off mismatch", mode: registrator.PeerIPVerificationOff, peer: "127.0.0.1", code: codes.OK},
+		{name: "warn mismatch", mode: registrator.PeerIPVerificationWarn, peer: "127.0.0.1", code: codes.OK},
+		{name: "enforce match", mode: registrator.PeerIPVerificationEnforce, peer: "10.5.0.4", code: codes.OK},
+		{name: "enforce mapped match", mode: registrator.PeerIPVerificationEnforce, peer: "::ffff:10.5.0.4", code: codes.OK},
+		{name: "enforce mismatch", mode: registrator.PeerIPVerificationEnforce, peer: "10.5.0.5", code: codes.PermissionDenied},
+		{name: "enforce foreign SAN", mode: registrator.PeerIPVerificationEnforce, peer: "10.5.0.4", extraIP: "10.5.0.9", code: codes.PermissionDenied},
+		{
+			name:    "enforce allowed SAN",
+			mode:    registrator.PeerIPVerificationEnforce,
+			allowed: []netip.Prefix{netip.MustParsePrefix("10.5.0.100/32")},
+			peer:    "10.5.0.4",
+			extraIP: "10.5.0.100",
+			code:    codes.OK,
+		},
+		{
+			name:    "enforce allowed CIDR",
+			mode:    registrator.PeerIPVerificationEnforce,
+			allowed: []netip.Prefix{netip.MustParsePrefix("192.168.0.0/16"), netip.MustParsePrefix("10.5.0.0/24")},
+			peer:    "192.168.3.7",
+			code:    codes.OK,
+		},
+		{
+			name:    "enforce allowed CIDR foreign SAN",
+			mode:    registrator.PeerIPVerificationEnforce,
+			allowed: []netip.Prefix{netip.MustParsePrefix("192.168.0.0/16")},
+			peer:    "192.168.3.7",
+			code:    codes.PermissionDenied,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			reg := &registrator.Registrator{
+				CACert:      caCertPath,
+				CAKey:       caKeyPath,
+				AcceptedCAs: caCertPath,
+
+				PeerIPVerification: tc.mode,
+				PeerIPAllowedCIDRs: tc.allowed,
+			}
+
+			ctx := peer.NewContext(context.Background(), &peer.Peer{
+				Addr: &net.TCPAddr{
+					IP:   netip.MustParseAddr(tc.peer).AsSlice(),
+					Port: 30000,
+				},
+			})
+
+			csr := serverCSR
+			if tc.extraIP != "" {
+				csr, _, err = x509.NewEd25519CSRAndIdentity(
+					x509.IPAddresses([]net.IP{netip.MustParseAddr("10.5.0.4").AsSlice(), netip.MustParseAddr(tc.extraIP).AsSlice()}),
+					x509.DNSNames([]string{"test-server"}),
+					x509.CommonName("test-server"),
+				)
+				require.NoError(t, err)
+			}
+
+			_, err := reg.Certificate(ctx, &securityapi.CertificateRequest{
+				Csr: csr.X509CertificateRequestPEM,
+			})
+			assert.Equal(t, tc.code, status.Code(err), "unexpected error: %v", err)
+		})
+	}
+}
+
+func TestParseCIDRs(t *testing.T) {
+	prefixes, err := registrator.ParseCIDRs("10.0.0.0/8, 192.168.1.10,fd00::/8,::ffff:172.16.0.0/108,")
+	require.NoError(t, err)
+
+	assert.Equal(t, []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("192.168.1.10/32"),
+		netip.MustParsePrefix("fd00::/8"),
+		netip.MustParsePrefix("172.16.0.0/12"),
+	}, prefixes)
+
+	_, err = registrator.ParseCIDRs("10.0.0.0/33")
+	assert.Error(t, err)
+}
+
+func TestCertificatePolicy(t *testing.T) {
+	tempDir := t.TempDir()
+
+	ca, err := x509.NewSelfSignedCertificateAuthority(
+		x509.Organization("test-ca"),
+		x509.NotAfter(time.Now().Add(time.Hour)),
+	)
+	require.NoError(t, err)
+
+	caCertPath := filepath.Join(tempDir, "ca.crt")
+	caKeyPath := filepath.Join(tempDir, "ca.key")
+
+	require.NoError(t, os.WriteFile(caCertPath, ca.CrtPEM, 0644))
+	require.NoError(t, os.WriteFile(caKeyPath, ca.KeyPEM, 0644))
+
+	pol, err := policy.New(policy.Config{AllowedIPCIDRs: []string{"10.5.0.0/24"}})
+	require.NoError(t, err)
+
+	reg := &registrator.Registrator{
+		CACert:      caCertPath,
+		CAKey:       caKeyPath,
+		AcceptedCAs: caCertPath,
+		Policy:      pol,
+		Tenant:      "policy",
+	}
+
+	ctx := peer.NewContext(context.Background(), &peer.Peer{
+		Addr: &net.TCPAddr{
+			IP:   netip.MustParseAddr("127.0.0.1").AsSlice(),
+			Port: 30000,
+		},
+	})
+
+	for _, tc := range []struct {
+		ip   string
+		code codes.Code
+	}{
+		{ip: "10.5.0.4", code: codes.OK},
+		{ip: "10.6.0.4", code: codes.PermissionDenied},
+	} {
+		serverCSR, _, err := x509.NewEd25519CSRAndIdentity(
+			x509.IPAddresses([]net.IP{netip.MustParseAddr(tc.ip).AsSlice()}),
+			x509.CommonName("test-server"),
+		)
+		require.NoError(t, err)
+
+		_, err = reg.Certificate(ctx, &securityapi.CertificateRequest{
+			Csr: serverCSR.X509CertificateRequestPEM,
+		})
+		assert.Equal(t, tc.code, status.Code(err), "unexpected error for %s: %v", tc.ip, err)
+	}
+	assert.EqualValues(t, 1, testutil.ToFloat64(metrics.CertificatesIssued.WithLabelValues("policy")))
+	assert.EqualValues(t, 1, testutil.ToFloat64(metrics.CSRsRejected.WithLabelValues("policy", metrics.RejectPolicy)))
+	assert.EqualValues(t, 0, testutil.ToFloat64(metrics.CSRsRejected.WithLabelValues("policy", metrics.RejectPeerIP)))
+}
+
+func TestCertificateClientCertificate(t *testing.T) {
+	ca, clientCA, otherCA := newTestCA(t), newTestCA(t), newTestCA(t)
+
+	pol, err := policy.New(policy.Config{ClientCertificateSANs: true})
+	require.NoError(t, err)
+
+	store, err := pki.Load(pki.Files{CACert: ca.certPath, CAKey: ca.keyPath, AcceptedCAs: []string{ca.certPath}, ClientCAs: clientCA.certPath})
+	require.NoError(t, err)
+
+	reg := &registrator.Registrator{PKI: store, Policy: pol}
+
+	// clientContext returns the context of a TLS connection whose client
+	// certificate was verified by root
+	clientContext := func(root *stdx509.Certificate) context.Context {
+		client := &stdx509.Certificate{DNSNames: []string{"test-server"}, IPAddresses: []net.IP{net.ParseIP("10.5.0.4")}}
+
+		return peer.NewContext(context.Background(), &peer.Peer{
+			Addr:     &net.TCPAddr{IP: net.ParseIP("10.5.0.4"), Port: 30000},
+			AuthInfo: credentials.TLSInfo{State: tls.ConnectionState{VerifiedChains: [][]*stdx509.Certificate{{client, root}}}},
+		})
+	}
+
+	_, err = issue(t, clientContext(clientCA.Crt), reg, newTestCSR(t, "10.5.0.4"))
+	assert.NoError(t, err)
+
+	_, err = issue(t, clientContext(clientCA.Crt), reg, newTestCSR(t, "10.5.0.5"))
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	_, err = issue(t, peerContext("10.5.0.4"), reg, newTestCSR(t, "10.5.0.4"))
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	// verified by client CAs other than the registrator's, e.g. those of the
+	// fallback for a tenant reached by token prefix
+	_, err = issue(t, clientContext(otherCA.Crt), reg, newTestCSR(t, "10.5.0.4"))
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func TestCertificateTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	otel.SetTracerProvider(provider)
+	t.Cleanup(func() { otel.SetTracerProvider(noop.NewTracerProvider()) })
+
+	ca := newTestCA(t)
+
+	ctx, span := provider.Tracer("test").Start(peerContext("10.5.0.4"), "rpc")
+	ctx = auth.NewContext(ctx, &auth.Identity{TokenName: "workers"})
+
+	_, err := issue(t, ctx, ca.registrator(), newTestCSR(t, "10.5.0.4"))
+	require.NoError(t, err)
+
+	span.End()
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, s := range recorder.Ended() {
+		spans[s.Name()] = s
+	}
+
+	assert.Len(t, spans, 4)
+	assert.Contains(t, spans, "trustd.load_key_material")
+	assert.Contains(t, spans["trustd.evaluate_policy"].Attributes(), attribute.String("trustd.token_name", "workers"))
+	assert.Contains(t, spans["trustd.sign"].Attributes(), attribute.String("trustd.signer", "ca"))
+
+	attrs := spans["rpc"].Attributes()
+	assert.Contains(t, attrs, attribute.String("trustd.csr.subject", "CN=test-server"))
+	assert.Contains(t, attrs, attribute.Int("trustd.csr.dns_names", 1))
+	assert.Contains(t, attrs, attribute.Int("trustd.csr.ip_addresses", 1))
+}
+
+func TestCertificateLifetime(t *testing.T) {
+	tempDir := t.TempDir()
+
+	ca, err := x509.NewSelfSignedCertificateAuthority(
+		x509.Organization("test-ca"),
+		x509.NotAfter(time.Now().Add(time.Hour)),
+	)
+	require.NoError(t, err)
+
+	caCertPath := filepath.Join(tempDir, "ca.crt")
+	caKeyPath := filepath.Join(tempDir, "ca.key")
+
+	require.NoError(t, os.WriteFile(caCertPath, ca.CrtPEM, 0644))
+	require.NoError(t, os.WriteFile(caKeyPath, ca.KeyPEM, 0644))
+
+	serverCSR, _, err := x509.NewEd25519CSRAndIdentity(
+		x509.IPAddresses([]net.IP{netip.MustParseAddr("10.5.0.4").AsSlice()}),
+		x509.CommonName("test-server"),
+	)
+	require.NoError(t, err)
+
+	ctx := peer.NewContext(context.Background(), &peer.Peer{
+		Addr: &net.TCPAddr{
+			IP:   netip.MustParseAddr("127.0.0.1").AsSlice(),
+			Port: 30000,
+		},
+	})
+
+	issue := func(lifetime registrator.Lifetime) (*stdx509.Certificate, error) {
+		reg := &registrator.Registrator{
+			CACert:      caCertPath,
+			CAKey:       caKeyPath,
+			AcceptedCAs: caCertPath,
+			Lifetime:    lifetime,
+		}
+
+		resp, err := reg.Certificate(ctx, &securityapi.CertificateRequest{
+			Csr: serverCSR.X509CertificateRequestPEM,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		block, _ := pem.Decode(resp.Crt)
+		require.NotNil(t, block)
+
+		return stdx509.ParseCertificate(block.Bytes)
+	}
+
+	t.Run("validity and backdate", func(t *testing.T) {
+		cert, err := issue(registrator.Lifetime{Validity: 30 * time.Minute, Backdate: 5 * time.Minute})
+		require.NoError(t, err)
+
+		assert.WithinDuration(t, time.Now().Add(-5*time.Minute), cert.NotBefore, 5*time.Second)
+		assert.WithinDuration(t, time.Now().Add(30*time.Minute), cert.NotAfter, 5*time.Second)
+	})
+
+	t.Run("jitter", func(t *testing.T) {
+		cert, err := issue(registrator.Lifetime{Validity: 30 * time.Minute, Jitter: 10 * time.Minute})
+		require.NoError(t, err)
+
+		assert.True(t, cert.NotAfter.Before(time.Now().Add(30*time.Minute+time.Second)))
+		assert.True(t, cert.NotAfter.After(time.Now().Add(20*time.Minute-time.Second)))
+	})
+
+	t.Run("clamp to CA", func(t *testing.T) {
+		cert, err := issue(registrator.Lifetime{Validity: 2 * time.Hour})
+		require.NoError(t, err)
+
+		assert.Equal(t, ca.Crt.NotAfter, cert.NotAfter)
+	})
+
+	t.Run("refuse past CA", func(t *testing.T) {
+		_, err := issue(registrator.Lifetime{Validity: 2 * time.Hour, CAExpiry: registrator.CAExpiryRefuse})
+		assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	})
+}
+
+func TestCertificateLedger(t *testing.T) {
+	ca := newTestCA(t)
+
+	l, err := ledger.Open(filepath.Join(t.TempDir(), "ledger.db"))
+	require.NoError(t, err)
+
+	t.Cleanup(func() { l.Close() })
+
+	reg := ca.registrator()
+	reg.Ledger = l
+	reg.CRLDistributionPoints = []string{"http://trustd.example:9983/crl"}
+	reg.OCSPServers = []string{"http://trustd.example:9983/ocsp"}
+
+	ctx := auth.NewContext(peerContext("10.5.0.4"), &auth.Identity{TokenName: "workers"})
+
+	cert, err := issue(t, ctx, reg, newTestCSR(t, "10.5.0.4"))
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"http://trustd.example:9983/crl"}, cert.CRLDistributionPoints)
+	assert.Equal(t, []string{"http://trustd.example:9983/ocsp"}, cert.OCSPServer)
+
+	rec, err := l.Get(context.Background(), ledger.SerialString(cert))
+	require.NoError(t, err)
+
+	assert.Equal(t, "workers", rec.Token)
+	assert.Equal(t, "10.5.0.4:30000", rec.Peer)
+	assert.Equal(t, []string{"10.5.0.4"}, rec.IPAddresses)
+}
+
+func TestCertificateTokenRestrictions(t *testing.T) {
+	ca := newTestCA(t)
+
+	pol, err := policy.New(policy.Config{AllowedIPCIDRs: []string{"10.5.0.0/24"}})
+	require.NoError(t, err)
+
+	ctx := auth.NewContext(peerContext("10.5.0.4"), &auth.Identity{
+		TokenName:    "workers",
+		Policy:       pol,
+		CertValidity: 10 * time.Minute,
+	})
+
+	cert, err := issue(t, ctx, ca.registrator(), newTestCSR(t, "10.5.0.4"))
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(10*time.Minute), cert.NotAfter, 5*time.Second)
+
+	_, err = issue(t, ctx, ca.registrator(), newTestCSR(t, "10.6.0.4"))
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func TestCertificateBackendCAExpiry(t *testing.T) {
+	ca := newTestCA(t)
+
+	issueWith := func(lifetime registrator.Lifetime) (*stdx509.Certificate, error) {
+		reg := &registrator.Registrator{Backend: &templateBackend{ca: ca}, Lifetime: lifetime}
+
+		return issue(t, peerContext("10.5.0.4"), reg, newTestCSR(t, "10.5.0.4"))
+	}
+
+	t.Run("clamp to CA", func(t *testing.T) {
+		cert, err := issueWith(registrator.Lifetime{Validity: 2 * time.Hour})
+		require.NoError(t, err)
+
+		assert.Equal(t, ca.Crt.NotAfter, cert.NotAfter)
+	})
+
+	t.Run("refuse past CA", func(t *testing.T) {
+		_, err := issueWith(registrator.Lifetime{Validity: 2 * time.Hour, CAExpiry: registrator.CAExpiryRefuse})
+		assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	})
+}
+
+func TestCertificateBackend(t *testing.T) {
+	ca := newTestCA(t)
+
+	pol, err := policy.New(policy.Config{AllowedIPCIDRs: []string{"10.5.0.0/24"}})
+	require.NoError(t, err)
+
+	backend := &templateBackend{ca: ca}
+	reg := &registrator.Registrator{
+		Backend:            backend,
+		Policy:             pol,
+		PeerIPVerification: registrator.PeerIPVerificationEnforce,
+		Lifetime:           registrator.Lifetime{Validity: time.Hour},
+	}
+
+	// rejected by the policy and the peer IP verification without asking the backend
+	_, err = issue(t, peerContext("10.6.0.4"), reg, newTestCSR(t, "10.6.0.4"))
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	_, err = issue(t, peerContext("10.5.0.5"), reg, newTestCSR(t, "10.5.0.4"))
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	assert.Zero(t, backend.calls)
+
+	cert, err := issue(t, peerContext("10.5.0.4"), reg, newTestCSR(t, "10.5.0.4"))
+	require.NoError(t, err)
+	require.NoError(t, cert.CheckSignatureFrom(ca.Crt))
+	assert.Equal(t, 1, backend.calls)
+
+	// errors without a status mean the backend couldn't be reached
+	backend.err = errors.New("connection refused")
+
+	_, err = issue(t, peerContext("10.5.0.4"), reg, newTestCSR(t, "10.5.0.4"))
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+
+	backend.err = status.Error(codes.PermissionDenied, "CSR rejected")
+
+	_, err = issue(t, peerContext("10.5.0.4"), reg, newTestCSR(t, "10.5.0.4"))
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+// templateBackend signs the template with a CA, like the signer plugin.
+type templateBackend struct {
+	ca testCA
+
+	// calls counts the calls to Sign, which fail with err if set
+	calls int
+	err   error
+}
+
+func (b *templateBackend) Sign(_ context.Context, csr *stdx509.CertificateRequest, template *stdx509.Certificate) (*registrator.Issued, error) {
+	b.calls++
+
+	if b.err != nil {
+		return nil, b.err
+	}
+
+	der, err := stdx509.CreateCertificate(rand.Reader, template, b.ca.Crt, csr.PublicKey, b.ca.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := stdx509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	return &registrator.Issued{Certificate: cert, Chain: []*stdx509.Certificate{b.ca.Crt}, CAs: b.ca.CrtPEM}, nil
+}
+
+func (b *templateBackend) IssuerNotAfter(context.Context) (time.Time, error) {
+	return b.ca.Crt.NotAfter, nil
+}
+
+// testCA is a self-signed CA written to disk.
+type testCA struct {
+	*x509.CertificateAuthority
+
+	certPath string
+	keyPath  string
+}
+
+func newTestCA(t *testing.T) testCA {
+	t.Helper()
+
+	tempDir := t.TempDir()
+
+	ca, err := x509.NewSelfSignedCertificateAuthority(
+		x509.Organization("test-ca"),
+		x509.NotAfter(time.Now().Add(time.Hour)),
+	)
+	require.NoError(t, err)
+
+	tca := testCA{
+		CertificateAuthority: ca,
+		certPath:             filepath.Join(tempDir, "ca.crt"),
+		keyPath:              filepath.Join(tempDir, "ca.key"),
+	}
+
+	require.NoError(t, os.WriteFile(tca.certPath, ca.CrtPEM, 0644))
+	require.NoError(t, os.WriteFile(tca.keyPath, ca.KeyPEM, 0644))
+
+	return tca
+}
+
+// registrator returns a registrator signing with the CA and returning it as the accepted CAs.
+func (ca testCA) registrator() *registrator.Registrator {
+	return &registrator.Registrator{
+		CACert:      ca.certPath,
+		CAKey:       ca.keyPath,
+		AcceptedCAs: ca.certPath,
+	}
+}
+
+func newTestCSR(t *testing.T, ip string) []byte {
+	t.Helper()
+
+	csr, _, err := x509.NewEd25519CSRAndIdentity(
+		x509.IPAddresses([]net.IP{netip.MustParseAddr(ip).AsSlice()}),
+		x509.DNSNames([]string{"test-server"}),
+		x509.CommonName("test-server"),
+	)
+	require.NoError(t, err)
+
+	return csr.X509CertificateRequestPEM
+}
+
+func peerContext(ip string) context.Context {
+	return peer.NewContext(context.Background(), &peer.Peer{
+		Addr: &net.TCPAddr{
+			IP:   netip.MustParseAddr(ip).AsSlice(),
+			Port: 30000,
+		},
+	})
+}
+
+// issue requests a certificate and parses the returned leaf.
+func issue(t *testing.T, ctx context.Context, reg *registrator.Registrator, csr []byte) (*stdx509.Certificate, error) {
+	t.Helper()
+
+	resp, err := reg.Certificate(ctx, &securityapi.CertificateRequest{Csr: csr})
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(resp.Crt)
+	require.NotNil(t, block)
+
+	return stdx509.ParseCertificate(block.Bytes)
+}
+
+func TestCertificateCARotation(t *testing.T) {
+	ctx := peerContext("10.5.0.4")
+	csr := newTestCSR(t, "10.5.0.4")
+
+	oldCA, newCA := newTestCA(t), newTestCA(t)
+
+	dir := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "current"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "current", "ca.crt"), oldCA.CrtPEM, 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "current", "ca.key"), oldCA.KeyPEM, 0600))
+
+	store, err := pki.Load(pki.Files{CADir: dir})
+	require.NoError(t, err)
+
+	reg := &registrator.Registrator{PKI: store}
+
+	// request returns the leaf, the intermediates and the trusted CAs of a response.
+	request := func() (*stdx509.Certificate, []*stdx509.Certificate, []*stdx509.Certificate) {
+		t.Helper()
+
+		_, err := store.Reload()
+		require.NoError(t, err)
+
+		resp, err := reg.Certificate(ctx, &securityapi.CertificateRequest{Csr: csr})
+		require.NoError(t, err)
+
+		chain := parseCertificates(t, resp.Crt)
+		require.NotEmpty(t, chain)
+
+		return chain[0], chain[1:], parseCertificates(t, resp.Ca)
+	}
+
+	// verifies checks whether the leaf verifies against the root only.
+	verifies := func(leaf *stdx509.Certificate, intermediates []*stdx509.Certificate, root *stdx509.Certificate) bool {
+		opts := stdx509.VerifyOptions{
+			Roots:         stdx509.NewCertPool(),
+			Intermediates: stdx509.NewCertPool(),
+			KeyUsages:     []stdx509.ExtKeyUsage{stdx509.ExtKeyUsageServerAuth},
+		}
+
+		opts.Roots.AddCert(root)
+
+		for _, cert := range intermediates {
+			opts.Intermediates.AddCert(cert)
+		}
+
+		_, err := leaf.Verify(opts)
+
+		return err == nil
+	}
+
+	leaf, intermediates, trusted := request()
+	assert.Empty(t, intermediates)
+	assert.Equal(t, []*stdx509.Certificate{oldCA.Crt}, trusted)
+	assert.True(t, verifies(leaf, intermediates, oldCA.Crt))
+
+	// introduce: the new CA is trusted, the old one still signs
+	require.NoError(t, pki.Introduce(dir, newCA.CrtPEM, newCA.KeyPEM, true))
+	assert.Error(t, pki.Introduce(dir, newCA.CrtPEM, newCA.KeyPEM, true))
+
+	leaf, intermediates, trusted = request()
+	assert.Empty(t, intermediates)
+	assert.ElementsMatch(t, []*stdx509.Certificate{oldCA.Crt, newCA.Crt}, trusted)
+	assert.True(t, verifies(leaf, intermediates, oldCA.Crt))
+	assert.False(t, verifies(leaf, intermediates, newCA.Crt))
+
+	// activate: the new CA signs, the cross-signed certificate keeps the
+	// leaf valid for workers trusting only the old CA
+	require.NoError(t, pki.Activate(dir))
+	assert.Error(t, pki.Activate(dir))
+
+	leaf, intermediates, trusted = request()
+	require.Len(t, intermediates, 1)
+	assert.ElementsMatch(t, []*stdx509.Certificate{newCA.Crt, oldCA.Crt}, trusted)
+	assert.True(t, verifies(leaf, intermediates, newCA.Crt))
+	assert.True(t, verifies(leaf, intermediates, oldCA.Crt))
+	assert.False(t, verifies(leaf, nil, oldCA.Crt))
+
+	// retire: only the new CA is left
+	require.NoError(t, pki.Retire(dir))
+	assert.Error(t, pki.Retire(dir))
+
+	leaf, intermediates, trusted = request()
+	assert.Empty(t, intermediates)
+	assert.Equal(t, []*stdx509.Certificate{newCA.Crt}, trusted)
+	assert.True(t, verifies(leaf, intermediates, newCA.Crt))
+	assert.False(t, verifies(leaf, intermediates, oldCA.Crt))
+}
+
+func parseCertificates(t *testing.T, data []byte) []*stdx509.Certificate {
+	t.Helper()
+
+	var certs []*stdx509.Certificate
+
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		cert, err := stdx509.ParseCertificate(block.Bytes)
+		require.NoError(t, err)
+
+		certs = append(certs, cert)
+	}
+
+	return certs
+}
+
+// newIntermediateCA returns an intermediate CA signed by the parent CA, and
+// its certificate and key PEM.
+func newIntermediateCA(t *testing.T, name string, notAfter time.Time, parent *stdx509.Certificate, parentKey crypto.Signer) (*stdx509.Certificate, crypto.Signer, []byte, []byte) {
+	t.Helper()
+
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	serial, err := x509.NewSerialNumber()
+	require.NoError(t, err)
+
+	der, err := stdx509.CreateCertificate(rand.Reader, &stdx509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{name}},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              notAfter,
+		KeyUsage:              stdx509.KeyUsageCertSign | stdx509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}, parent, pub, parentKey)
+	require.NoError(t, err)
+
+	cert, err := stdx509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	keyDER, err := stdx509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+
+	return cert, key, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+}
+
+func TestCertificateIntermediateCA(t *testing.T) {
+	ctx := peerContext("10.5.0.4")
+	csr := newTestCSR(t, "10.5.0.4")
+
+	// root (kept offline) -> policy CA -> issuing CA, which signs
+	root := newTestCA(t)
+	rootKey, ok := root.Key.(crypto.Signer)
+	require.True(t, ok)
+
+	// the policy CA expires before the issuing CA, bounding the leaf
+	policyCA, policyKey, policyCAPEM, _ := newIntermediateCA(t, "policy-ca", time.Now().Add(30*time.Minute), root.Crt, rootKey)
+	issuingCA, _, issuingCAPEM, issuingKeyPEM := newIntermediateCA(t, "issuing-ca", time.Now().Add(time.Hour), policyCA, policyKey)
+
+	dir := t.TempDir()
+	files := pki.Files{
+		CACert:      filepath.Join(dir, "ca.crt"),
+		CAKey:       filepath.Join(dir, "ca.key"),
+		CAChain:     filepath.Join(dir, "chain.crt"),
+		AcceptedCAs: []string{root.certPath},
+	}
+
+	require.NoError(t, os.WriteFile(files.CACert, issuingCAPEM, 0644))
+	require.NoError(t, os.WriteFile(files.CAKey, issuingKeyPEM, 0600))
+	// the root in the chain file isn't returned to clients
+	require.NoError(t, os.WriteFile(files.CAChain, slices.Concat(policyCAPEM, root.CrtPEM), 0644))
+
+	store, err := pki.Load(files)
+	require.NoError(t, err)
+
+	reg := &registrator.Registrator{PKI: store}
+
+	resp, err := reg.Certificate(ctx, &securityapi.CertificateRequest{Csr: csr})
+	require.NoError(t, err)
+
+	chain := parseCertificates(t, resp.Crt)
+	require.Len(t, chain, 3)
+	assert.Equal(t, issuingCA.Raw, chain[1].Raw)
+	assert.Equal(t, policyCA.Raw, chain[2].Raw)
+	assert.Equal(t, []*stdx509.Certificate{root.Crt}, parseCertificates(t, resp.Ca))
+
+	// verify checks the leaf against the root with the given intermediates.
+	verify := func(intermediates []*stdx509.Certificate) error {
+		opts := stdx509.VerifyOptions{Roots: stdx509.NewCertPool(), Intermediates: stdx509.NewCertPool()}
+		opts.Roots.AddCert(root.Crt)
+
+		for _, cert := range intermediates {
+			opts.Intermediates.AddCert(cert)
+		}
+
+		_, err := chain[0].Verify(opts)
+
+		return err
+	}
+
+	assert.NoError(t, verify(chain[1:]))
+	assert.Error(t, verify(nil))
+	assert.Error(t, verify(chain[1:2]))
+
+	assert.Equal(t, policyCA.NotAfter, chain[0].NotAfter)
+
+	// only the leaf
+	reg.OmitChain = true
+
+	resp, err = reg.Certificate(ctx, &securityapi.CertificateRequest{Csr: csr})
+	require.NoError(t, err)
+	assert.Len(t, parseCertificates(t, resp.Crt), 1)
+
+	// without the chain, the issuing CA doesn't verify against the root
+	files.CAChain = ""
+
+	_, err = pki.Load(files)
+	assert.ErrorContains(t, err, "no accepted CA verifies the signing CA")
+
+	// a chain file with a leaf certificate is rejected
+	files.CAChain = filepath.Join(dir, "chain.crt")
+	require.NoError(t, os.WriteFile(files.CAChain, slices.Concat(policyCAPEM, resp.Crt), 0644))
+
+	_, err = pki.Load(files)
+	assert.ErrorContains(t, err, "is not a CA")
+
+	// so is a chain file which isn't ordered from the issuer towards the root
+	require.NoError(t, os.WriteFile(files.CAChain, slices.Concat(root.CrtPEM, policyCAPEM), 0644))
+
+	_, err = pki.Load(files)
+	assert.ErrorContains(t, err, "doesn't issue")
+}
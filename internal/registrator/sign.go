@@ -0,0 +1,75 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package registrator
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	stdx509 "crypto/x509"
+	"encoding/pem"
+	"time"
+
+	"github.com/siderolabs/crypto/x509"
+)
+
+// signCertificate issues a certificate for pub from the template.
+//
+// It replaces x509.NewCertificateFromCSR, which offers no way to set
+// extensions such as CRL distribution points.
+func signCertificate(template, ca *stdx509.Certificate, pub any, key crypto.Signer) (*x509.Certificate, error) {
+	serialNumber, err := x509.NewSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+
+	template.SerialNumber = serialNumber
+
+	crtDER, err := stdx509.CreateCertificate(rand.Reader, template, ca, pub, key)
+	if err != nil {
+		return nil, err
+	}
+
+	crt, err := stdx509.ParseCertificate(crtDER)
+	if err != nil {
+		return nil, err
+	}
+
+	return &x509.Certificate{
+		X509Certificate: crt,
+		X509CertificatePEM: pem.EncodeToMemory(&pem.Block{
+			Type:  x509.PEMTypeCertificate,
+			Bytes: crtDER,
+		}),
+	}, nil
+}
+
+// Backend signs certificates in place of the local CA, e.g. a Vault PKI
+// mount.
+type Backend interface {
+	// Sign issues a certificate for a CSR which passed all local checks,
+	// with the subject, SANs, usages and validity of the template.
+	Sign(ctx context.Context, csr *stdx509.CertificateRequest, template *stdx509.Certificate) (*Issued, error)
+}
+
+// IssuerExpiry is implemented by backends signing the template as given
+// rather than building the certificate themselves. Issued certificates are
+// then bound by the expiry of their issuer like those of the local CA,
+// following the CAExpiry policy.
+type IssuerExpiry interface {
+	// IssuerNotAfter returns the expiry of the issuer of the next
+	// certificate, and of the intermediates above it.
+	IssuerNotAfter(ctx context.Context) (time.Time, error)
+}
+
+// Issued is a certificate issued by a Backend.
+type Issued struct {
+	Certificate *stdx509.Certificate
+	// Chain starts with the issuer of Certificate and goes towards the root.
+	Chain []*stdx509.Certificate
+	// CAs is the PEM bundle clients should trust, returned unless the
+	// registrator has accepted CAs of its own.
+	CAs []byte
+}
@@ -0,0 +1,159 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package revocation publishes the revocation status of certificates issued by trustd.
+package revocation
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cozystack/standalone-trustd/internal/ledger"
+	"github.com/cozystack/standalone-trustd/internal/pki"
+)
+
+// reasons maps RFC 5280 CRLReason names to their codes.
+var reasons = map[string]int{
+	"unspecified":          0,
+	"keycompromise":        1,
+	"cacompromise":         2,
+	"affiliationchanged":   3,
+	"superseded":           4,
+	"cessationofoperation": 5,
+	"privilegewithdrawn":   9,
+}
+
+// ParseReason parses an RFC 5280 revocation reason name, e.g. keyCompromise.
+func ParseReason(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	reason, ok := reasons[strings.ToLower(s)]
+	if !ok {
+		return 0, fmt.Errorf("unknown revocation reason %q", s)
+	}
+
+	return reason, nil
+}
+
+// CRL maintains a signed certificate revocation list built from the ledger.
+type CRL struct {
+	Ledger *ledger.Ledger
+	Issuer *x509.Certificate
+	Signer crypto.Signer
+	// PKI, if set, provides the issuer and signer from the current key
+	// material on every refresh instead of Issuer and Signer, so that the
+	// CRL follows reloads of the CA.
+	PKI *pki.Store
+	// Validity is the distance between ThisUpdate and NextUpdate.
+	Validity time.Duration
+
+	mu     sync.RWMutex
+	der    []byte
+	number *big.Int
+}
+
+// Refresh regenerates the CRL from the ledger.
+func (c *CRL) Refresh(ctx context.Context) error {
+	now := time.Now()
+
+	revocations, err := c.Ledger.Revocations(ctx, now)
+	if err != nil {
+		return err
+	}
+
+	entries := make([]x509.RevocationListEntry, 0, len(revocations))
+
+	for _, rev := range revocations {
+		serial, ok := new(big.Int).SetString(rev.Serial, 16)
+		if !ok {
+			return fmt.Errorf("invalid serial number %q in ledger", rev.Serial)
+		}
+
+		entries = append(entries, x509.RevocationListEntry{
+			SerialNumber:   serial,
+			RevocationTime: rev.RevokedAt,
+			ReasonCode:     rev.Reason,
+		})
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// CRL numbers must increase monotonically, also across restarts
+	number := big.NewInt(now.Unix())
+	if c.number != nil && number.Cmp(c.number) <= 0 {
+		number = new(big.Int).Add(c.number, big.NewInt(1))
+	}
+
+	issuer, signer := c.Issuer, c.Signer
+	if c.PKI != nil {
+		m := c.PKI.Current()
+		issuer, signer = m.CA, m.CAKey
+	}
+
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    number,
+		ThisUpdate:                now,
+		NextUpdate:                now.Add(c.Validity),
+		RevokedCertificateEntries: entries,
+	}, issuer, signer)
+	if err != nil {
+		return fmt.Errorf("failed to sign CRL: %w", err)
+	}
+
+	c.der = der
+	c.number = number
+
+	return nil
+}
+
+// Run refreshes the CRL every interval until the context is canceled.
+func (c *CRL) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := c.Refresh(ctx); err != nil {
+			slog.Warn("CRL refresh failed", "error", err)
+		}
+	}
+}
+
+// DER returns the current CRL.
+func (c *CRL) DER() []byte {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.der
+}
+
+// ServeHTTP serves the current CRL in DER form.
+func (c *CRL) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	der := c.DER()
+	if der == nil {
+		http.Error(w, "CRL not available", http.StatusServiceUnavailable)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/pkix-crl")
+	w.Write(der)
+}
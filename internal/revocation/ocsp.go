@@ -0,0 +1,286 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package revocation
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+
+	"github.com/cozystack/standalone-trustd/internal/ledger"
+	"github.com/cozystack/standalone-trustd/internal/pki"
+)
+
+// maxOCSPRequestSize bounds the size of POSTed OCSP requests.
+const maxOCSPRequestSize = 64 << 10
+
+// OCSPResponder answers RFC 6960 OCSP requests about certificates issued by
+// Issuer from the ledger.
+//
+// It is meant to be mounted with http.StripPrefix, so that GET requests carry
+// only the base64 encoded OCSP request in their path.
+type OCSPResponder struct {
+	Ledger *ledger.Ledger
+	Issuer *x509.Certificate
+	// Responder signs the responses: either Issuer itself or a delegated
+	// OCSP signing certificate issued by it.
+	Responder *x509.Certificate
+	Signer    crypto.Signer
+	// PKI, if set, provides Issuer from the current key material on every
+	// response, and Responder and Signer too unless they hold a delegated
+	// OCSP signing certificate, so that responses follow reloads of the CA.
+	PKI *pki.Store
+	// Validity is the distance between thisUpdate and nextUpdate. Signed
+	// responses are cached for half of it.
+	Validity time.Duration
+
+	mu    sync.Mutex
+	cache map[string]cachedResponse
+}
+
+type cachedResponse struct {
+	der     []byte
+	issuer  *x509.Certificate
+	expires time.Time
+}
+
+// signers returns the issuer, the responder certificate and its key.
+func (o *OCSPResponder) signers() (issuer, responder *x509.Certificate, signer crypto.Signer) {
+	issuer, responder, signer = o.Issuer, o.Responder, o.Signer
+
+	if o.PKI != nil {
+		m := o.PKI.Current()
+		issuer = m.CA
+
+		if responder == nil {
+			responder, signer = m.CA, m.CAKey
+		}
+	}
+
+	return issuer, responder, signer
+}
+
+// Validate checks that the responder certificate and key can sign responses
+// for the issuer.
+func (o *OCSPResponder) Validate() error {
+	return validateResponder(o.signers())
+}
+
+func validateResponder(issuer, responder *x509.Certificate, signer crypto.Signer) error {
+	pub, ok := signer.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !pub.Equal(responder.PublicKey) {
+		return fmt.Errorf("OCSP signer key does not match the responder certificate")
+	}
+
+	// x/crypto/ocsp signs with RSA and ECDSA keys only
+	switch responder.PublicKeyAlgorithm {
+	case x509.RSA, x509.ECDSA:
+	default:
+		return fmt.Errorf("OCSP responses cannot be signed with %s keys, configure a delegated RSA or ECDSA OCSP signing certificate", responder.PublicKeyAlgorithm)
+	}
+
+	if responder.Equal(issuer) {
+		return nil
+	}
+
+	if err := responder.CheckSignatureFrom(issuer); err != nil {
+		return fmt.Errorf("delegated OCSP signing certificate is not issued by the signing CA: %w", err)
+	}
+
+	if !slices.Contains(responder.ExtKeyUsage, x509.ExtKeyUsageOCSPSigning) {
+		return fmt.Errorf("delegated OCSP signing certificate lacks the OCSPSigning extended key usage")
+	}
+
+	return nil
+}
+
+// ServeHTTP implements the OCSP HTTP transport (RFC 6960, appendix A) for
+// both GET and POST requests.
+func (o *OCSPResponder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var (
+		raw []byte
+		err error
+	)
+
+	switch r.Method {
+	case http.MethodGet:
+		var encoded string
+
+		if encoded, err = url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), "/")); err == nil {
+			raw, err = base64.StdEncoding.DecodeString(encoded)
+		}
+	case http.MethodPost:
+		raw, err = io.ReadAll(io.LimitReader(r.Body, maxOCSPRequestSize))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	if err != nil {
+		writeOCSP(w, ocsp.MalformedRequestErrorResponse, 0)
+
+		return
+	}
+
+	req, err := ocsp.ParseRequest(raw)
+	if err != nil {
+		writeOCSP(w, ocsp.MalformedRequestErrorResponse, 0)
+
+		return
+	}
+
+	issuer, responder, signer := o.signers()
+
+	if !issuedBy(issuer, req) {
+		writeOCSP(w, ocsp.UnauthorizedErrorResponse, 0)
+
+		return
+	}
+
+	resp, err := o.response(r, req, issuer, responder, signer)
+	if err != nil {
+		slog.Warn("OCSP response failed", "serial", ledger.FormatSerial(req.SerialNumber), "error", err)
+		writeOCSP(w, ocsp.InternalErrorErrorResponse, 0)
+
+		return
+	}
+
+	maxAge := time.Duration(0)
+	if r.Method == http.MethodGet {
+		maxAge = o.Validity / 2
+	}
+
+	writeOCSP(w, resp, maxAge)
+}
+
+// response returns a response for the request signed by responder, from the
+// cache if possible.
+func (o *OCSPResponder) response(r *http.Request, req *ocsp.Request, issuer, responder *x509.Certificate, signer crypto.Signer) ([]byte, error) {
+	serial := ledger.FormatSerial(req.SerialNumber)
+	cacheKey := fmt.Sprintf("%d/%s", req.HashAlgorithm, serial)
+	now := time.Now()
+
+	o.mu.Lock()
+	cached, ok := o.cache[cacheKey]
+	o.mu.Unlock()
+
+	if ok && now.Before(cached.expires) && cached.issuer.Equal(issuer) {
+		return cached.der, nil
+	}
+
+	// the CA may have been reloaded since the delegated certificate was checked
+	if o.PKI != nil && o.Responder != nil {
+		if err := validateResponder(issuer, responder, signer); err != nil {
+			return nil, err
+		}
+	}
+
+	template := ocsp.Response{
+		SerialNumber: req.SerialNumber,
+		IssuerHash:   req.HashAlgorithm,
+		ThisUpdate:   now,
+		NextUpdate:   now.Add(o.Validity),
+		Status:       ocsp.Good,
+	}
+
+	if !responder.Equal(issuer) {
+		template.Certificate = responder
+	}
+
+	switch rec, err := o.Ledger.Get(r.Context(), serial); {
+	case err == nil:
+		rev, err := o.Ledger.RevocationOf(r.Context(), serial)
+		if err != nil {
+			return nil, err
+		}
+
+		if rev != nil {
+			template.Status = ocsp.Revoked
+			template.RevokedAt = rev.RevokedAt
+			template.RevocationReason = rev.Reason
+		} else if now.After(rec.NotAfter) {
+			template.Status = ocsp.Unknown
+		}
+	case errors.Is(err, ledger.ErrNotFound):
+		template.Status = ocsp.Unknown
+	default:
+		return nil, err
+	}
+
+	der, err := ocsp.CreateResponse(issuer, responder, template, signer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign OCSP response: %w", err)
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.cache == nil {
+		o.cache = map[string]cachedResponse{}
+	}
+
+	// drop expired entries so that probing random serials cannot grow the cache forever
+	for key, entry := range o.cache {
+		if now.After(entry.expires) {
+			delete(o.cache, key)
+		}
+	}
+
+	o.cache[cacheKey] = cachedResponse{der: der, issuer: issuer, expires: now.Add(o.Validity / 2)}
+
+	return der, nil
+}
+
+// issuedBy checks that the request asks about a certificate of issuer.
+func issuedBy(issuer *x509.Certificate, req *ocsp.Request) bool {
+	if !req.HashAlgorithm.Available() {
+		return false
+	}
+
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+
+	if _, err := asn1.Unmarshal(issuer.RawSubjectPublicKeyInfo, &spki); err != nil {
+		return false
+	}
+
+	h := req.HashAlgorithm.New()
+	h.Write(issuer.RawSubject)
+	nameHash := h.Sum(nil)
+
+	h.Reset()
+	h.Write(spki.PublicKey.RightAlign())
+	keyHash := h.Sum(nil)
+
+	return bytes.Equal(nameHash, req.IssuerNameHash) && bytes.Equal(keyHash, req.IssuerKeyHash)
+}
+
+func writeOCSP(w http.ResponseWriter, resp []byte, maxAge time.Duration) {
+	w.Header().Set("Content-Type", "application/ocsp-response")
+
+	if maxAge > 0 {
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d, public", int(maxAge.Seconds())))
+	}
+
+	w.Write(resp)
+}
@@ -0,0 +1,401 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package revocation_test
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	stdx509 "crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/siderolabs/crypto/x509"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ocsp"
+
+	"github.com/cozystack/standalone-trustd/internal/ledger"
+	"github.com/cozystack/standalone-trustd/internal/pki"
+	"github.com/cozystack/standalone-trustd/internal/revocation"
+)
+
+// fixture is a CA and a ledger holding two certificates issued by it.
+type fixture struct {
+	ca     *testCA
+	ledger *ledger.Ledger
+	good   *stdx509.Certificate
+	bad    *stdx509.Certificate
+}
+
+func newFixture(t *testing.T) *fixture {
+	t.Helper()
+
+	ca := newTestCA(t)
+
+	l, err := ledger.Open(filepath.Join(t.TempDir(), "ledger.db"))
+	require.NoError(t, err)
+
+	t.Cleanup(func() { l.Close() })
+
+	f := &fixture{ca: ca, ledger: l}
+
+	for _, crt := range []**stdx509.Certificate{&f.good, &f.bad} {
+		csr, _, err := x509.NewEd25519CSRAndIdentity(x509.CommonName("worker"))
+		require.NoError(t, err)
+
+		signed, err := x509.NewCertificateFromCSRBytes(ca.crtPEM, ca.keyPEM, csr.X509CertificateRequestPEM,
+			x509.NotAfter(time.Now().Add(30*time.Minute)))
+		require.NoError(t, err)
+
+		require.NoError(t, l.Add(context.Background(), ledger.NewRecord(signed.X509Certificate, ca.crt, "peer", "default")))
+
+		*crt = signed.X509Certificate
+	}
+
+	require.NoError(t, l.Revoke(context.Background(), ledger.SerialString(f.bad), 1, time.Now()))
+
+	return f
+}
+
+// testCA is a CA allowed to sign CRLs and OCSP responses; siderolabs/crypto
+// CAs only carry the certSign key usage.
+type testCA struct {
+	crt    *stdx509.Certificate
+	key    crypto.Signer
+	crtPEM []byte
+	keyPEM []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	template := &stdx509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              stdx509.KeyUsageCertSign | stdx509.KeyUsageCRLSign | stdx509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := stdx509.CreateCertificate(rand.Reader, template, template, pub, key)
+	require.NoError(t, err)
+
+	crt, err := stdx509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	keyDER, err := stdx509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+
+	return &testCA{
+		crt:    crt,
+		key:    key,
+		crtPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM: pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func TestCRL(t *testing.T) {
+	f := newFixture(t)
+
+	crl := &revocation.CRL{
+		Ledger:   f.ledger,
+		Issuer:   f.ca.crt,
+		Signer:   f.ca.key,
+		Validity: time.Hour,
+	}
+
+	srv := httptest.NewServer(crl)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+
+	require.NoError(t, crl.Refresh(context.Background()))
+
+	resp, err = http.Get(srv.URL)
+	require.NoError(t, err)
+
+	der, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, "application/pkix-crl", resp.Header.Get("Content-Type"))
+
+	list, err := stdx509.ParseRevocationList(der)
+	require.NoError(t, err)
+	require.NoError(t, list.CheckSignatureFrom(f.ca.crt))
+
+	require.Len(t, list.RevokedCertificateEntries, 1)
+	assert.Equal(t, f.bad.SerialNumber, list.RevokedCertificateEntries[0].SerialNumber)
+	assert.Equal(t, 1, list.RevokedCertificateEntries[0].ReasonCode)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), list.NextUpdate, 5*time.Second)
+
+	first := list.Number
+
+	require.NoError(t, crl.Refresh(context.Background()))
+
+	list, err = stdx509.ParseRevocationList(crl.DER())
+	require.NoError(t, err)
+	assert.Equal(t, 1, list.Number.Cmp(first), "CRL number must increase")
+}
+
+func TestCRLRequiresCRLSign(t *testing.T) {
+	f := newFixture(t)
+
+	// CAs generated by Talos lack the cRLSign key usage
+	talosCA, err := x509.NewSelfSignedCertificateAuthority(x509.Organization("talos"))
+	require.NoError(t, err)
+
+	crl := &revocation.CRL{
+		Ledger:   f.ledger,
+		Issuer:   talosCA.Crt,
+		Signer:   talosCA.Key.(crypto.Signer),
+		Validity: time.Hour,
+	}
+
+	assert.ErrorContains(t, crl.Refresh(context.Background()), "crlSign")
+}
+
+func TestCRLReloadedCA(t *testing.T) {
+	f := newFixture(t)
+	next := newTestCA(t)
+
+	dir := t.TempDir()
+	files := pki.Files{CACert: filepath.Join(dir, "ca.crt"), CAKey: filepath.Join(dir, "ca.key"), IncludeSigningCA: true}
+
+	writeCA := func(ca *testCA) {
+		require.NoError(t, os.WriteFile(files.CACert, ca.crtPEM, 0644))
+		require.NoError(t, os.WriteFile(files.CAKey, ca.keyPEM, 0600))
+	}
+
+	writeCA(f.ca)
+
+	store, err := pki.Load(files)
+	require.NoError(t, err)
+
+	crl := &revocation.CRL{Ledger: f.ledger, PKI: store, Validity: time.Hour}
+
+	require.NoError(t, crl.Refresh(context.Background()))
+
+	list, err := stdx509.ParseRevocationList(crl.DER())
+	require.NoError(t, err)
+	require.NoError(t, list.CheckSignatureFrom(f.ca.crt))
+
+	writeCA(next)
+
+	_, err = store.Reload()
+	require.NoError(t, err)
+
+	// the CRL is signed by the new CA
+	require.NoError(t, crl.Refresh(context.Background()))
+
+	list, err = stdx509.ParseRevocationList(crl.DER())
+	require.NoError(t, err)
+	require.NoError(t, list.CheckSignatureFrom(next.crt))
+}
+
+func TestParseReason(t *testing.T) {
+	reason, err := revocation.ParseReason("keyCompromise")
+	require.NoError(t, err)
+	assert.Equal(t, 1, reason)
+
+	reason, err = revocation.ParseReason("")
+	require.NoError(t, err)
+	assert.Equal(t, 0, reason)
+
+	_, err = revocation.ParseReason("bogus")
+	assert.Error(t, err)
+}
+
+// newOCSPSigner issues a delegated ECDSA OCSP signing certificate from the CA.
+func (ca *testCA) newOCSPSigner(t *testing.T) (*stdx509.Certificate, crypto.Signer) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	der, err := stdx509.CreateCertificate(rand.Reader, &stdx509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "test-ocsp"},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     stdx509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []stdx509.ExtKeyUsage{stdx509.ExtKeyUsageOCSPSigning},
+	}, ca.crt, key.Public(), ca.key)
+	require.NoError(t, err)
+
+	crt, err := stdx509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return crt, key
+}
+
+func TestOCSPResponder(t *testing.T) {
+	f := newFixture(t)
+
+	// Ed25519 CAs cannot sign OCSP responses themselves
+	direct := &revocation.OCSPResponder{
+		Ledger:    f.ledger,
+		Issuer:    f.ca.crt,
+		Responder: f.ca.crt,
+		Signer:    f.ca.key,
+		Validity:  time.Hour,
+	}
+	assert.Error(t, direct.Validate())
+
+	signerCrt, signerKey := f.ca.newOCSPSigner(t)
+
+	responder := &revocation.OCSPResponder{
+		Ledger:    f.ledger,
+		Issuer:    f.ca.crt,
+		Responder: signerCrt,
+		Signer:    signerKey,
+		Validity:  time.Hour,
+	}
+	require.NoError(t, responder.Validate())
+
+	mux := http.NewServeMux()
+	mux.Handle("/ocsp", responder)
+	mux.Handle("/ocsp/", http.StripPrefix("/ocsp/", responder))
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	query := func(t *testing.T, cert *stdx509.Certificate, get bool) []byte {
+		t.Helper()
+
+		req, err := ocsp.CreateRequest(cert, f.ca.crt, nil)
+		require.NoError(t, err)
+
+		var resp *http.Response
+
+		if get {
+			resp, err = http.Get(srv.URL + "/ocsp/" + url.PathEscape(base64.StdEncoding.EncodeToString(req)))
+		} else {
+			resp, err = http.Post(srv.URL+"/ocsp", "application/ocsp-request", bytes.NewReader(req))
+		}
+		require.NoError(t, err)
+
+		defer resp.Body.Close()
+
+		assert.Equal(t, "application/ocsp-response", resp.Header.Get("Content-Type"))
+
+		der, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+
+		return der
+	}
+
+	t.Run("good", func(t *testing.T) {
+		resp, err := ocsp.ParseResponseForCert(query(t, f.good, false), f.good, f.ca.crt)
+		require.NoError(t, err)
+		assert.Equal(t, ocsp.Good, resp.Status)
+		assert.WithinDuration(t, time.Now().Add(time.Hour), resp.NextUpdate, 5*time.Second)
+	})
+
+	t.Run("revoked", func(t *testing.T) {
+		resp, err := ocsp.ParseResponseForCert(query(t, f.bad, true), f.bad, f.ca.crt)
+		require.NoError(t, err)
+		assert.Equal(t, ocsp.Revoked, resp.Status)
+		assert.Equal(t, ocsp.KeyCompromise, resp.RevocationReason)
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		unknown := &stdx509.Certificate{SerialNumber: big.NewInt(12345)}
+
+		resp, err := ocsp.ParseResponseForCert(query(t, unknown, false), unknown, f.ca.crt)
+		require.NoError(t, err)
+		assert.Equal(t, ocsp.Unknown, resp.Status)
+	})
+
+	t.Run("other issuer", func(t *testing.T) {
+		other := newTestCA(t)
+
+		req, err := ocsp.CreateRequest(f.good, other.crt, nil)
+		require.NoError(t, err)
+
+		resp, err := http.Post(srv.URL+"/ocsp", "application/ocsp-request", bytes.NewReader(req))
+		require.NoError(t, err)
+
+		defer resp.Body.Close()
+
+		der, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+
+		_, err = ocsp.ParseResponse(der, nil)
+		assert.Equal(t, ocsp.ResponseError{Status: ocsp.Unauthorized}, err)
+	})
+}
+
+func TestOCSPResponderReloadedCA(t *testing.T) {
+	f := newFixture(t)
+	next := newTestCA(t)
+
+	dir := t.TempDir()
+	files := pki.Files{CACert: filepath.Join(dir, "ca.crt"), CAKey: filepath.Join(dir, "ca.key"), IncludeSigningCA: true}
+
+	writeCA := func(ca *testCA) {
+		require.NoError(t, os.WriteFile(files.CACert, ca.crtPEM, 0644))
+		require.NoError(t, os.WriteFile(files.CAKey, ca.keyPEM, 0600))
+	}
+
+	writeCA(f.ca)
+
+	store, err := pki.Load(files)
+	require.NoError(t, err)
+
+	signerCrt, signerKey := f.ca.newOCSPSigner(t)
+
+	responder := &revocation.OCSPResponder{Ledger: f.ledger, PKI: store, Responder: signerCrt, Signer: signerKey, Validity: time.Hour}
+	require.NoError(t, responder.Validate())
+
+	// query returns the parsed OCSP response about cert issued by issuer
+	query := func(cert, issuer *stdx509.Certificate) error {
+		req, err := ocsp.CreateRequest(cert, issuer, nil)
+		require.NoError(t, err)
+
+		rec := httptest.NewRecorder()
+		responder.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(req)))
+
+		_, err = ocsp.ParseResponseForCert(rec.Body.Bytes(), cert, issuer)
+
+		return err
+	}
+
+	require.NoError(t, query(f.good, f.ca.crt))
+
+	writeCA(next)
+
+	_, err = store.Reload()
+	require.NoError(t, err)
+
+	// only the new CA is answered for, and the delegated certificate of the
+	// previous CA can't sign its responses
+	assert.Equal(t, ocsp.ResponseError{Status: ocsp.Unauthorized}, query(f.good, f.ca.crt))
+	assert.Equal(t, ocsp.ResponseError{Status: ocsp.InternalError}, query(&stdx509.Certificate{SerialNumber: big.NewInt(12345)}, next.crt))
+	assert.Error(t, responder.Validate())
+}
@@ -0,0 +1,49 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package pkcs11 signs with a private key kept in a PKCS#11 token, e.g. an
+// HSM or SoftHSM2, so that the CA key never touches the disk.
+//
+// Using a token requires a build with cgo.
+package pkcs11
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Config selects a private key of a PKCS#11 token.
+type Config struct {
+	// Module is the path of the PKCS#11 library, e.g.
+	// /usr/lib/softhsm/libsofthsm2.so.
+	Module string `yaml:"module"`
+	// Slot is the ID of the slot holding the token.
+	Slot uint `yaml:"slot"`
+	// PINFile holds the user PIN of the token.
+	PINFile string `yaml:"pinFile"`
+	// KeyLabel selects the private key by its label. If empty, the token
+	// must hold a single private key.
+	KeyLabel string `yaml:"keyLabel"`
+}
+
+// readPIN reads the PIN file, ignoring surrounding whitespace.
+func (c Config) readPIN() (string, error) {
+	if c.PINFile == "" {
+		return "", errors.New("PIN file is required")
+	}
+
+	data, err := os.ReadFile(c.PINFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read PIN file: %w", err)
+	}
+
+	pin := strings.TrimSpace(string(data))
+	if pin == "" {
+		return "", fmt.Errorf("PIN file %s is empty", c.PINFile)
+	}
+
+	return pin, nil
+}
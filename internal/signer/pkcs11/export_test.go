@@ -0,0 +1,15 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build cgo
+
+package pkcs11
+
+// Token is the PKCS#11 API used by a Signer, for fake tokens.
+type Token = token
+
+// OpenToken opens a signer on a token instead of a module.
+func OpenToken(t Token, cfg Config) (*Signer, error) {
+	return openToken(t, cfg, nil)
+}
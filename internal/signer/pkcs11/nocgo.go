@@ -0,0 +1,38 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build !cgo
+
+package pkcs11
+
+import (
+	"crypto"
+	"errors"
+	"io"
+)
+
+var errNoCgo = errors.New("PKCS#11 support requires a build with cgo")
+
+// Signer is a crypto.Signer backed by a private key of a PKCS#11 token.
+type Signer struct{}
+
+// Open always fails without cgo.
+func Open(Config) (*Signer, error) {
+	return nil, errNoCgo
+}
+
+// Public implements crypto.Signer.
+func (*Signer) Public() crypto.PublicKey {
+	return nil
+}
+
+// Sign implements crypto.Signer.
+func (*Signer) Sign(io.Reader, []byte, crypto.SignerOpts) ([]byte, error) {
+	return nil, errNoCgo
+}
+
+// Close implements io.Closer.
+func (*Signer) Close() error {
+	return nil
+}
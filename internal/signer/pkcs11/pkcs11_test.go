@@ -0,0 +1,523 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build cgo
+
+package pkcs11_test
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	stdx509 "crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	p11 "github.com/miekg/pkcs11"
+	"github.com/siderolabs/crypto/x509"
+	securityapi "github.com/siderolabs/talos/pkg/machinery/api/security"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/peer"
+
+	"github.com/cozystack/standalone-trustd/internal/pki"
+	"github.com/cozystack/standalone-trustd/internal/registrator"
+	"github.com/cozystack/standalone-trustd/internal/signer/pkcs11"
+)
+
+const (
+	userPIN    = "1234"
+	soPIN      = "5678"
+	tokenLabel = "trustd-test"
+)
+
+// PKCS#11 3.0 constants missing from the bindings.
+const (
+	ckkECEdwards           = 0x00000040
+	ckmECEdwardsKeyPairGen = 0x00001055
+)
+
+var (
+	oidP256    = asn1.ObjectIdentifier{1, 2, 840, 10045, 3, 1, 7}
+	oidEd25519 = asn1.ObjectIdentifier{1, 3, 101, 112}
+)
+
+// softHSMModule returns the path of the SoftHSM2 module, or skips the test.
+func softHSMModule(t *testing.T) string {
+	t.Helper()
+
+	candidates := []string{
+		os.Getenv("SOFTHSM2_MODULE"),
+		"/usr/lib/softhsm/libsofthsm2.so",
+		"/usr/lib/x86_64-linux-gnu/softhsm/libsofthsm2.so",
+		"/usr/lib/aarch64-linux-gnu/softhsm/libsofthsm2.so",
+		"/usr/local/lib/softhsm/libsofthsm2.so",
+		"/opt/homebrew/lib/softhsm/libsofthsm2.so",
+	}
+
+	for _, path := range candidates {
+		if path == "" {
+			continue
+		}
+
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+
+	t.Skip("SoftHSM2 not found, set SOFTHSM2_MODULE")
+
+	return ""
+}
+
+func ecParams(t *testing.T, oid asn1.ObjectIdentifier) []byte {
+	t.Helper()
+
+	der, err := asn1.Marshal(oid)
+	require.NoError(t, err)
+
+	return der
+}
+
+// newToken initializes a SoftHSM2 token holding an ECDSA, an RSA and an
+// Ed25519 key, labeled after their type, and returns its slot.
+func newToken(t *testing.T, module string) uint {
+	t.Helper()
+
+	dir := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "tokens"), 0700))
+
+	conf := filepath.Join(dir, "softhsm2.conf")
+	require.NoError(t, os.WriteFile(conf, []byte("directories.tokendir = "+filepath.Join(dir, "tokens")+"\nobjectstore.backend = file\nlog.level = ERROR\n"), 0600))
+	t.Setenv("SOFTHSM2_CONF", conf)
+
+	ctx := p11.New(module)
+	require.NotNil(t, ctx)
+	require.NoError(t, ctx.Initialize())
+
+	defer func() {
+		ctx.Finalize()
+		ctx.Destroy()
+	}()
+
+	slots, err := ctx.GetSlotList(false)
+	require.NoError(t, err)
+	require.NotEmpty(t, slots)
+	require.NoError(t, ctx.InitToken(slots[0], soPIN, tokenLabel))
+
+	// SoftHSM2 moves an initialized token to a new slot
+	slots, err = ctx.GetSlotList(true)
+	require.NoError(t, err)
+
+	var slot uint
+
+	found := false
+
+	for _, s := range slots {
+		info, err := ctx.GetTokenInfo(s)
+		require.NoError(t, err)
+
+		if info.Label == tokenLabel {
+			slot, found = s, true
+		}
+	}
+
+	require.True(t, found)
+
+	session, err := ctx.OpenSession(slot, p11.CKF_SERIAL_SESSION|p11.CKF_RW_SESSION)
+	require.NoError(t, err)
+
+	defer ctx.CloseSession(session)
+
+	require.NoError(t, ctx.Login(session, p11.CKU_SO, soPIN))
+	require.NoError(t, ctx.InitPIN(session, userPIN))
+	require.NoError(t, ctx.Logout(session))
+	require.NoError(t, ctx.Login(session, p11.CKU_USER, userPIN))
+
+	for i, key := range []struct {
+		label     string
+		mechanism uint
+		keyType   uint
+		public    []*p11.Attribute
+	}{
+		{"ecdsa", p11.CKM_EC_KEY_PAIR_GEN, p11.CKK_EC, []*p11.Attribute{
+			p11.NewAttribute(p11.CKA_EC_PARAMS, ecParams(t, oidP256)),
+		}},
+		{"rsa", p11.CKM_RSA_PKCS_KEY_PAIR_GEN, p11.CKK_RSA, []*p11.Attribute{
+			p11.NewAttribute(p11.CKA_MODULUS_BITS, 2048),
+			p11.NewAttribute(p11.CKA_PUBLIC_EXPONENT, []byte{1, 0, 1}),
+		}},
+		{"ed25519", ckmECEdwardsKeyPairGen, ckkECEdwards, []*p11.Attribute{
+			p11.NewAttribute(p11.CKA_EC_PARAMS, ecParams(t, oidEd25519)),
+		}},
+	} {
+		common := func(class uint) []*p11.Attribute {
+			return []*p11.Attribute{
+				p11.NewAttribute(p11.CKA_CLASS, class),
+				p11.NewAttribute(p11.CKA_KEY_TYPE, key.keyType),
+				p11.NewAttribute(p11.CKA_TOKEN, true),
+				p11.NewAttribute(p11.CKA_LABEL, key.label),
+				p11.NewAttribute(p11.CKA_ID, []byte{byte(i + 1)}),
+			}
+		}
+
+		_, _, err = ctx.GenerateKeyPair(session,
+			[]*p11.Mechanism{p11.NewMechanism(key.mechanism, nil)},
+			append(common(p11.CKO_PUBLIC_KEY), append(key.public, p11.NewAttribute(p11.CKA_VERIFY, true))...),
+			append(common(p11.CKO_PRIVATE_KEY),
+				p11.NewAttribute(p11.CKA_SIGN, true),
+				p11.NewAttribute(p11.CKA_PRIVATE, true),
+				p11.NewAttribute(p11.CKA_SENSITIVE, true),
+			),
+		)
+		require.NoError(t, err, key.label)
+	}
+
+	return slot
+}
+
+func TestSigner(t *testing.T) {
+	module := softHSMModule(t)
+	slot := newToken(t, module)
+
+	dir := t.TempDir()
+	pinFile := filepath.Join(dir, "pin")
+	require.NoError(t, os.WriteFile(pinFile, []byte(userPIN+"\n"), 0600))
+
+	cfg := pkcs11.Config{Module: module, Slot: slot, PINFile: pinFile}
+
+	// the token holds several keys
+	_, err := pkcs11.Open(cfg)
+	assert.ErrorContains(t, err, "several private keys")
+
+	cfg.KeyLabel = "missing"
+	_, err = pkcs11.Open(cfg)
+	assert.ErrorContains(t, err, "not found")
+
+	for _, label := range []string{"ecdsa", "rsa", "ed25519"} {
+		t.Run(label, func(t *testing.T) {
+			cfg.KeyLabel = label
+
+			signer, err := pkcs11.Open(cfg)
+			require.NoError(t, err)
+
+			defer signer.Close()
+
+			// a self-signed CA whose key never leaves the token
+			template := &stdx509.Certificate{
+				SerialNumber:          big.NewInt(1),
+				Subject:               pkix.Name{Organization: []string{"hsm-ca"}},
+				NotBefore:             time.Now().Add(-time.Minute),
+				NotAfter:              time.Now().Add(time.Hour),
+				KeyUsage:              stdx509.KeyUsageCertSign | stdx509.KeyUsageDigitalSignature,
+				BasicConstraintsValid: true,
+				IsCA:                  true,
+			}
+
+			der, err := stdx509.CreateCertificate(rand.Reader, template, template, signer.Public(), signer)
+			require.NoError(t, err)
+
+			ca, err := stdx509.ParseCertificate(der)
+			require.NoError(t, err)
+			require.NoError(t, ca.CheckSignatureFrom(ca))
+
+			caCert := filepath.Join(dir, label+".crt")
+			require.NoError(t, os.WriteFile(caCert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644))
+
+			store, err := pki.Load(pki.Files{CACert: caCert, Signer: signer, IncludeSigningCA: true})
+			require.NoError(t, err)
+
+			csr, _, err := x509.NewEd25519CSRAndIdentity(
+				x509.IPAddresses([]net.IP{net.ParseIP("10.5.0.4")}),
+				x509.CommonName("test-server"),
+			)
+			require.NoError(t, err)
+
+			ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("10.5.0.4"), Port: 30000}})
+
+			resp, err := (&registrator.Registrator{PKI: store}).Certificate(ctx, &securityapi.CertificateRequest{
+				Csr: csr.X509CertificateRequestPEM,
+			})
+			require.NoError(t, err)
+
+			block, _ := pem.Decode(resp.Crt)
+			require.NotNil(t, block)
+
+			leaf, err := stdx509.ParseCertificate(block.Bytes)
+			require.NoError(t, err)
+			assert.NoError(t, leaf.CheckSignatureFrom(ca))
+		})
+	}
+
+	// a CA certificate of another key is rejected
+	cfg.KeyLabel = "ecdsa"
+
+	signer, err := pkcs11.Open(cfg)
+	require.NoError(t, err)
+
+	defer signer.Close()
+
+	_, err = pki.Load(pki.Files{CACert: filepath.Join(dir, "rsa.crt"), Signer: signer, IncludeSigningCA: true})
+	assert.ErrorContains(t, err, "does not match")
+}
+
+// fakeToken is a token holding a P-256 key, which can be reset or removed
+// to invalidate its sessions without SoftHSM2.
+type fakeToken struct {
+	key *ecdsa.PrivateKey
+	pin string
+	// removed fails opening sessions
+	removed bool
+	logins  int
+
+	// sessions are the open sessions, and whether they are logged in
+	sessions    map[p11.SessionHandle]bool
+	nextSession p11.SessionHandle
+	// generation changes the object handles on every reset
+	generation p11.ObjectHandle
+	found      []p11.ObjectHandle
+}
+
+func newFakeToken(t *testing.T) *fakeToken {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	return &fakeToken{key: key, pin: userPIN, sessions: map[p11.SessionHandle]bool{}}
+}
+
+// reset closes all sessions, like a token reset.
+func (f *fakeToken) reset() {
+	clear(f.sessions)
+	f.generation++
+}
+
+func (f *fakeToken) privateKey() p11.ObjectHandle { return 10*f.generation + 1 }
+func (f *fakeToken) publicKey() p11.ObjectHandle  { return 10*f.generation + 2 }
+
+func (f *fakeToken) OpenSession(uint, uint) (p11.SessionHandle, error) {
+	if f.removed {
+		return 0, p11.Error(p11.CKR_TOKEN_NOT_PRESENT)
+	}
+
+	f.nextSession++
+	f.sessions[f.nextSession] = false
+
+	return f.nextSession, nil
+}
+
+func (f *fakeToken) CloseSession(sh p11.SessionHandle) error {
+	if _, ok := f.sessions[sh]; !ok {
+		return p11.Error(p11.CKR_SESSION_HANDLE_INVALID)
+	}
+
+	delete(f.sessions, sh)
+
+	return nil
+}
+
+func (f *fakeToken) Login(sh p11.SessionHandle, _ uint, pin string) error {
+	if _, ok := f.sessions[sh]; !ok {
+		return p11.Error(p11.CKR_SESSION_HANDLE_INVALID)
+	}
+
+	if pin != f.pin {
+		return p11.Error(p11.CKR_PIN_INCORRECT)
+	}
+
+	f.sessions[sh] = true
+	f.logins++
+
+	return nil
+}
+
+// loggedIn checks that a session is open and logged in.
+func (f *fakeToken) loggedIn(sh p11.SessionHandle) error {
+	loggedIn, ok := f.sessions[sh]
+
+	switch {
+	case !ok:
+		return p11.Error(p11.CKR_SESSION_HANDLE_INVALID)
+	case !loggedIn:
+		return p11.Error(p11.CKR_USER_NOT_LOGGED_IN)
+	default:
+		return nil
+	}
+}
+
+func (f *fakeToken) FindObjectsInit(sh p11.SessionHandle, template []*p11.Attribute) error {
+	if err := f.loggedIn(sh); err != nil {
+		return err
+	}
+
+	f.found = nil
+
+	for _, attr := range template {
+		if attr.Type != p11.CKA_CLASS {
+			continue
+		}
+
+		switch binary.NativeEndian.Uint64(attr.Value) {
+		case p11.CKO_PRIVATE_KEY:
+			f.found = []p11.ObjectHandle{f.privateKey()}
+		case p11.CKO_PUBLIC_KEY:
+			f.found = []p11.ObjectHandle{f.publicKey()}
+		}
+	}
+
+	return nil
+}
+
+func (f *fakeToken) FindObjects(p11.SessionHandle, int) ([]p11.ObjectHandle, bool, error) {
+	found := f.found
+	f.found = nil
+
+	return found, false, nil
+}
+
+func (f *fakeToken) FindObjectsFinal(p11.SessionHandle) error {
+	return nil
+}
+
+func (f *fakeToken) GetAttributeValue(sh p11.SessionHandle, _ p11.ObjectHandle, template []*p11.Attribute) ([]*p11.Attribute, error) {
+	if err := f.loggedIn(sh); err != nil {
+		return nil, err
+	}
+
+	point, err := f.key.PublicKey.Bytes()
+	if err != nil {
+		return nil, err
+	}
+
+	params, err := asn1.Marshal(oidP256)
+	if err != nil {
+		return nil, err
+	}
+
+	if point, err = asn1.Marshal(point); err != nil {
+		return nil, err
+	}
+
+	attrs := make([]*p11.Attribute, 0, len(template))
+
+	for _, attr := range template {
+		switch attr.Type {
+		case p11.CKA_KEY_TYPE:
+			attrs = append(attrs, p11.NewAttribute(attr.Type, p11.CKK_EC))
+		case p11.CKA_ID:
+			attrs = append(attrs, p11.NewAttribute(attr.Type, []byte{1}))
+		case p11.CKA_LABEL:
+			attrs = append(attrs, p11.NewAttribute(attr.Type, "ecdsa"))
+		case p11.CKA_EC_PARAMS:
+			attrs = append(attrs, p11.NewAttribute(attr.Type, params))
+		case p11.CKA_EC_POINT:
+			attrs = append(attrs, p11.NewAttribute(attr.Type, point))
+		default:
+			return nil, p11.Error(p11.CKR_ATTRIBUTE_TYPE_INVALID)
+		}
+	}
+
+	return attrs, nil
+}
+
+func (f *fakeToken) SignInit(sh p11.SessionHandle, _ []*p11.Mechanism, key p11.ObjectHandle) error {
+	if err := f.loggedIn(sh); err != nil {
+		return err
+	}
+
+	if key != f.privateKey() {
+		return p11.Error(p11.CKR_KEY_HANDLE_INVALID)
+	}
+
+	return nil
+}
+
+func (f *fakeToken) Sign(sh p11.SessionHandle, digest []byte) ([]byte, error) {
+	if err := f.loggedIn(sh); err != nil {
+		return nil, err
+	}
+
+	r, s, err := ecdsa.Sign(rand.Reader, f.key, digest)
+	if err != nil {
+		return nil, err
+	}
+
+	// r || s
+	return append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...), nil
+}
+
+func TestSignerSessionLoss(t *testing.T) {
+	tok := newFakeToken(t)
+
+	pinFile := filepath.Join(t.TempDir(), "pin")
+	require.NoError(t, os.WriteFile(pinFile, []byte(userPIN), 0600))
+
+	signer, err := pkcs11.OpenToken(tok, pkcs11.Config{PINFile: pinFile})
+	require.NoError(t, err)
+
+	defer signer.Close()
+
+	digest := sha256.Sum256([]byte("to be signed"))
+
+	// sign signs the digest and checks the signature with the key of the token
+	sign := func() error {
+		signature, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+		if err != nil {
+			return err
+		}
+
+		assert.True(t, ecdsa.VerifyASN1(&tok.key.PublicKey, digest[:], signature))
+
+		return nil
+	}
+
+	require.NoError(t, sign())
+	assert.Equal(t, 1, tok.logins)
+
+	// a reset token gets a new session, and the key a new handle
+	tok.reset()
+	require.NoError(t, sign())
+	assert.Equal(t, 2, tok.logins)
+	assert.Len(t, tok.sessions, 1)
+
+	// a removed token fails signatures until it is back
+	tok.reset()
+	tok.removed = true
+	assert.ErrorContains(t, sign(), "failed to replace the lost session")
+
+	tok.removed = false
+	require.NoError(t, sign())
+
+	// the PIN file is read again
+	tok.pin = "4321"
+	require.NoError(t, os.WriteFile(pinFile, []byte(tok.pin), 0600))
+	tok.reset()
+	require.NoError(t, sign())
+
+	// a token holding another key is refused
+	public := signer.Public()
+
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tok.key = other
+	tok.reset()
+
+	_, err = signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	assert.ErrorContains(t, err, "the private key changed")
+	assert.Equal(t, public, signer.Public())
+	assert.Empty(t, tok.sessions)
+}
@@ -0,0 +1,517 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build cgo
+
+package pkcs11
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"sync"
+
+	p11 "github.com/miekg/pkcs11"
+)
+
+// PKCS#11 3.0 constants missing from the bindings.
+const (
+	ckkECEdwards = 0x00000040
+	ckmEdDSA     = 0x00001057
+)
+
+// modules are the loaded PKCS#11 modules by path. A module can be
+// initialized only once per process, so signers share it.
+var modules = struct {
+	sync.Mutex
+	loaded map[string]*module
+}{loaded: map[string]*module{}}
+
+type module struct {
+	ctx  *p11.Ctx
+	refs int
+}
+
+// loadModule loads and initializes a module, or returns the loaded one.
+func loadModule(path string) (*p11.Ctx, error) {
+	modules.Lock()
+	defer modules.Unlock()
+
+	if m, ok := modules.loaded[path]; ok {
+		m.refs++
+
+		return m.ctx, nil
+	}
+
+	ctx := p11.New(path)
+	if ctx == nil {
+		return nil, fmt.Errorf("failed to load PKCS#11 module %s", path)
+	}
+
+	if err := ctx.Initialize(); err != nil {
+		ctx.Destroy()
+
+		return nil, fmt.Errorf("failed to initialize PKCS#11 module %s: %w", path, err)
+	}
+
+	modules.loaded[path] = &module{ctx: ctx, refs: 1}
+
+	return ctx, nil
+}
+
+// unloadModule finalizes and unloads a module once no signer uses it.
+func unloadModule(path string) error {
+	modules.Lock()
+	defer modules.Unlock()
+
+	m := modules.loaded[path]
+
+	if m.refs--; m.refs > 0 {
+		return nil
+	}
+
+	delete(modules.loaded, path)
+
+	err := m.ctx.Finalize()
+	m.ctx.Destroy()
+
+	return err
+}
+
+// token is the part of the PKCS#11 API used by a Signer, implemented by the
+// *p11.Ctx of a module.
+type token interface {
+	OpenSession(slotID uint, flags uint) (p11.SessionHandle, error)
+	CloseSession(sh p11.SessionHandle) error
+	Login(sh p11.SessionHandle, userType uint, pin string) error
+	FindObjectsInit(sh p11.SessionHandle, temp []*p11.Attribute) error
+	FindObjects(sh p11.SessionHandle, max int) ([]p11.ObjectHandle, bool, error)
+	FindObjectsFinal(sh p11.SessionHandle) error
+	GetAttributeValue(sh p11.SessionHandle, o p11.ObjectHandle, a []*p11.Attribute) ([]*p11.Attribute, error)
+	SignInit(sh p11.SessionHandle, m []*p11.Mechanism, o p11.ObjectHandle) error
+	Sign(sh p11.SessionHandle, message []byte) ([]byte, error)
+}
+
+// Signer is a crypto.Signer backed by a private key of a PKCS#11 token.
+//
+// A session lost to a token reset or removal is replaced on the next
+// signature, logging in again with the current content of the PIN file.
+type Signer struct {
+	ctx    token
+	cfg    Config
+	unload func() error
+
+	// a session must not be used concurrently
+	mu      sync.Mutex
+	session p11.SessionHandle
+	opened  bool
+
+	key     p11.ObjectHandle
+	keyType uint
+	public  crypto.PublicKey
+}
+
+// Open loads the module, logs in to the token and looks up the private key.
+func Open(cfg Config) (*Signer, error) {
+	if _, err := cfg.readPIN(); err != nil {
+		return nil, err
+	}
+
+	ctx, err := loadModule(cfg.Module)
+	if err != nil {
+		return nil, err
+	}
+
+	return openToken(ctx, cfg, func() error { return unloadModule(cfg.Module) })
+}
+
+// openToken logs in to the token and looks up the private key. unload, if
+// set, releases the token when the signer is closed.
+func openToken(ctx token, cfg Config, unload func() error) (*Signer, error) {
+	s := &Signer{ctx: ctx, cfg: cfg, unload: unload}
+
+	if err := s.open(); err != nil {
+		s.Close()
+
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// open opens a session, logs in and looks up the private key.
+func (s *Signer) open() error {
+	cfg := s.cfg
+
+	pin, err := cfg.readPIN()
+	if err != nil {
+		return err
+	}
+
+	session, err := s.ctx.OpenSession(cfg.Slot, p11.CKF_SERIAL_SESSION)
+	if err != nil {
+		return fmt.Errorf("failed to open a session on slot %d: %w", cfg.Slot, err)
+	}
+
+	s.session, s.opened = session, true
+
+	if err = s.ctx.Login(session, p11.CKU_USER, pin); err != nil && !errors.Is(err, p11.Error(p11.CKR_USER_ALREADY_LOGGED_IN)) {
+		return fmt.Errorf("failed to log in to slot %d: %w", cfg.Slot, err)
+	}
+
+	template := []*p11.Attribute{p11.NewAttribute(p11.CKA_CLASS, p11.CKO_PRIVATE_KEY)}
+	if cfg.KeyLabel != "" {
+		template = append(template, p11.NewAttribute(p11.CKA_LABEL, cfg.KeyLabel))
+	}
+
+	keys, err := s.find(template)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case len(keys) == 0 && cfg.KeyLabel != "":
+		return fmt.Errorf("private key %q not found on slot %d", cfg.KeyLabel, cfg.Slot)
+	case len(keys) == 0:
+		return fmt.Errorf("no private key found on slot %d", cfg.Slot)
+	case len(keys) > 1:
+		return fmt.Errorf("several private keys found on slot %d, select one by its label", cfg.Slot)
+	}
+
+	s.key = keys[0]
+
+	attrs, err := s.ctx.GetAttributeValue(session, s.key, []*p11.Attribute{
+		p11.NewAttribute(p11.CKA_KEY_TYPE, nil),
+		p11.NewAttribute(p11.CKA_ID, nil),
+		p11.NewAttribute(p11.CKA_LABEL, nil),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read the private key attributes: %w", err)
+	}
+
+	s.keyType = ulong(attrs[0].Value)
+
+	if s.public, err = s.publicKey(attrs[1].Value, attrs[2].Value); err != nil {
+		return fmt.Errorf("failed to read the public key: %w", err)
+	}
+
+	return nil
+}
+
+// find returns all objects matching the template.
+func (s *Signer) find(template []*p11.Attribute) ([]p11.ObjectHandle, error) {
+	if err := s.ctx.FindObjectsInit(s.session, template); err != nil {
+		return nil, fmt.Errorf("failed to search objects: %w", err)
+	}
+
+	defer s.ctx.FindObjectsFinal(s.session)
+
+	var objects []p11.ObjectHandle
+
+	for {
+		found, _, err := s.ctx.FindObjects(s.session, 16)
+		if err != nil {
+			return nil, fmt.Errorf("failed to search objects: %w", err)
+		}
+
+		if len(found) == 0 {
+			return objects, nil
+		}
+
+		objects = append(objects, found...)
+	}
+}
+
+// publicKey reads the public key matching the private key. RSA private keys
+// carry it, for other types it is read from the public key object with the
+// same ID, or else the same label.
+func (s *Signer) publicKey(id, label []byte) (crypto.PublicKey, error) {
+	if s.keyType == p11.CKK_RSA {
+		attrs, err := s.ctx.GetAttributeValue(s.session, s.key, []*p11.Attribute{
+			p11.NewAttribute(p11.CKA_MODULUS, nil),
+			p11.NewAttribute(p11.CKA_PUBLIC_EXPONENT, nil),
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(attrs[0].Value),
+			E: int(new(big.Int).SetBytes(attrs[1].Value).Int64()),
+		}, nil
+	}
+
+	template := []*p11.Attribute{p11.NewAttribute(p11.CKA_CLASS, p11.CKO_PUBLIC_KEY)}
+
+	if len(id) > 0 {
+		template = append(template, p11.NewAttribute(p11.CKA_ID, id))
+	} else {
+		template = append(template, p11.NewAttribute(p11.CKA_LABEL, label))
+	}
+
+	objects, err := s.find(template)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(objects) != 1 {
+		return nil, fmt.Errorf("found %d matching public keys", len(objects))
+	}
+
+	attrs, err := s.ctx.GetAttributeValue(s.session, objects[0], []*p11.Attribute{
+		p11.NewAttribute(p11.CKA_EC_PARAMS, nil),
+		p11.NewAttribute(p11.CKA_EC_POINT, nil),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// the point is a DER octet string, but some tokens return it raw
+	point := attrs[1].Value
+
+	var unwrapped []byte
+	if rest, err := asn1.Unmarshal(point, &unwrapped); err == nil && len(rest) == 0 {
+		point = unwrapped
+	}
+
+	switch s.keyType {
+	case p11.CKK_EC:
+		curve, err := namedCurve(attrs[0].Value)
+		if err != nil {
+			return nil, err
+		}
+
+		return ecdsa.ParseUncompressedPublicKey(curve, point)
+	case ckkECEdwards:
+		if len(point) != ed25519.PublicKeySize {
+			return nil, errors.New("only Ed25519 Edwards curve keys are supported")
+		}
+
+		return ed25519.PublicKey(point), nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %#x", s.keyType)
+	}
+}
+
+var curveOIDs = map[string]elliptic.Curve{
+	"1.2.840.10045.3.1.7": elliptic.P256(),
+	"1.3.132.0.34":        elliptic.P384(),
+	"1.3.132.0.35":        elliptic.P521(),
+}
+
+func namedCurve(params []byte) (elliptic.Curve, error) {
+	var oid asn1.ObjectIdentifier
+	if _, err := asn1.Unmarshal(params, &oid); err != nil {
+		return nil, fmt.Errorf("failed to parse the EC parameters: %w", err)
+	}
+
+	curve, ok := curveOIDs[oid.String()]
+	if !ok {
+		return nil, fmt.Errorf("unsupported curve %s", oid)
+	}
+
+	return curve, nil
+}
+
+// Public implements crypto.Signer.
+func (s *Signer) Public() crypto.PublicKey {
+	return s.public
+}
+
+// Sign implements crypto.Signer. ECDSA signatures are returned ASN.1
+// encoded, like crypto/ecdsa does.
+func (s *Signer) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	mechanism, data, err := s.mechanism(digest, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// a previous attempt to replace a lost session failed
+	if !s.opened {
+		if err = s.reopen(); err != nil {
+			return nil, fmt.Errorf("PKCS#11 sign: %w", err)
+		}
+	}
+
+	signature, err := s.sign(mechanism, data)
+	if sessionLost(err) {
+		slog.Warn("PKCS#11 session lost, logging in again", "module", s.cfg.Module, "slot", s.cfg.Slot, "error", err)
+
+		if err = s.reopen(); err == nil {
+			signature, err = s.sign(mechanism, data)
+		}
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("PKCS#11 sign: %w", err)
+	}
+
+	if s.keyType != p11.CKK_EC {
+		return signature, nil
+	}
+
+	// PKCS#11 returns r || s
+	half := len(signature) / 2
+
+	return asn1.Marshal(struct{ R, S *big.Int }{
+		new(big.Int).SetBytes(signature[:half]),
+		new(big.Int).SetBytes(signature[half:]),
+	})
+}
+
+func (s *Signer) sign(mechanism *p11.Mechanism, data []byte) ([]byte, error) {
+	if err := s.ctx.SignInit(s.session, []*p11.Mechanism{mechanism}, s.key); err != nil {
+		return nil, err
+	}
+
+	return s.ctx.Sign(s.session, data)
+}
+
+// sessionLost reports whether an error means that the session, or the key
+// handle found in it, is gone, e.g. because the token was reset.
+func sessionLost(err error) bool {
+	var code p11.Error
+	if !errors.As(err, &code) {
+		return false
+	}
+
+	switch code {
+	case p11.CKR_SESSION_HANDLE_INVALID, p11.CKR_SESSION_CLOSED, p11.CKR_USER_NOT_LOGGED_IN,
+		p11.CKR_KEY_HANDLE_INVALID, p11.CKR_OBJECT_HANDLE_INVALID,
+		p11.CKR_DEVICE_REMOVED, p11.CKR_TOKEN_NOT_PRESENT:
+		return true
+	default:
+		return false
+	}
+}
+
+// reopen replaces the session with a new one. The key is looked up again,
+// as its handle may have changed, and must still be the key of the CA.
+func (s *Signer) reopen() error {
+	if s.opened {
+		s.ctx.CloseSession(s.session) //nolint:errcheck
+		s.opened = false
+	}
+
+	public := s.public
+
+	err := s.open()
+	if err == nil && !public.(interface{ Equal(crypto.PublicKey) bool }).Equal(s.public) {
+		err = errors.New("the private key changed")
+	}
+
+	if err != nil {
+		if s.opened {
+			s.ctx.CloseSession(s.session) //nolint:errcheck
+			s.opened = false
+		}
+
+		s.public = public
+
+		return fmt.Errorf("failed to replace the lost session: %w", err)
+	}
+
+	return nil
+}
+
+// DigestInfo prefixes of PKCS #1 v1.5 signatures, see crypto/rsa.
+var hashPrefixes = map[crypto.Hash][]byte{
+	crypto.SHA256: {0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20},
+	crypto.SHA384: {0x30, 0x41, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x02, 0x05, 0x00, 0x04, 0x30},
+	crypto.SHA512: {0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40},
+}
+
+// PSS hash and MGF mechanisms.
+var pssParams = map[crypto.Hash][2]uint{
+	crypto.SHA256: {p11.CKM_SHA256, p11.CKG_MGF1_SHA256},
+	crypto.SHA384: {p11.CKM_SHA384, p11.CKG_MGF1_SHA384},
+	crypto.SHA512: {p11.CKM_SHA512, p11.CKG_MGF1_SHA512},
+}
+
+// mechanism returns the mechanism and the data to sign for the key type.
+func (s *Signer) mechanism(digest []byte, opts crypto.SignerOpts) (*p11.Mechanism, []byte, error) {
+	hash := opts.HashFunc()
+
+	switch s.keyType {
+	case p11.CKK_EC:
+		return p11.NewMechanism(p11.CKM_ECDSA, nil), digest, nil
+	case ckkECEdwards:
+		if hash != crypto.Hash(0) {
+			return nil, nil, errors.New("Ed25519 signs unhashed messages")
+		}
+
+		return p11.NewMechanism(ckmEdDSA, nil), digest, nil
+	}
+
+	if pss, ok := opts.(*rsa.PSSOptions); ok {
+		params, ok := pssParams[hash]
+		if !ok {
+			return nil, nil, fmt.Errorf("unsupported hash %s", hash)
+		}
+
+		saltLength := pss.SaltLength
+		if saltLength == rsa.PSSSaltLengthAuto || saltLength == rsa.PSSSaltLengthEqualsHash {
+			saltLength = hash.Size()
+		}
+
+		return p11.NewMechanism(p11.CKM_RSA_PKCS_PSS, p11.NewPSSParams(params[0], params[1], uint(saltLength))), digest, nil
+	}
+
+	prefix, ok := hashPrefixes[hash]
+	if !ok {
+		return nil, nil, fmt.Errorf("unsupported hash %s", hash)
+	}
+
+	return p11.NewMechanism(p11.CKM_RSA_PKCS, nil), append(prefix[:len(prefix):len(prefix)], digest...), nil
+}
+
+// Close closes the session and unloads the module if no other signer uses
+// it.
+func (s *Signer) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.ctx == nil {
+		return nil
+	}
+
+	var err error
+
+	if s.opened {
+		err = s.ctx.CloseSession(s.session)
+		s.opened = false
+	}
+
+	if s.unload != nil {
+		err = errors.Join(err, s.unload())
+	}
+
+	s.ctx = nil
+
+	return err
+}
+
+// ulong decodes a CK_ULONG attribute value.
+func ulong(b []byte) uint {
+	switch len(b) {
+	case 8:
+		return uint(binary.NativeEndian.Uint64(b))
+	case 4:
+		return uint(binary.NativeEndian.Uint32(b))
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,362 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package plugin signs certificates with an external process speaking the
+// signer protocol (api/signer/v1) over a Unix socket.
+//
+// trustd builds each certificate itself and only sends its TBS part to the
+// plugin, which holds the private key of the CA.
+package plugin
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	stdx509 "crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/siderolabs/crypto/x509"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc/filters"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+
+	signerv1 "github.com/cozystack/standalone-trustd/api/signer/v1"
+	"github.com/cozystack/standalone-trustd/internal/pki"
+	"github.com/cozystack/standalone-trustd/internal/registrator"
+)
+
+// Defaults of Config.
+const (
+	DefaultTimeout        = 5 * time.Second
+	DefaultRetries        = 2
+	DefaultHealthInterval = 10 * time.Second
+)
+
+// retryBackoff is the delay before the first retry, doubled for each next one.
+const retryBackoff = 100 * time.Millisecond
+
+// Config selects a signer plugin.
+type Config struct {
+	// Socket is the path of the Unix socket the plugin listens on.
+	Socket string `yaml:"socket"`
+	// Timeout bounds each call to the plugin, DefaultTimeout if zero.
+	Timeout time.Duration `yaml:"timeout"`
+	// Retries is how often a call failing with Unavailable or a timeout is
+	// repeated, DefaultRetries if zero; negative disables retries.
+	Retries int `yaml:"retries"`
+	// HealthInterval is how often the plugin's health and chain are checked,
+	// DefaultHealthInterval if zero.
+	HealthInterval time.Duration `yaml:"healthInterval"`
+}
+
+// Backend implements registrator.Backend with a signer plugin.
+type Backend struct {
+	cfg    Config
+	conn   *grpc.ClientConn
+	signer signerv1.SignerServiceClient
+	health healthpb.HealthClient
+
+	// serving is false once a health check failed, so that requests fail
+	// fast until the plugin recovers
+	serving atomic.Bool
+
+	mu    sync.Mutex
+	chain []*stdx509.Certificate
+}
+
+// New returns a backend for the plugin. The plugin doesn't need to be up
+// yet: the connection is established lazily.
+func New(cfg Config) (*Backend, error) {
+	if cfg.Socket == "" {
+		return nil, errors.New("signer plugin socket is required")
+	}
+
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultTimeout
+	}
+
+	if cfg.Retries == 0 {
+		cfg.Retries = DefaultRetries
+	}
+
+	if cfg.HealthInterval <= 0 {
+		cfg.HealthInterval = DefaultHealthInterval
+	}
+
+	conn, err := grpc.NewClient("unix:"+cfg.Socket,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		// trace signatures, as part of issuing certificates, but not polling
+		grpc.WithStatsHandler(otelgrpc.NewClientHandler(otelgrpc.WithFilter(filters.FullMethodName(signerv1.SignerService_Sign_FullMethodName)))),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to the signer plugin: %w", err)
+	}
+
+	b := &Backend{
+		cfg:    cfg,
+		conn:   conn,
+		signer: signerv1.NewSignerServiceClient(conn),
+		health: healthpb.NewHealthClient(conn),
+	}
+
+	b.serving.Store(true)
+
+	return b, nil
+}
+
+// Close closes the connection to the plugin.
+func (b *Backend) Close() error {
+	return b.conn.Close()
+}
+
+// Watch checks the health of the plugin and refreshes the chain every
+// HealthInterval, until the context is canceled. name identifies the plugin
+// in log messages.
+func (b *Backend) Watch(ctx context.Context, name string) {
+	ticker := time.NewTicker(b.cfg.HealthInterval)
+	defer ticker.Stop()
+
+	for {
+		err := b.Check(ctx)
+
+		switch serving := err == nil; {
+		case ctx.Err() != nil:
+			return
+		case serving != b.serving.Load():
+			if serving {
+				slog.Info("signer plugin is serving again", "name", name)
+			} else {
+				slog.Warn("signer plugin is not serving", "name", name, "error", err)
+			}
+		}
+
+		b.serving.Store(err == nil)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Check verifies that the plugin is serving and refreshes the chain, which
+// changes when the plugin rotates its CA.
+func (b *Backend) Check(ctx context.Context) error {
+	var resp *healthpb.HealthCheckResponse
+
+	if err := b.call(ctx, func(ctx context.Context) (err error) {
+		resp, err = b.health.Check(ctx, &healthpb.HealthCheckRequest{Service: signerv1.SignerService_ServiceDesc.ServiceName})
+
+		return err
+	}); err != nil {
+		return err
+	}
+
+	if resp.Status != healthpb.HealthCheckResponse_SERVING {
+		return fmt.Errorf("health status %s", resp.Status)
+	}
+
+	_, err := b.fetchChain(ctx)
+
+	return err
+}
+
+// Sign implements registrator.Backend.
+func (b *Backend) Sign(ctx context.Context, csr *stdx509.CertificateRequest, template *stdx509.Certificate) (*registrator.Issued, error) {
+	if !b.serving.Load() {
+		return nil, status.Error(codes.Unavailable, "signer plugin is not serving")
+	}
+
+	chain, err := b.currentChain(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	serialNumber, err := x509.NewSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+
+	template.SerialNumber = serialNumber
+
+	der, err := stdx509.CreateCertificate(rand.Reader, template, chain[0], csr.PublicKey, &remoteKey{ctx: ctx, backend: b, public: chain[0].PublicKey})
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := stdx509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	issued := &registrator.Issued{Certificate: cert, Chain: chain}
+
+	// clients trust the roots of the chain, or its last certificate if the
+	// plugin omits the root
+	trusted := chain[len(chain)-1:]
+
+	for _, cert := range chain {
+		if pki.SelfSigned(cert) {
+			trusted = []*stdx509.Certificate{cert}
+
+			break
+		}
+	}
+
+	for _, cert := range trusted {
+		issued.CAs = append(issued.CAs, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+	}
+
+	return issued, nil
+}
+
+// IssuerNotAfter implements registrator.IssuerExpiry, as the plugin signs
+// the template of the registrator.
+func (b *Backend) IssuerNotAfter(ctx context.Context) (time.Time, error) {
+	chain, err := b.currentChain(ctx)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return pki.ChainNotAfter(chain), nil
+}
+
+// currentChain returns the cached chain, fetching it on first use.
+func (b *Backend) currentChain(ctx context.Context) ([]*stdx509.Certificate, error) {
+	b.mu.Lock()
+	chain := b.chain
+	b.mu.Unlock()
+
+	if chain != nil {
+		return chain, nil
+	}
+
+	return b.fetchChain(ctx)
+}
+
+// fetchChain asks the plugin for its chain and caches it.
+func (b *Backend) fetchChain(ctx context.Context) ([]*stdx509.Certificate, error) {
+	var resp *signerv1.GetPublicChainResponse
+
+	if err := b.call(ctx, func(ctx context.Context) (err error) {
+		resp, err = b.signer.GetPublicChain(ctx, &signerv1.GetPublicChainRequest{})
+
+		return err
+	}); err != nil {
+		return nil, fmt.Errorf("failed to get the chain of the signer plugin: %w", err)
+	}
+
+	if len(resp.Certificates) == 0 {
+		return nil, errors.New("signer plugin returned an empty chain")
+	}
+
+	chain := make([]*stdx509.Certificate, 0, len(resp.Certificates))
+
+	for _, der := range resp.Certificates {
+		cert, err := stdx509.ParseCertificate(der)
+		if err != nil {
+			return nil, fmt.Errorf("signer plugin returned an invalid certificate: %w", err)
+		}
+
+		chain = append(chain, cert)
+	}
+
+	if !chain[0].IsCA {
+		return nil, errors.New("signer plugin returned a signing certificate which isn't a CA")
+	}
+
+	b.mu.Lock()
+	b.chain = chain
+	b.mu.Unlock()
+
+	return chain, nil
+}
+
+// call runs fn with a timeout, retrying with backoff while the plugin is
+// unavailable or slow.
+func (b *Backend) call(ctx context.Context, fn func(ctx context.Context) error) error {
+	backoff := retryBackoff
+
+	for attempt := 0; ; attempt++ {
+		callCtx, cancel := context.WithTimeout(ctx, b.cfg.Timeout)
+		err := fn(callCtx)
+
+		cancel()
+
+		if code := status.Code(err); attempt >= b.cfg.Retries || ctx.Err() != nil ||
+			(code != codes.Unavailable && code != codes.DeadlineExceeded) {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+	}
+}
+
+// hashes maps the hash functions of crypto.SignerOpts to the protocol.
+var hashes = map[crypto.Hash]signerv1.Hash{
+	0:             signerv1.Hash_HASH_NONE,
+	crypto.SHA256: signerv1.Hash_HASH_SHA256,
+	crypto.SHA384: signerv1.Hash_HASH_SHA384,
+	crypto.SHA512: signerv1.Hash_HASH_SHA512,
+}
+
+// remoteKey is the crypto.Signer of the plugin for a single request.
+type remoteKey struct {
+	ctx     context.Context //nolint:containedctx
+	backend *Backend
+	public  crypto.PublicKey
+}
+
+// Public implements crypto.Signer.
+func (k *remoteKey) Public() crypto.PublicKey {
+	return k.public
+}
+
+// Sign implements crypto.Signer.
+func (k *remoteKey) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	hash, ok := hashes[opts.HashFunc()]
+	if !ok {
+		return nil, fmt.Errorf("unsupported hash %s", opts.HashFunc())
+	}
+
+	req := &signerv1.SignRequest{Digest: digest, Hash: hash}
+
+	if pss, ok := opts.(*rsa.PSSOptions); ok {
+		req.PssSaltLength = int32(pss.SaltLength)
+		if pss.SaltLength == rsa.PSSSaltLengthAuto || pss.SaltLength == rsa.PSSSaltLengthEqualsHash {
+			req.PssSaltLength = -1
+		}
+	}
+
+	var resp *signerv1.SignResponse
+
+	if err := k.backend.call(k.ctx, func(ctx context.Context) (err error) {
+		resp, err = k.backend.signer.Sign(ctx, req)
+
+		return err
+	}); err != nil {
+		return nil, fmt.Errorf("signer plugin failed to sign: %w", err)
+	}
+
+	return resp.Signature, nil
+}
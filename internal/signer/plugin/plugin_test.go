@@ -0,0 +1,173 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package plugin_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	stdx509 "crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/siderolabs/crypto/x509"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/cozystack/standalone-trustd/internal/pki"
+	"github.com/cozystack/standalone-trustd/internal/registrator"
+	"github.com/cozystack/standalone-trustd/internal/signer/plugin"
+)
+
+// startPlugin serves the reference plugin for a new CA on a Unix socket.
+func startPlugin(t *testing.T, opts ...x509.Option) (*x509.CertificateAuthority, string, *grpc.Server) {
+	t.Helper()
+
+	ca, err := x509.NewSelfSignedCertificateAuthority(append([]x509.Option{
+		x509.Organization("plugin-ca"),
+		x509.NotAfter(time.Now().Add(time.Hour)),
+	}, opts...)...)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ca.key")
+
+	require.NoError(t, os.WriteFile(certPath, ca.CrtPEM, 0o600))
+	require.NoError(t, os.WriteFile(keyPath, ca.KeyPEM, 0o600))
+
+	store, err := pki.Load(pki.Files{CACert: certPath, CAKey: keyPath, IncludeSigningCA: true})
+	require.NoError(t, err)
+
+	socket := filepath.Join(dir, "signer.sock")
+
+	listener, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+
+	server := grpc.NewServer()
+	(&plugin.Server{PKI: store}).Register(server)
+
+	go server.Serve(listener) //nolint:errcheck
+
+	t.Cleanup(server.Stop)
+
+	return ca, socket, server
+}
+
+func newBackend(t *testing.T, cfg plugin.Config) *plugin.Backend {
+	t.Helper()
+
+	backend, err := plugin.New(cfg)
+	require.NoError(t, err)
+
+	t.Cleanup(func() { backend.Close() })
+
+	return backend
+}
+
+// sign signs a server certificate for a new key with the backend.
+func sign(t *testing.T, backend *plugin.Backend) (*registrator.Issued, error) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	der, err := stdx509.CreateCertificateRequest(rand.Reader, &stdx509.CertificateRequest{Subject: pkix.Name{CommonName: "worker-1"}}, key)
+	require.NoError(t, err)
+
+	csr, err := stdx509.ParseCertificateRequest(der)
+	require.NoError(t, err)
+
+	return backend.Sign(context.Background(), csr, &stdx509.Certificate{
+		Subject:     csr.Subject,
+		NotBefore:   time.Now(),
+		NotAfter:    time.Now().Add(time.Hour),
+		KeyUsage:    stdx509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []stdx509.ExtKeyUsage{stdx509.ExtKeyUsageServerAuth},
+	})
+}
+
+func TestBackend(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts []x509.Option
+	}{
+		{name: "ECDSA", opts: []x509.Option{x509.ECDSA(true)}},
+		{name: "RSA", opts: []x509.Option{x509.RSA(true)}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ca, socket, _ := startPlugin(t, tc.opts...)
+
+			issued, err := sign(t, newBackend(t, plugin.Config{Socket: socket}))
+			require.NoError(t, err)
+
+			assert.Equal(t, ca.CrtPEM, issued.CAs)
+			require.Len(t, issued.Chain, 1)
+			assert.Equal(t, ca.Crt.Raw, issued.Chain[0].Raw)
+
+			cert := issued.Certificate
+			require.NoError(t, cert.CheckSignatureFrom(ca.Crt))
+			assert.Equal(t, "worker-1", cert.Subject.CommonName)
+			assert.Equal(t, []stdx509.ExtKeyUsage{stdx509.ExtKeyUsageServerAuth}, cert.ExtKeyUsage)
+		})
+	}
+}
+
+func TestBackendIssuerNotAfter(t *testing.T) {
+	ca, socket, _ := startPlugin(t)
+
+	notAfter, err := newBackend(t, plugin.Config{Socket: socket}).IssuerNotAfter(context.Background())
+	require.NoError(t, err)
+
+	assert.Equal(t, ca.Crt.NotAfter, notAfter)
+}
+
+func TestBackendHealth(t *testing.T) {
+	_, socket, server := startPlugin(t)
+
+	backend := newBackend(t, plugin.Config{Socket: socket, Timeout: time.Second, HealthInterval: 10 * time.Millisecond})
+	require.NoError(t, backend.Check(context.Background()))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	go backend.Watch(ctx, "test plugin")
+
+	_, err := sign(t, backend)
+	require.NoError(t, err)
+
+	// once the plugin is down, requests fail fast
+	server.Stop()
+
+	require.Eventually(t, func() bool {
+		start := time.Now()
+		_, err := sign(t, backend)
+
+		return status.Code(err) == codes.Unavailable && time.Since(start) < 50*time.Millisecond
+	}, 10*time.Second, 10*time.Millisecond)
+}
+
+func TestBackendRetries(t *testing.T) {
+	backend := newBackend(t, plugin.Config{
+		Socket:  filepath.Join(t.TempDir(), "missing.sock"),
+		Timeout: 100 * time.Millisecond,
+		Retries: 2,
+	})
+
+	start := time.Now()
+
+	err := backend.Check(context.Background())
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+
+	// the first retry waits 100ms, the second 200ms
+	assert.GreaterOrEqual(t, time.Since(start), 300*time.Millisecond)
+}
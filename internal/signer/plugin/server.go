@@ -0,0 +1,84 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package plugin
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+
+	signerv1 "github.com/cozystack/standalone-trustd/api/signer/v1"
+	"github.com/cozystack/standalone-trustd/internal/pki"
+)
+
+// Server is the reference signer plugin, signing with the CA of a key
+// material store, i.e. the files trustd reads without a plugin.
+type Server struct {
+	signerv1.UnimplementedSignerServiceServer
+
+	PKI *pki.Store
+}
+
+// Register registers the signer and health services.
+func (s *Server) Register(srv *grpc.Server) {
+	signerv1.RegisterSignerServiceServer(srv, s)
+
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus(signerv1.SignerService_ServiceDesc.ServiceName, healthpb.HealthCheckResponse_SERVING)
+	healthpb.RegisterHealthServer(srv, healthServer)
+}
+
+// GetPublicChain implements signerv1.SignerServiceServer.
+func (s *Server) GetPublicChain(context.Context, *signerv1.GetPublicChainRequest) (*signerv1.GetPublicChainResponse, error) {
+	m := s.PKI.Current()
+
+	resp := &signerv1.GetPublicChainResponse{Certificates: [][]byte{m.CA.Raw}}
+
+	for _, cert := range m.Chain {
+		resp.Certificates = append(resp.Certificates, cert.Raw)
+	}
+
+	return resp, nil
+}
+
+// Sign implements signerv1.SignerServiceServer.
+func (s *Server) Sign(_ context.Context, req *signerv1.SignRequest) (*signerv1.SignResponse, error) {
+	var opts crypto.SignerOpts
+
+	switch req.Hash {
+	case signerv1.Hash_HASH_NONE:
+		opts = crypto.Hash(0)
+	case signerv1.Hash_HASH_SHA256:
+		opts = crypto.SHA256
+	case signerv1.Hash_HASH_SHA384:
+		opts = crypto.SHA384
+	case signerv1.Hash_HASH_SHA512:
+		opts = crypto.SHA512
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "unsupported hash %s", req.Hash)
+	}
+
+	if req.PssSaltLength != 0 {
+		opts = &rsa.PSSOptions{SaltLength: int(req.PssSaltLength), Hash: opts.HashFunc()}
+	}
+
+	if hash := opts.HashFunc(); hash != 0 && len(req.Digest) != hash.Size() {
+		return nil, status.Errorf(codes.InvalidArgument, "digest must be %d bytes", hash.Size())
+	}
+
+	signature, err := s.PKI.Current().CAKey.Sign(rand.Reader, req.Digest, opts)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "failed to sign: %s", err)
+	}
+
+	return &signerv1.SignResponse{Signature: signature}, nil
+}
@@ -0,0 +1,446 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package vault signs certificates with the PKI secrets engine of HashiCorp
+// Vault.
+package vault
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/tls"
+	stdx509 "crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/cozystack/standalone-trustd/internal/pki"
+	"github.com/cozystack/standalone-trustd/internal/registrator"
+)
+
+// Defaults of Config.
+const (
+	DefaultMount               = "pki"
+	DefaultKubernetesMount     = "kubernetes"
+	DefaultKubernetesTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	DefaultTimeout             = 10 * time.Second
+)
+
+// Config selects a Vault PKI role and how to authenticate to Vault.
+type Config struct {
+	// Address is the Vault URL, e.g. https://vault.example.com:8200.
+	Address string `yaml:"address"`
+	// CACert verifies the TLS certificate of Vault instead of the system
+	// roots.
+	CACert string `yaml:"caCert"`
+	// Mount is the path of the PKI secrets engine, DefaultMount if empty.
+	Mount string `yaml:"mount"`
+	// Role is the PKI role to sign with; optional with Verbatim.
+	Role string `yaml:"role"`
+	// Verbatim signs with sign-verbatim, which keeps the subject and SANs of
+	// the CSR instead of applying the role's restrictions to them.
+	Verbatim bool `yaml:"verbatim"`
+
+	// TokenFile holds a Vault token. It is read for every request, so that
+	// it can be rotated on disk.
+	TokenFile string `yaml:"tokenFile"`
+	// KubernetesRole, if set, logs in with the Kubernetes auth method
+	// instead of TokenFile.
+	KubernetesRole string `yaml:"kubernetesRole"`
+	// KubernetesMount is the path of the Kubernetes auth method,
+	// DefaultKubernetesMount if empty.
+	KubernetesMount string `yaml:"kubernetesMount"`
+	// KubernetesTokenFile holds the service account token presented to
+	// Vault, DefaultKubernetesTokenFile if empty.
+	KubernetesTokenFile string `yaml:"kubernetesTokenFile"`
+
+	// Timeout bounds each request to Vault, DefaultTimeout if zero.
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// Validate checks that the configuration is complete.
+func (c Config) Validate() error {
+	switch {
+	case c.Address == "":
+		return errors.New("Vault address is required")
+	case c.Role == "" && !c.Verbatim:
+		return errors.New("Vault role is required, unless signing verbatim")
+	case c.TokenFile == "" && c.KubernetesRole == "":
+		return errors.New("Vault token file or Kubernetes role is required")
+	case c.TokenFile != "" && c.KubernetesRole != "":
+		return errors.New("Vault token file and Kubernetes role are mutually exclusive")
+	}
+
+	return nil
+}
+
+// Backend implements registrator.Backend with a Vault PKI role.
+type Backend struct {
+	cfg    Config
+	client *http.Client
+
+	// mu guards the token obtained with Kubernetes auth
+	mu      sync.Mutex
+	token   string
+	renewAt time.Time
+}
+
+// New returns a backend for the configuration.
+func New(cfg Config) (*Backend, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	if cfg.Mount == "" {
+		cfg.Mount = DefaultMount
+	}
+
+	if cfg.KubernetesMount == "" {
+		cfg.KubernetesMount = DefaultKubernetesMount
+	}
+
+	if cfg.KubernetesTokenFile == "" {
+		cfg.KubernetesTokenFile = DefaultKubernetesTokenFile
+	}
+
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultTimeout
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if cfg.CACert != "" {
+		data, err := os.ReadFile(cfg.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read Vault CA certificate: %w", err)
+		}
+
+		roots := stdx509.NewCertPool()
+		if !roots.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.CACert)
+		}
+
+		transport.TLSClientConfig = &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12}
+	}
+
+	return &Backend{
+		cfg:    cfg,
+		client: &http.Client{Transport: transport, Timeout: cfg.Timeout},
+	}, nil
+}
+
+// signRequest is the body of the sign and sign-verbatim endpoints.
+type signRequest struct {
+	CSR    string `json:"csr"`
+	TTL    string `json:"ttl"`
+	Format string `json:"format"`
+
+	// sign
+	CommonName string `json:"common_name,omitempty"`
+	AltNames   string `json:"alt_names,omitempty"`
+	IPSANs     string `json:"ip_sans,omitempty"`
+
+	// sign-verbatim
+	KeyUsage    []string `json:"key_usage,omitempty"`
+	ExtKeyUsage []string `json:"ext_key_usage,omitempty"`
+}
+
+type signResponse struct {
+	Data struct {
+		Certificate string   `json:"certificate"`
+		IssuingCA   string   `json:"issuing_ca"`
+		CAChain     []string `json:"ca_chain"`
+	} `json:"data"`
+}
+
+// Sign implements registrator.Backend.
+//
+// The role decides about the validity window except for its end: NotBefore
+// of the template can't be passed to Vault.
+func (b *Backend) Sign(ctx context.Context, csr *stdx509.CertificateRequest, template *stdx509.Certificate) (*registrator.Issued, error) {
+	req := signRequest{
+		CSR:    string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr.Raw})),
+		TTL:    fmt.Sprintf("%ds", int64(time.Until(template.NotAfter).Seconds())),
+		Format: "pem",
+	}
+
+	path := "/v1/" + b.cfg.Mount
+
+	if b.cfg.Verbatim {
+		// the subject is signed as requested, the registrator can't drop an
+		// organization granting client auth to Talos like for its own CA
+		if len(csr.Subject.Organization) > 0 {
+			return nil, status.Errorf(codes.PermissionDenied, "CSR requests organization %v, which isn't signed verbatim", csr.Subject.Organization)
+		}
+
+		// the usages keep the certificate from being used for client auth,
+		// whatever subject the CSR requested
+		req.KeyUsage = []string{"DigitalSignature"}
+		req.ExtKeyUsage = []string{"ServerAuth"}
+
+		path += "/sign-verbatim"
+		if b.cfg.Role != "" {
+			path += "/" + b.cfg.Role
+		}
+	} else {
+		req.CommonName = template.Subject.CommonName
+		req.AltNames = strings.Join(template.DNSNames, ",")
+
+		ips := make([]string, 0, len(template.IPAddresses))
+		for _, ip := range template.IPAddresses {
+			ips = append(ips, ip.String())
+		}
+
+		req.IPSANs = strings.Join(ips, ",")
+
+		path += "/sign/" + b.cfg.Role
+	}
+
+	var resp signResponse
+
+	if err := b.withToken(ctx, func(token string) error {
+		return b.do(ctx, path, token, req, &resp)
+	}); err != nil {
+		var apiErr *apiError
+		if errors.As(err, &apiErr) && apiErr.status == http.StatusBadRequest {
+			return nil, status.Errorf(codes.PermissionDenied, "CSR rejected by Vault: %s", apiErr.message())
+		}
+
+		return nil, err
+	}
+
+	return parseSignResponse(csr, &resp)
+}
+
+// parseSignResponse checks the issued certificate and builds its chain.
+func parseSignResponse(csr *stdx509.CertificateRequest, resp *signResponse) (*registrator.Issued, error) {
+	leaf, err := parseCertificates(resp.Data.Certificate)
+	if err != nil || len(leaf) == 0 {
+		return nil, fmt.Errorf("invalid certificate returned by Vault: %v", err)
+	}
+
+	chainPEM := resp.Data.CAChain
+	if len(chainPEM) == 0 {
+		chainPEM = []string{resp.Data.IssuingCA}
+	}
+
+	chain, err := parseCertificates(chainPEM...)
+	if err != nil || len(chain) == 0 {
+		return nil, fmt.Errorf("invalid CA chain returned by Vault: %v", err)
+	}
+
+	issued := &registrator.Issued{Certificate: leaf[0], Chain: chain}
+
+	pub, ok := csr.PublicKey.(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !pub.Equal(issued.Certificate.PublicKey) {
+		return nil, errors.New("certificate returned by Vault doesn't match the CSR")
+	}
+
+	if err = issued.Certificate.CheckSignatureFrom(chain[0]); err != nil {
+		return nil, fmt.Errorf("certificate returned by Vault isn't signed by its issuing CA: %w", err)
+	}
+
+	// clients trust the roots of the chain, or its last certificate if it
+	// doesn't reach one
+	trusted := chain[len(chain)-1:]
+	if roots := roots(chain); len(roots) > 0 {
+		trusted = roots
+	}
+
+	for _, cert := range trusted {
+		issued.CAs = append(issued.CAs, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+	}
+
+	return issued, nil
+}
+
+func roots(chain []*stdx509.Certificate) []*stdx509.Certificate {
+	var roots []*stdx509.Certificate
+
+	for _, cert := range chain {
+		if pki.SelfSigned(cert) {
+			roots = append(roots, cert)
+		}
+	}
+
+	return roots
+}
+
+func parseCertificates(pemData ...string) ([]*stdx509.Certificate, error) {
+	var certs []*stdx509.Certificate
+
+	for _, data := range pemData {
+		rest := []byte(data)
+
+		for {
+			var block *pem.Block
+
+			if block, rest = pem.Decode(rest); block == nil {
+				break
+			}
+
+			cert, err := stdx509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+
+			certs = append(certs, cert)
+		}
+	}
+
+	return certs, nil
+}
+
+// withToken runs fn with a Vault token. A token from Kubernetes auth is
+// renewed by logging in again once fn is denied access.
+func (b *Backend) withToken(ctx context.Context, fn func(token string) error) error {
+	if b.cfg.KubernetesRole == "" {
+		data, err := os.ReadFile(b.cfg.TokenFile)
+		if err != nil {
+			return fmt.Errorf("failed to read Vault token: %w", err)
+		}
+
+		return fn(strings.TrimSpace(string(data)))
+	}
+
+	token, err := b.kubernetesToken(ctx, false)
+	if err != nil {
+		return err
+	}
+
+	err = fn(token)
+
+	var apiErr *apiError
+	if !errors.As(err, &apiErr) || apiErr.status != http.StatusForbidden {
+		return err
+	}
+
+	if token, err = b.kubernetesToken(ctx, true); err != nil {
+		return err
+	}
+
+	return fn(token)
+}
+
+type loginResponse struct {
+	Auth struct {
+		ClientToken   string `json:"client_token"`
+		LeaseDuration int64  `json:"lease_duration"`
+	} `json:"auth"`
+}
+
+// kubernetesToken returns the cached token, or logs in with the service
+// account token if it is due for renewal or refresh is set.
+func (b *Backend) kubernetesToken(ctx context.Context, refresh bool) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !refresh && b.token != "" && time.Now().Before(b.renewAt) {
+		return b.token, nil
+	}
+
+	jwt, err := os.ReadFile(b.cfg.KubernetesTokenFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read service account token: %w", err)
+	}
+
+	var resp loginResponse
+
+	if err = b.do(ctx, "/v1/auth/"+b.cfg.KubernetesMount+"/login", "", map[string]string{
+		"role": b.cfg.KubernetesRole,
+		"jwt":  strings.TrimSpace(string(jwt)),
+	}, &resp); err != nil {
+		return "", fmt.Errorf("Vault Kubernetes login failed: %w", err)
+	}
+
+	if resp.Auth.ClientToken == "" {
+		return "", errors.New("Vault Kubernetes login returned no token")
+	}
+
+	b.token = resp.Auth.ClientToken
+	b.renewAt = time.Now().Add(time.Duration(resp.Auth.LeaseDuration) * time.Second * 3 / 4)
+
+	// a token without lease doesn't expire
+	if resp.Auth.LeaseDuration == 0 {
+		b.renewAt = time.Now().Add(24 * time.Hour)
+	}
+
+	return b.token, nil
+}
+
+// apiError is an error response of Vault.
+type apiError struct {
+	status int
+	errors []string
+}
+
+func (e *apiError) message() string {
+	if len(e.errors) == 0 {
+		return http.StatusText(e.status)
+	}
+
+	return strings.Join(e.errors, "; ")
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("Vault returned %d: %s", e.status, e.message())
+}
+
+// do sends a JSON request to Vault and decodes the response into out.
+func (b *Backend) do(ctx context.Context, path, token string, in, out any) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(b.cfg.Address, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		apiErr := &apiError{status: resp.StatusCode}
+
+		var errResp struct {
+			Errors []string `json:"errors"`
+		}
+
+		if json.Unmarshal(data, &errResp) == nil {
+			apiErr.errors = errResp.Errors
+		}
+
+		return apiErr
+	}
+
+	return json.Unmarshal(data, out)
+}
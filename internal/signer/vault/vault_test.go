@@ -0,0 +1,404 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package vault_test
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	stdx509 "crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/cozystack/standalone-trustd/internal/signer/vault"
+)
+
+// fakeVault is an httptest stand-in for a Vault PKI secrets engine signing
+// with an intermediate CA, and a Kubernetes auth method.
+type fakeVault struct {
+	*httptest.Server
+
+	root, intermediate *stdx509.Certificate
+	key                crypto.Signer
+
+	mu sync.Mutex
+	// tokens are the accepted Vault tokens
+	tokens map[string]bool
+	// requests records the paths and bodies of sign requests
+	requests []signRequest
+	logins   int
+	// reject fails sign requests with a 400 and this message
+	reject string
+}
+
+type signRequest struct {
+	Path string
+	Body map[string]any
+}
+
+func newFakeVault(t *testing.T) *fakeVault {
+	t.Helper()
+
+	v := &fakeVault{tokens: map[string]bool{"s.static": true}}
+
+	rootKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	v.root = newCA(t, "vault-root", nil, rootKey, rootKey)
+
+	intermediateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	v.intermediate = newCA(t, "vault-intermediate", v.root, intermediateKey, rootKey)
+	v.key = intermediateKey
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/auth/kubernetes/login", v.login)
+	mux.HandleFunc("POST /v1/pki/sign/{role}", v.sign)
+	mux.HandleFunc("POST /v1/pki/sign-verbatim", v.sign)
+
+	v.Server = httptest.NewServer(mux)
+	t.Cleanup(v.Close)
+
+	return v
+}
+
+func newCA(t *testing.T, name string, parent *stdx509.Certificate, key *ecdsa.PrivateKey, parentKey crypto.Signer) *stdx509.Certificate {
+	t.Helper()
+
+	template := &stdx509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              stdx509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	if parent == nil {
+		parent = template
+	}
+
+	der, err := stdx509.CreateCertificate(rand.Reader, template, parent, key.Public(), parentKey)
+	require.NoError(t, err)
+
+	cert, err := stdx509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return cert
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string][]string{"errors": {msg}}) //nolint:errcheck
+}
+
+func (v *fakeVault) login(w http.ResponseWriter, r *http.Request) {
+	var body map[string]string
+	if json.NewDecoder(r.Body).Decode(&body) != nil || body["role"] != "trustd" || body["jwt"] != "sa-jwt" {
+		writeError(w, http.StatusBadRequest, "invalid role or JWT")
+
+		return
+	}
+
+	v.mu.Lock()
+	v.logins++
+	token := fmt.Sprintf("s.kube-%d", v.logins)
+	v.tokens[token] = true
+	v.mu.Unlock()
+
+	json.NewEncoder(w).Encode(map[string]any{ //nolint:errcheck
+		"auth": map[string]any{"client_token": token, "lease_duration": 3600},
+	})
+}
+
+func (v *fakeVault) sign(w http.ResponseWriter, r *http.Request) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if !v.tokens[r.Header.Get("X-Vault-Token")] {
+		writeError(w, http.StatusForbidden, "permission denied")
+
+		return
+	}
+
+	var body map[string]any
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+
+		return
+	}
+
+	v.requests = append(v.requests, signRequest{Path: r.URL.Path, Body: body})
+
+	if v.reject != "" {
+		writeError(w, http.StatusBadRequest, v.reject)
+
+		return
+	}
+
+	block, _ := pem.Decode([]byte(body["csr"].(string)))
+
+	csr, err := stdx509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+
+		return
+	}
+
+	ttl, err := time.ParseDuration(body["ttl"].(string))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+
+		return
+	}
+
+	der, err := stdx509.CreateCertificate(rand.Reader, &stdx509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      csr.Subject,
+		DNSNames:     csr.DNSNames,
+		IPAddresses:  csr.IPAddresses,
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(ttl),
+		KeyUsage:     stdx509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []stdx509.ExtKeyUsage{stdx509.ExtKeyUsageServerAuth},
+	}, v.intermediate, csr.PublicKey, v.key)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]any{ //nolint:errcheck
+		"data": map[string]any{
+			"certificate": encode(der),
+			"issuing_ca":  encode(v.intermediate.Raw),
+			"ca_chain":    []string{encode(v.intermediate.Raw), encode(v.root.Raw)},
+		},
+	})
+}
+
+func encode(der []byte) string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+func tokenFile(t *testing.T, token string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(path, []byte(token), 0o600))
+
+	return path
+}
+
+// newRequest returns a CSR with the organizations and the template the
+// registrator builds for it.
+func newRequest(t *testing.T, validity time.Duration, organizations ...string) (*stdx509.CertificateRequest, *stdx509.Certificate) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	der, err := stdx509.CreateCertificateRequest(rand.Reader, &stdx509.CertificateRequest{
+		Subject:     pkix.Name{CommonName: "worker-1", Organization: organizations},
+		DNSNames:    []string{"worker-1"},
+		IPAddresses: []net.IP{net.ParseIP("10.5.0.4")},
+	}, key)
+	require.NoError(t, err)
+
+	csr, err := stdx509.ParseCertificateRequest(der)
+	require.NoError(t, err)
+
+	return csr, &stdx509.Certificate{
+		Subject:     pkix.Name{CommonName: csr.Subject.CommonName},
+		DNSNames:    csr.DNSNames,
+		IPAddresses: csr.IPAddresses,
+		NotBefore:   time.Now(),
+		NotAfter:    time.Now().Add(validity),
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		cfg  vault.Config
+		ok   bool
+	}{
+		{name: "token file", cfg: vault.Config{Address: "https://vault", Role: "trustd", TokenFile: "token"}, ok: true},
+		{name: "kubernetes", cfg: vault.Config{Address: "https://vault", Role: "trustd", KubernetesRole: "trustd"}, ok: true},
+		{name: "verbatim without role", cfg: vault.Config{Address: "https://vault", Verbatim: true, TokenFile: "token"}, ok: true},
+		{name: "no address", cfg: vault.Config{Role: "trustd", TokenFile: "token"}},
+		{name: "no role", cfg: vault.Config{Address: "https://vault", TokenFile: "token"}},
+		{name: "no auth", cfg: vault.Config{Address: "https://vault", Role: "trustd"}},
+		{name: "both auths", cfg: vault.Config{Address: "https://vault", Role: "trustd", TokenFile: "token", KubernetesRole: "trustd"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.cfg.Validate()
+			if tc.ok {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestSign(t *testing.T) {
+	v := newFakeVault(t)
+
+	backend, err := vault.New(vault.Config{
+		Address:   v.URL,
+		Role:      "trustd",
+		TokenFile: tokenFile(t, "s.static\n"),
+	})
+	require.NoError(t, err)
+
+	csr, template := newRequest(t, 30*time.Minute)
+
+	issued, err := backend.Sign(context.Background(), csr, template)
+	require.NoError(t, err)
+
+	// the chain holds the intermediate, the root is returned as CA
+	assert.Equal(t, []*stdx509.Certificate{v.intermediate, v.root}, issued.Chain)
+	assert.Equal(t, encode(v.root.Raw), string(issued.CAs))
+
+	roots := stdx509.NewCertPool()
+	roots.AddCert(v.root)
+
+	intermediates := stdx509.NewCertPool()
+	intermediates.AddCert(v.intermediate)
+
+	_, err = issued.Certificate.Verify(stdx509.VerifyOptions{Roots: roots, Intermediates: intermediates})
+	require.NoError(t, err)
+
+	assert.WithinDuration(t, time.Now().Add(30*time.Minute), issued.Certificate.NotAfter, 5*time.Second)
+
+	require.Len(t, v.requests, 1)
+	assert.Equal(t, "/v1/pki/sign/trustd", v.requests[0].Path)
+	assert.Equal(t, "worker-1", v.requests[0].Body["common_name"])
+	assert.Equal(t, "worker-1", v.requests[0].Body["alt_names"])
+	assert.Equal(t, "10.5.0.4", v.requests[0].Body["ip_sans"])
+}
+
+func TestSignRejected(t *testing.T) {
+	v := newFakeVault(t)
+	v.reject = "IP SAN 10.5.0.4 not allowed by role"
+
+	backend, err := vault.New(vault.Config{
+		Address:   v.URL,
+		Role:      "trustd",
+		TokenFile: tokenFile(t, "s.static"),
+	})
+	require.NoError(t, err)
+
+	csr, template := newRequest(t, time.Hour)
+
+	_, err = backend.Sign(context.Background(), csr, template)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	assert.Contains(t, err.Error(), "not allowed by role")
+	assert.Len(t, v.requests, 1)
+}
+
+func TestSignVerbatim(t *testing.T) {
+	v := newFakeVault(t)
+
+	backend, err := vault.New(vault.Config{
+		Address:   v.URL,
+		Verbatim:  true,
+		TokenFile: tokenFile(t, "s.static"),
+	})
+	require.NoError(t, err)
+
+	csr, template := newRequest(t, time.Hour)
+
+	_, err = backend.Sign(context.Background(), csr, template)
+	require.NoError(t, err)
+
+	require.Len(t, v.requests, 1)
+	assert.Equal(t, "/v1/pki/sign-verbatim", v.requests[0].Path)
+	assert.Equal(t, []any{"ServerAuth"}, v.requests[0].Body["ext_key_usage"])
+	assert.NotContains(t, v.requests[0].Body, "common_name")
+
+	// an organization, e.g. granting client auth to Talos, isn't forwarded
+	csr, template = newRequest(t, time.Hour, "os:admin")
+
+	_, err = backend.Sign(context.Background(), csr, template)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	assert.Len(t, v.requests, 1)
+}
+
+func TestSignKubernetesAuth(t *testing.T) {
+	v := newFakeVault(t)
+
+	backend, err := vault.New(vault.Config{
+		Address:             v.URL,
+		Role:                "trustd",
+		KubernetesRole:      "trustd",
+		KubernetesTokenFile: tokenFile(t, "sa-jwt\n"),
+	})
+	require.NoError(t, err)
+
+	sign := func() {
+		t.Helper()
+
+		csr, template := newRequest(t, time.Hour)
+
+		_, err := backend.Sign(context.Background(), csr, template)
+		require.NoError(t, err)
+	}
+
+	// the token is reused
+	sign()
+	sign()
+	assert.Equal(t, 1, v.logins)
+
+	// and renewed once Vault revoked it
+	v.mu.Lock()
+	clear(v.tokens)
+	v.mu.Unlock()
+
+	sign()
+	assert.Equal(t, 2, v.logins)
+}
+
+func TestSignVaultUnavailable(t *testing.T) {
+	v := newFakeVault(t)
+	v.Close()
+
+	backend, err := vault.New(vault.Config{
+		Address:   v.URL,
+		Role:      "trustd",
+		TokenFile: tokenFile(t, "s.static"),
+	})
+	require.NoError(t, err)
+
+	// without a status, the registrator reports the error as Unavailable
+	csr, template := newRequest(t, time.Hour)
+
+	_, err = backend.Sign(context.Background(), csr, template)
+	require.Error(t, err)
+
+	_, ok := status.FromError(err)
+	assert.False(t, ok)
+}
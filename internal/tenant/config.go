@@ -0,0 +1,257 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package tenant routes requests of many clusters through a single trustd.
+package tenant
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/cozystack/standalone-trustd/internal/signer/pkcs11"
+	"github.com/cozystack/standalone-trustd/internal/signer/plugin"
+	"github.com/cozystack/standalone-trustd/internal/signer/vault"
+)
+
+var nameRE = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
+// Config is the on-disk definition of a tenant, one file per tenant named
+// after it (e.g. tenant-foo.yaml).
+//
+// Relative paths are resolved against the directory holding the file.
+type Config struct {
+	// Name is derived from the file name.
+	Name string `yaml:"-"`
+
+	// ServerNames selects the tenant by TLS SNI.
+	ServerNames []string `yaml:"serverNames"`
+	// TokenPrefix selects the tenant by a prefix of the client token, for
+	// clients connecting without a matching server name.
+	TokenPrefix string `yaml:"tokenPrefix"`
+
+	CACert string `yaml:"caCert"`
+	CAKey  string `yaml:"caKey"`
+	// CAKeyPassphrase decrypts an encrypted CAKey, like --ca-key-passphrase;
+	// a relative file: source is resolved like the paths.
+	CAKeyPassphrase string `yaml:"caKeyPassphrase"`
+	// PKCS11, if set, holds the CA key in a PKCS#11 token and replaces
+	// CAKey, like the --pkcs11-* flags.
+	PKCS11 *pkcs11.Config `yaml:"pkcs11"`
+	// Vault, if set, signs with a Vault PKI role and replaces the CA, like
+	// the --vault-* flags.
+	Vault *vault.Config `yaml:"vault"`
+	// SignerPlugin, if set, signs with an external signer plugin and
+	// replaces the CA, like the --signer-plugin* flags.
+	SignerPlugin *plugin.Config `yaml:"signerPlugin"`
+	// CAChain holds the intermediates above an intermediate CACert, like
+	// --ca-chain.
+	CAChain string `yaml:"caChain"`
+	// CADir holds a CA rotation and replaces CACert and CAKey, like --ca-dir.
+	CADir string `yaml:"caDir"`
+	// AcceptedCAs lists files and directories, like --accepted-cas.
+	AcceptedCAs      Paths `yaml:"acceptedCAs"`
+	IncludeSigningCA bool  `yaml:"includeSigningCA"`
+	// ServerCert and ServerKey are presented to clients connecting with one
+	// of ServerNames.
+	ServerCert string `yaml:"serverCert"`
+	ServerKey  string `yaml:"serverKey"`
+	// ClientCAs verifies the TLS client certificates of clients connecting
+	// with one of ServerNames, like --client-cas.
+	ClientCAs string `yaml:"clientCAs"`
+
+	// AuthMode is tokens (default) or bootstrap-token, like --auth-mode.
+	AuthMode       string `yaml:"authMode"`
+	AuthToken      string `yaml:"authToken"`
+	AuthTokensFile string `yaml:"authTokensFile"`
+	Kubeconfig     string `yaml:"kubeconfig"`
+
+	// CSRPolicy overrides --csr-policy.
+	CSRPolicy string `yaml:"csrPolicy"`
+	// Ledger is the tenant's issuance ledger database.
+	Ledger string `yaml:"ledger"`
+}
+
+// Paths is a list of paths, written as a YAML sequence or a single string.
+type Paths []string
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (p *Paths) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*p = Paths{node.Value}
+
+		return nil
+	}
+
+	return node.Decode((*[]string)(p))
+}
+
+// Load reads and validates a tenant definition.
+func Load(path string) (*Config, error) {
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	if !nameRE.MatchString(name) {
+		return nil, fmt.Errorf("invalid tenant name %q", name)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tenant %s: %w", name, err)
+	}
+
+	cfg := &Config{Name: name}
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+
+	if err = dec.Decode(cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse tenant %s: %w", name, err)
+	}
+
+	if err = cfg.validate(); err != nil {
+		return nil, fmt.Errorf("invalid tenant %s: %w", name, err)
+	}
+
+	dir := filepath.Dir(path)
+
+	paths := []*string{
+		&cfg.CACert, &cfg.CAKey, &cfg.CAChain, &cfg.CADir, &cfg.ServerCert, &cfg.ServerKey, &cfg.ClientCAs,
+		&cfg.AuthTokensFile, &cfg.Kubeconfig, &cfg.CSRPolicy, &cfg.Ledger,
+	}
+
+	if cfg.PKCS11 != nil {
+		paths = append(paths, &cfg.PKCS11.PINFile)
+	}
+
+	if cfg.Vault != nil {
+		paths = append(paths, &cfg.Vault.CACert, &cfg.Vault.TokenFile, &cfg.Vault.KubernetesTokenFile)
+	}
+
+	if cfg.SignerPlugin != nil {
+		paths = append(paths, &cfg.SignerPlugin.Socket)
+	}
+
+	for i := range cfg.AcceptedCAs {
+		paths = append(paths, &cfg.AcceptedCAs[i])
+	}
+
+	for _, p := range paths {
+		if *p != "" && !filepath.IsAbs(*p) {
+			*p = filepath.Join(dir, *p)
+		}
+	}
+
+	if path, ok := strings.CutPrefix(cfg.CAKeyPassphrase, "file:"); ok && path != "" && !filepath.IsAbs(path) {
+		cfg.CAKeyPassphrase = "file:" + filepath.Join(dir, path)
+	}
+
+	return cfg, nil
+}
+
+// LoadDir loads all tenant definitions (*.yaml, *.yml) from a directory.
+//
+// Broken definitions are reported in the returned error but don't prevent
+// loading the others.
+func LoadDir(dir string) ([]*Config, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tenants directory: %w", err)
+	}
+
+	var (
+		configs []*Config
+		errs    []error
+	)
+
+	for _, entry := range entries {
+		if entry.IsDir() || (filepath.Ext(entry.Name()) != ".yaml" && filepath.Ext(entry.Name()) != ".yml") {
+			continue
+		}
+
+		cfg, err := Load(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			errs = append(errs, err)
+
+			continue
+		}
+
+		configs = append(configs, cfg)
+	}
+
+	return configs, errors.Join(errs...)
+}
+
+func (c *Config) validate() error {
+	if len(c.ServerNames) == 0 && c.TokenPrefix == "" {
+		return errors.New("serverNames or tokenPrefix is required")
+	}
+
+	switch {
+	case c.CAKeyPassphrase != "" && c.CAKey == "":
+		return errors.New("caKeyPassphrase requires caKey")
+	case c.Vault != nil && (c.CACert != "" || c.CAKey != "" || c.CAChain != "" || c.CADir != "" || c.PKCS11 != nil):
+		return errors.New("vault replaces the CA and can't be combined with caCert, caKey, caChain, caDir and pkcs11")
+	case c.Vault != nil && c.SignerPlugin != nil:
+		return errors.New("vault and signerPlugin are mutually exclusive")
+	case c.Vault != nil:
+		if err := c.Vault.Validate(); err != nil {
+			return fmt.Errorf("vault: %w", err)
+		}
+	case c.SignerPlugin != nil && (c.CACert != "" || c.CAKey != "" || c.CAChain != "" || c.CADir != "" || c.PKCS11 != nil):
+		return errors.New("signerPlugin replaces the CA and can't be combined with caCert, caKey, caChain, caDir and pkcs11")
+	case c.SignerPlugin != nil && c.SignerPlugin.Socket == "":
+		return errors.New("signerPlugin requires a socket")
+	case c.SignerPlugin != nil:
+	case c.CADir != "" && (c.CACert != "" || c.CAKey != ""):
+		return errors.New("caDir can't be combined with caCert and caKey")
+	case c.PKCS11 != nil && (c.CAKey != "" || c.CADir != ""):
+		return errors.New("pkcs11 replaces caKey and can't be combined with caDir")
+	case c.PKCS11 != nil && c.PKCS11.Module == "":
+		return errors.New("pkcs11 requires a module")
+	case c.CADir != "" && c.CAChain != "":
+		return errors.New("caChain can't be combined with caDir")
+	case c.CADir != "":
+	case c.CACert == "" || (c.CAKey == "" && c.PKCS11 == nil):
+		return errors.New("caCert and caKey, or caDir, are required")
+	case len(c.AcceptedCAs) == 0 && !c.IncludeSigningCA:
+		return errors.New("acceptedCAs or includeSigningCA is required")
+	}
+
+	if c.TokenPrefix != "" && c.AuthToken != "" && !strings.HasPrefix(c.AuthToken, c.TokenPrefix) {
+		return errors.New("authToken must start with tokenPrefix")
+	}
+
+	if slices.Contains(c.ServerNames, "") {
+		return errors.New("empty server name")
+	}
+
+	if (c.ServerCert == "") != (c.ServerKey == "") {
+		return errors.New("serverCert and serverKey must be set together")
+	}
+
+	if len(c.ServerNames) > 0 && c.ServerCert == "" {
+		return errors.New("serverNames require serverCert and serverKey")
+	}
+
+	switch c.AuthMode {
+	case "", "tokens":
+		if c.AuthToken == "" && c.AuthTokensFile == "" {
+			return errors.New("authToken or authTokensFile is required")
+		}
+	case "bootstrap-token":
+		if c.AuthToken != "" || c.AuthTokensFile != "" {
+			return errors.New("authToken and authTokensFile can't be used with authMode bootstrap-token")
+		}
+	default:
+		return fmt.Errorf("unknown authMode %q", c.AuthMode)
+	}
+
+	return nil
+}
@@ -0,0 +1,251 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tenant
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	securityapi "github.com/siderolabs/talos/pkg/machinery/api/security"
+
+	"github.com/cozystack/standalone-trustd/internal/auth"
+	"github.com/cozystack/standalone-trustd/internal/pki"
+	"github.com/cozystack/standalone-trustd/internal/registrator"
+)
+
+// Tenant is a cluster served by trustd with its own CA, server certificate
+// and tokens.
+type Tenant struct {
+	Name        string
+	ServerNames []string
+	TokenPrefix string
+
+	// PKI holds the tenant's key material; its server certificate is
+	// presented to clients connecting with one of ServerNames.
+	PKI           *pki.Store
+	Authenticator auth.Authenticator
+	Registrator   *registrator.Registrator
+}
+
+// Set routes connections and requests to tenants.
+//
+// A request belongs to the tenant whose server names contain the TLS SNI of
+// the connection or, failing that, whose token prefix is the longest prefix
+// of the client token.
+type Set struct {
+	securityapi.UnimplementedSecurityServiceServer
+
+	// Fallback provides the server certificate for clients whose server name
+	// matches no tenant.
+	Fallback *pki.Store
+
+	mu           sync.RWMutex
+	byName       map[string]*Tenant
+	byServerName map[string]*Tenant
+	byPrefix     []*Tenant
+}
+
+// Add adds a tenant, failing if its name, server names or token prefix
+// clash with a tenant already in the set.
+func (s *Set) Add(t *Tenant) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.byName == nil {
+		s.byName = map[string]*Tenant{}
+		s.byServerName = map[string]*Tenant{}
+	}
+
+	if _, dup := s.byName[t.Name]; dup {
+		return fmt.Errorf("duplicate tenant %q", t.Name)
+	}
+
+	for _, name := range t.ServerNames {
+		if other, dup := s.byServerName[strings.ToLower(name)]; dup {
+			return fmt.Errorf("tenant %q: server name %q is already used by tenant %q", t.Name, name, other.Name)
+		}
+	}
+
+	if t.TokenPrefix != "" {
+		for _, other := range s.byPrefix {
+			if other.TokenPrefix == t.TokenPrefix {
+				return fmt.Errorf("tenant %q: token prefix %q is already used by tenant %q", t.Name, t.TokenPrefix, other.Name)
+			}
+		}
+	}
+
+	s.byName[t.Name] = t
+
+	for _, name := range t.ServerNames {
+		s.byServerName[strings.ToLower(name)] = t
+	}
+
+	if t.TokenPrefix != "" {
+		s.byPrefix = append(s.byPrefix, t)
+
+		// longest prefix first
+		slices.SortStableFunc(s.byPrefix, func(a, b *Tenant) int {
+			return len(b.TokenPrefix) - len(a.TokenPrefix)
+		})
+	}
+
+	return nil
+}
+
+// Len returns the number of tenants.
+func (s *Set) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return len(s.byName)
+}
+
+// Tenants returns the tenants ordered by name.
+func (s *Set) Tenants() []*Tenant {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	tenants := make([]*Tenant, 0, len(s.byName))
+	for _, t := range s.byName {
+		tenants = append(tenants, t)
+	}
+
+	slices.SortFunc(tenants, func(a, b *Tenant) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	return tenants
+}
+
+// Resolve finds the tenant for a request by TLS server name and token.
+func (s *Set) Resolve(serverName, token string) (*Tenant, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if t, ok := s.byServerName[strings.ToLower(serverName)]; ok {
+		return t, true
+	}
+
+	for _, t := range s.byPrefix {
+		if strings.HasPrefix(token, t.TokenPrefix) {
+			return t, true
+		}
+	}
+
+	return nil, false
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (s *Set) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	t, ok := s.byServerName[strings.ToLower(hello.ServerName)]
+	s.mu.RUnlock()
+
+	if ok {
+		if cert := t.PKI.Current().ServerCert; cert != nil {
+			return cert, nil
+		}
+	}
+
+	if s.Fallback != nil {
+		return s.Fallback.GetCertificate(hello)
+	}
+
+	return nil, fmt.Errorf("no certificate for server name %q", hello.ServerName)
+}
+
+// GetClientCAs returns the CAs verifying the TLS client certificates of a
+// connection: those of the tenant selected by SNI or, for server names of
+// no tenant, of the fallback. It returns nil if they have none.
+//
+// A tenant reached by token prefix only trusts a client certificate
+// verified by the fallback if its own client CAs vouch for it as well.
+func (s *Set) GetClientCAs(hello *tls.ClientHelloInfo) (*x509.CertPool, error) {
+	s.mu.RLock()
+	t, ok := s.byServerName[strings.ToLower(hello.ServerName)]
+	s.mu.RUnlock()
+
+	if ok {
+		return t.PKI.Current().ClientCAs, nil
+	}
+
+	if s.Fallback != nil {
+		return s.Fallback.Current().ClientCAs, nil
+	}
+
+	return nil, nil
+}
+
+// Authenticate implements auth.Authenticator by delegating to the tenant the
+// request is routed to.
+func (s *Set) Authenticate(ctx context.Context, token string, peerAddr net.Addr) (*auth.Identity, error) {
+	serverName := ServerName(ctx)
+
+	t, ok := s.Resolve(serverName, token)
+	if !ok {
+		return nil, fmt.Errorf("%w: no tenant for server name %q or token prefix", auth.ErrInvalidToken, serverName)
+	}
+
+	id, err := t.Authenticator.Authenticate(ctx, token, peerAddr)
+	if err != nil {
+		return nil, fmt.Errorf("tenant %s: %w", t.Name, err)
+	}
+
+	id.Tenant = t.Name
+
+	return id, nil
+}
+
+// Register implements the gRPC service registration.
+func (s *Set) Register(server *grpc.Server) {
+	securityapi.RegisterSecurityServiceServer(server, s)
+}
+
+// Certificate implements the securityapi.SecurityServer interface by
+// delegating to the registrator of the authenticated tenant.
+func (s *Set) Certificate(ctx context.Context, in *securityapi.CertificateRequest) (*securityapi.CertificateResponse, error) {
+	id, ok := auth.FromContext(ctx)
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "unauthenticated request")
+	}
+
+	s.mu.RLock()
+	t, ok := s.byName[id.Tenant]
+	s.mu.RUnlock()
+
+	if !ok {
+		return nil, status.Errorf(codes.Unauthenticated, "unknown tenant %q", id.Tenant)
+	}
+
+	return t.Registrator.Certificate(ctx, in)
+}
+
+// ServerName returns the TLS server name (SNI) requested by the client of a
+// gRPC call, if any.
+func ServerName(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok {
+		return ""
+	}
+
+	return info.State.ServerName
+}
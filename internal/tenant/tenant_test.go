@@ -0,0 +1,216 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tenant_test
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/siderolabs/crypto/x509"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+
+	"github.com/cozystack/standalone-trustd/internal/auth"
+	"github.com/cozystack/standalone-trustd/internal/pki"
+	"github.com/cozystack/standalone-trustd/internal/tenant"
+)
+
+func TestLoadDir(t *testing.T) {
+	dir := t.TempDir()
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "tenant-foo.yaml"), []byte(`
+serverNames: [foo.trustd.example.com]
+caCert: foo/ca.crt
+caKey: foo/ca.key
+acceptedCAs: /etc/trustd/foo/accepted.crt
+serverCert: foo/server.crt
+serverKey: foo/server.key
+authToken: foo-s3cret
+`), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "tenant-bar.yml"), []byte(`
+tokenPrefix: bar-
+caCert: bar/ca.crt
+caKey: bar/ca.key
+acceptedCAs: [bar/accepted.crt, shared]
+authMode: bootstrap-token
+`), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "broken.yaml"), []byte(`
+tokenPrefix: broken-
+caCert: ca.crt
+`), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "tenant-baz.yaml"), []byte(`
+tokenPrefix: baz-
+caCert: baz/ca.crt
+caKey: baz/ca.key
+includeSigningCA: true
+authToken: foo-s3cret
+`), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "README"), []byte("not a tenant"), 0644))
+
+	configs, err := tenant.LoadDir(dir)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "broken")
+	assert.ErrorContains(t, err, "authToken must start with tokenPrefix")
+	require.Len(t, configs, 2)
+
+	bar, foo := configs[0], configs[1]
+
+	assert.Equal(t, "tenant-bar", bar.Name)
+	assert.Equal(t, "bar-", bar.TokenPrefix)
+	assert.Equal(t, "bootstrap-token", bar.AuthMode)
+
+	assert.Equal(t, "tenant-foo", foo.Name)
+	assert.Equal(t, []string{"foo.trustd.example.com"}, foo.ServerNames)
+	assert.Equal(t, filepath.Join(dir, "foo/ca.crt"), foo.CACert)
+	assert.Equal(t, tenant.Paths{"/etc/trustd/foo/accepted.crt"}, foo.AcceptedCAs)
+	assert.Equal(t, tenant.Paths{filepath.Join(dir, "bar/accepted.crt"), filepath.Join(dir, "shared")}, bar.AcceptedCAs)
+}
+
+// newServerCert returns a store holding a self-signed server certificate.
+func newServerCert(t *testing.T) *pki.Store {
+	t.Helper()
+
+	ca, err := x509.NewSelfSignedCertificateAuthority(x509.NotAfter(time.Now().Add(time.Hour)))
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+
+	require.NoError(t, os.WriteFile(certPath, ca.CrtPEM, 0644))
+	require.NoError(t, os.WriteFile(keyPath, ca.KeyPEM, 0600))
+
+	store, err := pki.Load(pki.Files{ServerCert: certPath, ServerKey: keyPath})
+	require.NoError(t, err)
+
+	return store
+}
+
+func newTestTenant(t *testing.T, name, token string, serverNames []string, tokenPrefix string) *tenant.Tenant {
+	t.Helper()
+
+	store, err := auth.NewStore(auth.Token{Name: "default", Secret: token})
+	require.NoError(t, err)
+
+	return &tenant.Tenant{
+		Name:          name,
+		ServerNames:   serverNames,
+		TokenPrefix:   tokenPrefix,
+		PKI:           newServerCert(t),
+		Authenticator: store,
+	}
+}
+
+func sniContext(serverName string) context.Context {
+	return peer.NewContext(context.Background(), &peer.Peer{
+		Addr:     &net.TCPAddr{IP: net.ParseIP("10.5.0.4"), Port: 30000},
+		AuthInfo: credentials.TLSInfo{State: tls.ConnectionState{ServerName: serverName}},
+	})
+}
+
+func TestSet(t *testing.T) {
+	foo := newTestTenant(t, "foo", "foo-s3cret", []string{"foo.trustd.example.com"}, "foo-")
+	foobar := newTestTenant(t, "foobar", "foo-bar-s3cret", nil, "foo-bar-")
+	baz := newTestTenant(t, "baz", "baz-s3cret", []string{"baz.trustd.example.com"}, "")
+
+	fallback := newServerCert(t)
+	set := &tenant.Set{Fallback: fallback}
+
+	for _, tt := range []*tenant.Tenant{foo, foobar, baz} {
+		require.NoError(t, set.Add(tt))
+	}
+
+	assert.Error(t, set.Add(newTestTenant(t, "foo", "x", nil, "x-")))
+	assert.Error(t, set.Add(newTestTenant(t, "other", "x", []string{"FOO.trustd.example.com"}, "")))
+	assert.Error(t, set.Add(newTestTenant(t, "other", "x", nil, "foo-")))
+	assert.Equal(t, 3, set.Len())
+	assert.Equal(t, []*tenant.Tenant{baz, foo, foobar}, set.Tenants())
+
+	// server name wins over the token prefix
+	id, err := set.Authenticate(sniContext("baz.trustd.example.com"), "baz-s3cret", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "baz", id.Tenant)
+
+	_, err = set.Authenticate(sniContext("baz.trustd.example.com"), "foo-s3cret", nil)
+	assert.ErrorIs(t, err, auth.ErrInvalidToken)
+
+	// longest token prefix
+	id, err = set.Authenticate(sniContext(""), "foo-bar-s3cret", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "foobar", id.Tenant)
+
+	id, err = set.Authenticate(sniContext("unknown.example.com"), "foo-s3cret", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "foo", id.Tenant)
+
+	_, err = set.Authenticate(sniContext(""), "baz-s3cret", nil)
+	assert.ErrorIs(t, err, auth.ErrInvalidToken)
+
+	cert, err := set.GetCertificate(&tls.ClientHelloInfo{ServerName: "Foo.trustd.example.com"})
+	require.NoError(t, err)
+	assert.Same(t, foo.PKI.Current().ServerCert, cert)
+
+	cert, err = set.GetCertificate(&tls.ClientHelloInfo{})
+	require.NoError(t, err)
+	assert.Same(t, fallback.Current().ServerCert, cert)
+
+	set.Fallback = nil
+
+	_, err = set.GetCertificate(&tls.ClientHelloInfo{ServerName: "unknown.example.com"})
+	assert.Error(t, err)
+}
+
+// newClientCAs returns a store holding a self-signed client CA.
+func newClientCAs(t *testing.T) *pki.Store {
+	t.Helper()
+
+	ca, err := x509.NewSelfSignedCertificateAuthority(x509.NotAfter(time.Now().Add(time.Hour)))
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "client-cas.crt")
+	require.NoError(t, os.WriteFile(path, ca.CrtPEM, 0644))
+
+	store, err := pki.Load(pki.Files{ClientCAs: path})
+	require.NoError(t, err)
+
+	return store
+}
+
+func TestSetClientCAs(t *testing.T) {
+	foo := newTestTenant(t, "foo", "foo-s3cret", []string{"foo.trustd.example.com"}, "foo-")
+	foo.PKI = newClientCAs(t)
+	bar := newTestTenant(t, "bar", "bar-s3cret", []string{"bar.trustd.example.com"}, "")
+
+	fallback := newClientCAs(t)
+	set := &tenant.Set{Fallback: fallback}
+
+	require.NoError(t, set.Add(foo))
+	require.NoError(t, set.Add(bar))
+
+	pool, err := set.GetClientCAs(&tls.ClientHelloInfo{ServerName: "foo.trustd.example.com"})
+	require.NoError(t, err)
+	assert.Same(t, foo.PKI.Current().ClientCAs, pool)
+
+	// a tenant without client CAs doesn't use those of the fallback
+	pool, err = set.GetClientCAs(&tls.ClientHelloInfo{ServerName: "bar.trustd.example.com"})
+	require.NoError(t, err)
+	assert.Nil(t, pool)
+
+	pool, err = set.GetClientCAs(&tls.ClientHelloInfo{})
+	require.NoError(t, err)
+	assert.Same(t, fallback.Current().ClientCAs, pool)
+
+	set.Fallback = nil
+
+	pool, err = set.GetClientCAs(&tls.ClientHelloInfo{})
+	require.NoError(t, err)
+	assert.Nil(t, pool)
+}
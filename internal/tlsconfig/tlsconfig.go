@@ -6,104 +6,140 @@
 package tlsconfig
 
 import (
+	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
-	"io"
-	"os"
-)
+	"strings"
 
-// TLSConfig provides TLS configuration for the standalone trustd service.
-type TLSConfig struct {
-	caCert      []byte
-	caKey       []byte
-	serverCert  []byte
-	serverKey   []byte
-	acceptedCAs []byte
-}
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
 
-// NewTLSConfig creates a new TLS configuration from file paths.
-func NewTLSConfig(caCertPath, caKeyPath, serverCertPath, serverKeyPath, acceptedCAsPath string) (*tls.Config, error) {
-	config := &TLSConfig{}
+// ClientAuth controls whether clients present TLS certificates.
+type ClientAuth int
+
+// Client authentication modes.
+const (
+	// ClientAuthNone doesn't ask clients for a certificate.
+	ClientAuthNone ClientAuth = iota
+	// ClientAuthRequest asks clients for a certificate, which must be verified
+	// by the client CAs when one is presented.
+	ClientAuthRequest
+	// ClientAuthRequireAndVerify rejects clients without a certificate
+	// verified by the client CAs.
+	ClientAuthRequireAndVerify
+)
 
-	// Load CA certificate
-	caCert, err := os.ReadFile(caCertPath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read CA certificate: %w", err)
+// ParseClientAuth parses a client authentication mode name (none, request,
+// require-and-verify).
+func ParseClientAuth(s string) (ClientAuth, error) {
+	switch strings.ToLower(s) {
+	case "", "none":
+		return ClientAuthNone, nil
+	case "request":
+		return ClientAuthRequest, nil
+	case "require-and-verify":
+		return ClientAuthRequireAndVerify, nil
+	default:
+		return ClientAuthNone, fmt.Errorf("unknown client auth mode %q", s)
 	}
-	config.caCert = caCert
+}
 
-	// Load CA key
-	caKey, err := os.ReadFile(caKeyPath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read CA key: %w", err)
+// String implements fmt.Stringer.
+func (a ClientAuth) String() string {
+	switch a {
+	case ClientAuthNone:
+		return "none"
+	case ClientAuthRequest:
+		return "request"
+	case ClientAuthRequireAndVerify:
+		return "require-and-verify"
+	default:
+		return fmt.Sprintf("ClientAuth(%d)", int(a))
 	}
-	config.caKey = caKey
+}
 
-	// Load server certificate
-	serverCert, err := os.ReadFile(serverCertPath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read server certificate: %w", err)
+// NewServerTLSConfig creates a TLS configuration selecting the server
+// certificate per connection, e.g. by SNI.
+//
+// Unless clientAuth is ClientAuthNone, client certificates are verified
+// against the pool returned by getClientCAs for the connection, so that the
+// client CAs follow reloads and tenants. A connection without client CAs,
+// where getClientCAs returns nil, isn't asked for a certificate with
+// ClientAuthRequest and is rejected with ClientAuthRequireAndVerify.
+func NewServerTLSConfig(
+	getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error),
+	clientAuth ClientAuth,
+	getClientCAs func(*tls.ClientHelloInfo) (*x509.CertPool, error),
+) *tls.Config {
+	config := &tls.Config{
+		GetCertificate: getCertificate,
+		ClientAuth:     tls.NoClientCert,
+		MinVersion:     tls.VersionTLS12,
 	}
-	config.serverCert = serverCert
 
-	// Load server key
-	serverKey, err := os.ReadFile(serverKeyPath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read server key: %w", err)
+	switch clientAuth {
+	case ClientAuthNone:
+		return config
+	case ClientAuthRequest:
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	default:
+		config.ClientAuth = tls.RequireAndVerifyClientCert
 	}
-	config.serverKey = serverKey
 
-	// Load accepted CAs
-	acceptedCAs, err := os.ReadFile(acceptedCAsPath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read accepted CAs: %w", err)
-	}
-	config.acceptedCAs = acceptedCAs
+	config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		pool, err := getClientCAs(hello)
+		if err != nil {
+			return nil, err
+		}
 
-	return config.createTLSConfig()
-}
+		c := config.Clone()
+		c.GetConfigForClient = nil
+		c.ClientCAs = pool
 
-// createTLSConfig creates the actual TLS configuration.
-func (c *TLSConfig) createTLSConfig() (*tls.Config, error) {
-	// Parse server certificate and key
-	cert, err := tls.X509KeyPair(c.serverCert, c.serverKey)
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse server certificate and key: %w", err)
-	}
+		// a nil pool would verify against the system roots
+		if pool == nil {
+			if clientAuth == ClientAuthRequireAndVerify {
+				return nil, fmt.Errorf("no client CAs for server name %q", hello.ServerName)
+			}
+
+			c.ClientAuth = tls.NoClientCert
+		}
 
-	// Create TLS configuration
-	tlsConfig := &tls.Config{
-		Certificates: []tls.Certificate{cert},
-		// Server-only TLS: no client certificate verification
-		ClientAuth: tls.NoClientCert,
-		MinVersion: tls.VersionTLS12,
+		return c, nil
 	}
 
-	return tlsConfig, nil
+	return config
 }
 
-// GetCA returns the CA certificate.
-func (c *TLSConfig) GetCA() []byte {
-	return c.caCert
-}
+// ClientCertificate returns the verified TLS client certificate of the
+// caller of a gRPC call, or nil if it presented none or none of its verified
+// chains ends in one of trusted.
+func ClientCertificate(ctx context.Context, trusted []*x509.Certificate) *x509.Certificate {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil
+	}
 
-// GetCAKey returns the CA private key.
-func (c *TLSConfig) GetCAKey() []byte {
-	return c.caKey
-}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok {
+		return nil
+	}
 
-// GetAcceptedCAs returns the accepted CA certificates.
-func (c *TLSConfig) GetAcceptedCAs() []byte {
-	return c.acceptedCAs
-}
+	for _, chain := range info.State.VerifiedChains {
+		if len(chain) == 0 {
+			continue
+		}
+
+		root := chain[len(chain)-1]
 
-// LoadFile is a helper function to load a file.
-func LoadFile(path string) ([]byte, error) {
-	file, err := os.Open(path)
-	if err != nil {
-		return nil, err
+		for _, cert := range trusted {
+			if cert.Equal(root) {
+				return chain[0]
+			}
+		}
 	}
-	defer file.Close()
 
-	return io.ReadAll(file)
+	return nil
 }
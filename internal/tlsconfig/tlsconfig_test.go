@@ -0,0 +1,222 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tlsconfig_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+
+	"github.com/cozystack/standalone-trustd/internal/tlsconfig"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	require.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return &testCA{cert: cert, key: key}
+}
+
+func (ca *testCA) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+
+	return pool
+}
+
+func (ca *testCA) issue(t *testing.T, name string, usage x509.ExtKeyUsage) tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, key.Public(), ca.key)
+	require.NoError(t, err)
+
+	leaf, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// handshake connects a client presenting cert, if any, to a server with
+// config, and returns the connection state of the server.
+func handshake(t *testing.T, config *tls.Config, serverCA *testCA, cert *tls.Certificate) (tls.ConnectionState, error) {
+	t.Helper()
+
+	serverConn, clientConn := net.Pipe()
+
+	t.Cleanup(func() {
+		serverConn.Close()
+		clientConn.Close()
+	})
+
+	clientConfig := &tls.Config{RootCAs: serverCA.pool(), ServerName: "trustd"}
+	if cert != nil {
+		// presented even when the server doesn't list its issuer
+		clientConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return cert, nil
+		}
+	}
+
+	go func() {
+		client := tls.Client(clientConn, clientConfig)
+		if client.Handshake() == nil {
+			// completes the server side of a TLS 1.3 handshake
+			client.Read(make([]byte, 1))
+		}
+
+		clientConn.Close()
+	}()
+
+	server := tls.Server(serverConn, config)
+	err := server.Handshake()
+
+	return server.ConnectionState(), err
+}
+
+func TestClientAuth(t *testing.T) {
+	serverCA, clientCA, otherCA := newTestCA(t, "server CA"), newTestCA(t, "client CA"), newTestCA(t, "other CA")
+
+	serverCert := serverCA.issue(t, "trustd", x509.ExtKeyUsageServerAuth)
+	worker := clientCA.issue(t, "worker-1", x509.ExtKeyUsageClientAuth)
+	stranger := otherCA.issue(t, "stranger", x509.ExtKeyUsageClientAuth)
+
+	getCertificate := func(*tls.ClientHelloInfo) (*tls.Certificate, error) { return &serverCert, nil }
+	getClientCAs := func(*tls.ClientHelloInfo) (*x509.CertPool, error) { return clientCA.pool(), nil }
+
+	for _, tc := range []struct {
+		mode     tlsconfig.ClientAuth
+		cert     *tls.Certificate
+		verified string
+		fails    bool
+	}{
+		{mode: tlsconfig.ClientAuthNone},
+		{mode: tlsconfig.ClientAuthNone, cert: &worker},
+		{mode: tlsconfig.ClientAuthNone, cert: &stranger},
+		{mode: tlsconfig.ClientAuthRequest},
+		{mode: tlsconfig.ClientAuthRequest, cert: &worker, verified: "worker-1"},
+		{mode: tlsconfig.ClientAuthRequest, cert: &stranger, fails: true},
+		{mode: tlsconfig.ClientAuthRequireAndVerify, fails: true},
+		{mode: tlsconfig.ClientAuthRequireAndVerify, cert: &worker, verified: "worker-1"},
+		{mode: tlsconfig.ClientAuthRequireAndVerify, cert: &stranger, fails: true},
+	} {
+		name := tc.mode.String() + "/none"
+		if tc.cert != nil {
+			name = tc.mode.String() + "/" + tc.cert.Leaf.Subject.CommonName
+		}
+
+		t.Run(name, func(t *testing.T) {
+			config := tlsconfig.NewServerTLSConfig(getCertificate, tc.mode, getClientCAs)
+
+			state, err := handshake(t, config, serverCA, tc.cert)
+			if tc.fails {
+				assert.Error(t, err)
+
+				return
+			}
+
+			require.NoError(t, err)
+
+			ctx := peer.NewContext(context.Background(), &peer.Peer{AuthInfo: credentials.TLSInfo{State: state}})
+
+			client := tlsconfig.ClientCertificate(ctx, []*x509.Certificate{clientCA.cert})
+			if tc.verified == "" {
+				assert.Nil(t, client)
+
+				return
+			}
+
+			require.NotNil(t, client)
+			assert.Equal(t, tc.verified, client.Subject.CommonName)
+
+			// only trusted when one of the given CAs vouches for it
+			assert.Nil(t, tlsconfig.ClientCertificate(ctx, []*x509.Certificate{otherCA.cert}))
+		})
+	}
+
+	// the client CAs are looked up per connection
+	config := tlsconfig.NewServerTLSConfig(getCertificate, tlsconfig.ClientAuthRequest, func(*tls.ClientHelloInfo) (*x509.CertPool, error) {
+		return nil, errors.New("no client CAs")
+	})
+
+	_, err := handshake(t, config, serverCA, &worker)
+	assert.Error(t, err)
+
+	// without client CAs, clients aren't asked for a certificate unless one
+	// is required
+	noClientCAs := func(*tls.ClientHelloInfo) (*x509.CertPool, error) { return nil, nil }
+
+	state, err := handshake(t, tlsconfig.NewServerTLSConfig(getCertificate, tlsconfig.ClientAuthRequest, noClientCAs), serverCA, nil)
+	require.NoError(t, err)
+	assert.Empty(t, state.PeerCertificates)
+
+	state, err = handshake(t, tlsconfig.NewServerTLSConfig(getCertificate, tlsconfig.ClientAuthRequest, noClientCAs), serverCA, &stranger)
+	require.NoError(t, err)
+	assert.Empty(t, state.PeerCertificates)
+
+	_, err = handshake(t, tlsconfig.NewServerTLSConfig(getCertificate, tlsconfig.ClientAuthRequireAndVerify, noClientCAs), serverCA, &worker)
+	assert.Error(t, err)
+
+	assert.Nil(t, tlsconfig.ClientCertificate(context.Background(), []*x509.Certificate{clientCA.cert}))
+}
+
+func TestParseClientAuth(t *testing.T) {
+	for _, mode := range []tlsconfig.ClientAuth{tlsconfig.ClientAuthNone, tlsconfig.ClientAuthRequest, tlsconfig.ClientAuthRequireAndVerify} {
+		parsed, err := tlsconfig.ParseClientAuth(mode.String())
+		require.NoError(t, err)
+		assert.Equal(t, mode, parsed)
+	}
+
+	_, err := tlsconfig.ParseClientAuth("verify")
+	assert.Error(t, err)
+}
@@ -0,0 +1,59 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tracing_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace/noop"
+
+	"github.com/cozystack/standalone-trustd/internal/tracing"
+)
+
+func TestFileExporter(t *testing.T) {
+	t.Cleanup(func() { otel.SetTracerProvider(noop.NewTracerProvider()) })
+
+	file := filepath.Join(t.TempDir(), "traces.json")
+
+	shutdown, err := tracing.Setup(context.Background(), tracing.Config{Exporter: tracing.ExporterFile, File: file, SampleRatio: 1})
+	require.NoError(t, err)
+
+	// the caller's trace context is continued
+	carrier := propagation.MapCarrier{"traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}
+	ctx := otel.GetTextMapPropagator().Extract(context.Background(), carrier)
+
+	_, span := tracing.Start(ctx, "trustd.sign")
+	tracing.End(span, errors.New("signer unavailable"))
+
+	require.NoError(t, shutdown(context.Background()))
+
+	data, err := os.ReadFile(file)
+	require.NoError(t, err)
+
+	assert.Contains(t, string(data), `"Name":"trustd.sign"`)
+	assert.Contains(t, string(data), `"TraceID":"4bf92f3577b34da6a3ce929d0e0e4736"`)
+	assert.Contains(t, string(data), `"Description":"signer unavailable"`)
+	assert.Contains(t, string(data), `"Value":"standalone-trustd"`)
+}
+
+func TestSetupInvalid(t *testing.T) {
+	_, err := tracing.Setup(context.Background(), tracing.Config{Exporter: "jaeger"})
+	assert.ErrorContains(t, err, "unknown trace exporter")
+
+	_, err = tracing.Setup(context.Background(), tracing.Config{Exporter: tracing.ExporterFile})
+	assert.Error(t, err)
+
+	shutdown, err := tracing.Setup(context.Background(), tracing.Config{Exporter: tracing.ExporterOff})
+	require.NoError(t, err)
+	assert.NoError(t, shutdown(context.Background()))
+}
@@ -0,0 +1,137 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/cozystack/standalone-trustd/internal/ledger"
+	"github.com/cozystack/standalone-trustd/internal/pki"
+	"github.com/cozystack/standalone-trustd/internal/revocation"
+)
+
+// ledgerPruneInterval is how often expired ledger records are pruned.
+const ledgerPruneInterval = time.Hour
+
+// pruneLedger periodically removes records of certificates that expired more
+// than retention ago.
+func pruneLedger(ctx context.Context, l *ledger.Ledger, retention time.Duration) {
+	ticker := time.NewTicker(ledgerPruneInterval)
+	defer ticker.Stop()
+
+	for {
+		n, err := l.Prune(ctx, time.Now().Add(-retention))
+		if err != nil {
+			slog.Warn("ledger pruning failed", "error", err)
+		} else if n > 0 {
+			slog.Debug("pruned expired ledger records", "count", n)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// runExportLedger implements the export-ledger command: it writes every
+// ledger record to stdout as JSON lines.
+func runExportLedger() error {
+	if *ledgerPath == "" {
+		return fmt.Errorf("--ledger is required")
+	}
+
+	l, err := ledger.Open(*ledgerPath)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	return l.Export(context.Background(), os.Stdout)
+}
+
+// newCRL builds the CRL for certificates revoked in the ledger, signed by the
+// current CA of keyMaterial, and signs its first version.
+func newCRL(ctx context.Context, l *ledger.Ledger, keyMaterial *pki.Store) (*revocation.CRL, error) {
+	crl := &revocation.CRL{
+		Ledger:   l,
+		PKI:      keyMaterial,
+		Validity: *crlValidity,
+	}
+
+	if err := crl.Refresh(ctx); err != nil {
+		return nil, fmt.Errorf("failed to generate CRL: %w", err)
+	}
+
+	return crl, nil
+}
+
+// newOCSPResponder builds the OCSP responder, signing with the current CA of
+// keyMaterial or the delegated OCSP signing certificate.
+func newOCSPResponder(l *ledger.Ledger, keyMaterial *pki.Store) (*revocation.OCSPResponder, error) {
+	responder := &revocation.OCSPResponder{
+		Ledger:   l,
+		PKI:      keyMaterial,
+		Validity: *ocspValidity,
+	}
+
+	if *ocspSignerCert != "" || *ocspSignerKey != "" {
+		var err error
+
+		if responder.Responder, responder.Signer, err = pki.LoadCA(*ocspSignerCert, *ocspSignerKey); err != nil {
+			return nil, fmt.Errorf("failed to load OCSP signing certificate: %w", err)
+		}
+	}
+
+	if err := responder.Validate(); err != nil {
+		return nil, err
+	}
+
+	return responder, nil
+}
+
+// runRevoke implements the revoke command: it marks a certificate recorded in
+// the ledger as revoked. A running server publishes it with the next CRL refresh.
+func runRevoke() error {
+	if *ledgerPath == "" || *revokeSerial == "" {
+		return fmt.Errorf("--ledger and --serial are required")
+	}
+
+	serial, err := ledger.ParseSerial(*revokeSerial)
+	if err != nil {
+		return err
+	}
+
+	reason, err := revocation.ParseReason(*revokeReason)
+	if err != nil {
+		return err
+	}
+
+	l, err := ledger.Open(*ledgerPath)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	ctx := context.Background()
+
+	rec, err := l.Get(ctx, serial)
+	if err != nil {
+		return err
+	}
+
+	if err = l.Revoke(ctx, serial, reason, time.Now()); err != nil {
+		return err
+	}
+
+	slog.Info("revoked certificate", "serial", rec.Serial, "subject", rec.Subject, "reason", *revokeReason, "peer", rec.Peer)
+
+	return nil
+}
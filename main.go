@@ -7,29 +7,53 @@ package main
 
 import (
 	"context"
-	"crypto/subtle"
+	"crypto"
+	"crypto/tls"
+	stdx509 "crypto/x509"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
+	"net/http"
+	"os"
 	"os/signal"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
+	"github.com/siderolabs/crypto/x509"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc/filters"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/reflection"
 	"google.golang.org/grpc/status"
 
 	securityapi "github.com/siderolabs/talos/pkg/machinery/api/security"
 	"google.golang.org/protobuf/encoding/protojson"
 	"google.golang.org/protobuf/proto"
-
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"github.com/cozystack/standalone-trustd/internal/auth"
+	"github.com/cozystack/standalone-trustd/internal/ledger"
+	"github.com/cozystack/standalone-trustd/internal/logging"
+	"github.com/cozystack/standalone-trustd/internal/metrics"
+	"github.com/cozystack/standalone-trustd/internal/pki"
+	"github.com/cozystack/standalone-trustd/internal/policy"
 	"github.com/cozystack/standalone-trustd/internal/registrator"
+	"github.com/cozystack/standalone-trustd/internal/signer/pkcs11"
+	"github.com/cozystack/standalone-trustd/internal/signer/plugin"
+	"github.com/cozystack/standalone-trustd/internal/signer/vault"
 	"github.com/cozystack/standalone-trustd/internal/tlsconfig"
+	"github.com/cozystack/standalone-trustd/internal/tracing"
 )
 
 var (
@@ -38,17 +62,133 @@ var (
 	caKey       = flag.String("ca-key", "", "Path to CA private key file")
 	serverCert  = flag.String("server-cert", "", "Path to server certificate file")
 	serverKey   = flag.String("server-key", "", "Path to server private key file")
-	acceptedCAs = flag.String("accepted-cas", "", "Path to accepted CA certificates file")
+	clientAuth  = flag.String("client-auth", "none", "Whether clients present TLS certificates verified by --client-cas (none, request, require-and-verify)")
+	clientCAs   = flag.String("client-cas", "", "Path to the CA certificates verifying TLS client certificates, separate from --accepted-cas")
+	acceptedCAs = flag.String("accepted-cas", "", "Comma-separated accepted CA certificate files and directories")
 	authToken   = flag.String("auth-token", "", "Authentication token for client connections")
 	debugPort   = flag.Int("debug-port", 9983, "Debug server port")
-	verbosity   = flag.Int("v", 2, "verbosity level (0=min, 1=conn, 2=rpc, 3=payload)")
+	adminAddr   = flag.String("admin-addr", "127.0.0.1:9984", "Address of the admin server with /loglevel and pprof, which aren't authenticated (empty disables)")
+	logLevel    = flag.String("log-level", "info", "Log level (trace, debug, info, warn, error), adjustable at runtime")
+	logFormat   = flag.String("log-format", "text", "Log format (text, json)")
+
+	healthPort      = flag.Int("health-port", 0, "Port serving the gRPC health service without TLS, for Kubernetes gRPC probes (0 disables)")
+	serveReflection = flag.Bool("reflection", false, "Serve gRPC server reflection without authentication, e.g. for grpcurl")
+
+	traceExporter    = flag.String("trace-exporter", tracing.ExporterOff, "Where to export traces (off, otlp, file); otlp is configured by the OTEL_EXPORTER_OTLP_* environment variables")
+	traceFile        = flag.String("trace-file", "", "File receiving traces as JSON lines with --trace-exporter=file")
+	traceSampleRatio = flag.Float64("trace-sample-ratio", 1, "Fraction of traces sampled, unless the caller decided")
+
+	authTokensFile = flag.String("auth-tokens-file", "", "Path to a YAML file with named authentication tokens, reloaded on change")
+
+	authMode               = flag.String("auth-mode", "tokens", "How client tokens are validated (tokens, bootstrap-token)")
+	kubeconfig             = flag.String("kubeconfig", "", "Path to the kubeconfig of the cluster holding bootstrap tokens (in-cluster config if empty)")
+	bootstrapTokenCacheTTL = flag.Duration("bootstrap-token-cache-ttl", auth.DefaultBootstrapTokenCacheTTL, "How long bootstrap token lookups are cached")
+
+	reloadInterval = flag.Duration("reload-interval", time.Minute, "How often key material files are checked for changes in addition to file notifications (0 disables polling)")
+
+	tenantsDir = flag.String("tenants-dir", "", "Directory with one YAML file per tenant (enables multi-tenant mode)")
+
+	peerIPVerification = flag.String("peer-ip-verification", "off", "Verify that the caller address is among the IP SANs in the CSR (off, warn, enforce)")
+	peerIPAllowedCIDRs = flag.String("peer-ip-allowed-cidrs", "", "Comma-separated CIDRs permitted by peer IP verification as peer addresses and as requested IP SANs (VIPs, NAT ranges)")
+	csrPolicy          = flag.String("csr-policy", "", "Path to CSR policy file (YAML)")
+
+	certValidity = flag.Duration("cert-validity", x509.DefaultCertificateValidityDuration, "Validity of issued certificates")
+	certBackdate = flag.Duration("cert-backdate", 0, "Move NotBefore of issued certificates into the past to tolerate clock skew")
+	certJitter   = flag.Duration("cert-jitter", 0, "Shorten each issued certificate by a random amount up to this duration")
+	caExpiry     = flag.String("ca-expiry-policy", "clamp", "What to do when a certificate would outlive the signing CA (clamp, refuse)")
+
+	ledgerPath      = flag.String("ledger", "", "Path to the issuance ledger database (disabled if empty)")
+	ledgerRetention = flag.Duration("ledger-retention", 30*24*time.Hour, "How long to keep ledger records after the certificate expired (0 keeps them forever)")
+
+	crlEnabled  = flag.Bool("crl", false, "Publish a CRL of certificates revoked in the ledger at /crl on the debug port (requires --ledger and a CA with the cRLSign key usage)")
+	crlURL      = flag.String("crl-url", "", "CRL distribution point embedded into issued certificates (requires --crl)")
+	crlRefresh  = flag.Duration("crl-refresh", 10*time.Minute, "How often the CRL is regenerated")
+	crlValidity = flag.Duration("crl-validity", 24*time.Hour, "Time between thisUpdate and nextUpdate of the CRL")
+
+	ocspEnabled    = flag.Bool("ocsp", false, "Serve an OCSP responder at /ocsp on the debug port (requires --ledger)")
+	ocspURL        = flag.String("ocsp-url", "", "OCSP responder URL embedded into issued certificates (requires --ocsp)")
+	ocspSignerCert = flag.String("ocsp-signer-cert", "", "Path to a delegated OCSP signing certificate (defaults to the CA)")
+	ocspSignerKey  = flag.String("ocsp-signer-key", "", "Path to the delegated OCSP signing key")
+	ocspValidity   = flag.Duration("ocsp-validity", time.Hour, "Time between thisUpdate and nextUpdate of OCSP responses")
+
+	includeSigningCA = flag.Bool("accepted-cas-include-signing-ca", false, "Add the signing CA to the accepted CAs")
+	caChain          = flag.String("ca-chain", "", "Path to the intermediate certificates between an intermediate --ca-cert and the root")
+	returnChain      = flag.Bool("return-chain", true, "Return the intermediates after the issued certificate")
+
+	caKeyPassphrase = flag.String("ca-key-passphrase", "", "Source of the passphrase of an encrypted --ca-key: file:<path>, env:<name> or credential:<name> (systemd)")
+
+	pkcs11Module   = flag.String("pkcs11-module", "", "Path to a PKCS#11 library whose token holds the CA key, replaces --ca-key")
+	pkcs11Slot     = flag.Uint("pkcs11-slot", 0, "ID of the PKCS#11 slot holding the CA key")
+	pkcs11PINFile  = flag.String("pkcs11-pin-file", "", "Path to a file holding the PKCS#11 user PIN")
+	pkcs11KeyLabel = flag.String("pkcs11-key-label", "", "Label of the CA key in the PKCS#11 token (optional if it holds a single key)")
+
+	vaultAddr                = flag.String("vault-addr", "", "URL of a Vault server whose PKI secrets engine signs certificates, replaces --ca-cert and --ca-key")
+	vaultCACert              = flag.String("vault-ca-cert", "", "Path to the CA certificate verifying the TLS certificate of Vault (system roots if empty)")
+	vaultMount               = flag.String("vault-mount", vault.DefaultMount, "Path of the Vault PKI secrets engine")
+	vaultRole                = flag.String("vault-role", "", "Vault PKI role to sign with (optional with --vault-sign-verbatim)")
+	vaultSignVerbatim        = flag.Bool("vault-sign-verbatim", false, "Sign with the sign-verbatim endpoint, keeping the subject and SANs of the CSR")
+	vaultTokenFile           = flag.String("vault-token-file", "", "Path to a file holding the Vault token, re-read for every request")
+	vaultKubernetesRole      = flag.String("vault-kubernetes-role", "", "Log in to Vault with the Kubernetes auth method as this role, replaces --vault-token-file")
+	vaultKubernetesMount     = flag.String("vault-kubernetes-mount", vault.DefaultKubernetesMount, "Path of the Vault Kubernetes auth method")
+	vaultKubernetesTokenFile = flag.String("vault-kubernetes-token-file", vault.DefaultKubernetesTokenFile, "Path to the service account token presented to Vault")
+
+	signerPlugin               = flag.String("signer-plugin", "", "Path to the Unix socket of an external signer plugin, replaces --ca-cert and --ca-key (or to listen on, signer-plugin command)")
+	signerPluginTimeout        = flag.Duration("signer-plugin-timeout", plugin.DefaultTimeout, "Timeout of each call to the signer plugin")
+	signerPluginRetries        = flag.Int("signer-plugin-retries", plugin.DefaultRetries, "How often a call to an unavailable or slow signer plugin is retried")
+	signerPluginHealthInterval = flag.Duration("signer-plugin-health-interval", plugin.DefaultHealthInterval, "How often the health and chain of the signer plugin are checked")
+
+	startupCheckMode   = flag.String("startup-check", "enforce", "What to do about problems found in the key material at startup (off, warn, enforce)")
+	expiryWarning      = flag.Duration("expiry-warning", 30*24*time.Hour, "Warn about certificates expiring within this duration")
+	advertiseAddresses = flag.String("advertise-addresses", "", "Comma-separated IPs and DNS names clients use to reach trustd, checked against the server certificate SANs")
+
+	caDir       = flag.String("ca-dir", "", "Directory holding a CA rotation (current, next and previous CAs), replaces --ca-cert and --ca-key")
+	rotatePhase = flag.String("phase", "", "CA rotation phase: introduce, activate or retire (rotate-ca command)")
+	newCACert   = flag.String("new-ca-cert", "", "Path to the CA certificate to introduce (rotate-ca command)")
+	newCAKey    = flag.String("new-ca-key", "", "Path to the CA private key to introduce (rotate-ca command)")
+	crossSign   = flag.Bool("cross-sign", false, "Cross-sign the introduced CA with the current CA (rotate-ca command)")
+
+	revokeSerial = flag.String("serial", "", "Serial number of the certificate to revoke (revoke command)")
+	revokeReason = flag.String("reason", "unspecified", "RFC 5280 revocation reason, e.g. keyCompromise (revoke command)")
 )
 
 func main() {
-	flag.Parse()
+	command, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	flag.CommandLine.Parse(args) // exits on error
+
+	level, err := logging.ParseLevel(*logLevel)
+	if err == nil {
+		err = logging.Setup(os.Stderr, *logFormat, level)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid logging flags: %v\n", err)
+		os.Exit(2)
+	}
 
-	if err := run(); err != nil {
-		log.Fatal(err)
+	switch command {
+	case "serve":
+		err = run()
+	case "export-ledger":
+		err = runExportLedger()
+	case "revoke":
+		err = runRevoke()
+	case "rotate-ca":
+		err = runRotateCA()
+	case "signer-plugin":
+		err = runSignerPlugin()
+	case "check":
+		err = runCheck()
+	default:
+		err = fmt.Errorf("unknown command %q", command)
+	}
+
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
 	}
 }
 
@@ -56,39 +196,253 @@ func run() error {
 	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
 	defer cancel()
 
-	log.SetFlags(log.Lshortfile | log.Ldate | log.Lmicroseconds | log.Ltime)
+	go logging.ToggleDebugOnSignal(ctx)
+
+	shutdownTracing, err := tracing.Setup(ctx, tracing.Config{
+		Exporter:       *traceExporter,
+		File:           *traceFile,
+		SampleRatio:    *traceSampleRatio,
+		ServiceVersion: readBuildInfo().Version,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set up tracing: %w", err)
+	}
+
+	defer func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if err := shutdownTracing(shutdownCtx); err != nil {
+			slog.Warn("failed to flush traces", "error", err)
+		}
+	}()
 
 	// Validate required flags
-	if *caCert == "" || *caKey == "" {
-		return fmt.Errorf("--ca-cert and --ca-key are required")
+	if *tenantsDir != "" {
+		if err := validateTenantFlags(); err != nil {
+			return err
+		}
+	} else {
+		switch {
+		case *caKeyPassphrase != "" && *caKey == "":
+			return fmt.Errorf("--ca-key-passphrase requires --ca-key")
+		case *vaultAddr != "" && (*caCert != "" || *caKey != "" || *caChain != "" || *caDir != "" || *pkcs11Module != ""):
+			return fmt.Errorf("--vault-addr replaces the CA and can't be combined with --ca-cert, --ca-key, --ca-chain, --ca-dir and --pkcs11-module")
+		case *vaultAddr != "" && *signerPlugin != "":
+			return fmt.Errorf("--vault-addr and --signer-plugin are mutually exclusive")
+		case *vaultAddr != "":
+		case *signerPlugin != "" && (*caCert != "" || *caKey != "" || *caChain != "" || *caDir != "" || *pkcs11Module != ""):
+			return fmt.Errorf("--signer-plugin replaces the CA and can't be combined with --ca-cert, --ca-key, --ca-chain, --ca-dir and --pkcs11-module")
+		case *signerPlugin != "":
+		case *caDir != "" && (*caCert != "" || *caKey != ""):
+			return fmt.Errorf("--ca-dir can't be combined with --ca-cert and --ca-key")
+		case *pkcs11Module != "" && (*caKey != "" || *caDir != ""):
+			return fmt.Errorf("--pkcs11-module replaces --ca-key and can't be combined with --ca-dir")
+		case *caDir != "" && *caChain != "":
+			return fmt.Errorf("--ca-chain can't be combined with --ca-dir")
+		case *caDir != "":
+		case *caCert == "" || (*caKey == "" && *pkcs11Module == ""):
+			return fmt.Errorf("--ca-cert and --ca-key, or --ca-dir, are required")
+		case *acceptedCAs == "" && !*includeSigningCA:
+			return fmt.Errorf("--accepted-cas or --accepted-cas-include-signing-ca is required")
+		}
+		if *serverCert == "" || *serverKey == "" {
+			return fmt.Errorf("--server-cert and --server-key are required")
+		}
+		switch *authMode {
+		case "tokens":
+			if *authToken == "" && *authTokensFile == "" {
+				return fmt.Errorf("--auth-token or --auth-tokens-file is required")
+			}
+		case "bootstrap-token":
+			if *authToken != "" || *authTokensFile != "" {
+				return fmt.Errorf("--auth-token and --auth-tokens-file can't be used with --auth-mode=bootstrap-token")
+			}
+		default:
+			return fmt.Errorf("unknown --auth-mode %q", *authMode)
+		}
+	}
+
+	peerIPMode, err := registrator.ParsePeerIPVerification(*peerIPVerification)
+	if err != nil {
+		return fmt.Errorf("invalid --peer-ip-verification: %w", err)
+	}
+	peerIPCIDRs, err := registrator.ParseCIDRs(*peerIPAllowedCIDRs)
+	if err != nil {
+		return fmt.Errorf("invalid --peer-ip-allowed-cidrs: %w", err)
+	}
+
+	clientAuthMode, err := tlsconfig.ParseClientAuth(*clientAuth)
+	if err != nil {
+		return fmt.Errorf("invalid --client-auth: %w", err)
+	}
+	if clientAuthMode != tlsconfig.ClientAuthNone && *clientCAs == "" && *tenantsDir == "" {
+		return fmt.Errorf("--client-auth=%s requires --client-cas", clientAuthMode)
+	}
+
+	caExpiryPolicy, err := registrator.ParseCAExpiryPolicy(*caExpiry)
+	if err != nil {
+		return fmt.Errorf("invalid --ca-expiry-policy: %w", err)
 	}
-	if *serverCert == "" || *serverKey == "" {
-		return fmt.Errorf("--server-cert and --server-key are required")
+	switch *startupCheckMode {
+	case "off", "warn", "enforce":
+	default:
+		return fmt.Errorf("unknown --startup-check %q", *startupCheckMode)
 	}
-	if *acceptedCAs == "" {
-		return fmt.Errorf("--accepted-cas is required")
+	if *certValidity <= 0 || *certBackdate < 0 || *certJitter < 0 {
+		return fmt.Errorf("--cert-validity must be positive, --cert-backdate and --cert-jitter must not be negative")
 	}
-	if *authToken == "" {
-		return fmt.Errorf("--auth-token is required")
+	if *certJitter >= *certValidity {
+		return fmt.Errorf("--cert-jitter must be shorter than --cert-validity")
 	}
 
-	// Start debug server
-	go runDebugServer(ctx, *debugPort)
+	var csrPol *policy.Policy
+	if *csrPolicy != "" {
+		if csrPol, err = policy.Load(*csrPolicy); err != nil {
+			return fmt.Errorf("failed to load CSR policy: %w", err)
+		}
+	}
+	if csrPol.RequiresClientCertificate() && clientAuthMode == tlsconfig.ClientAuthNone && *tenantsDir == "" {
+		return fmt.Errorf("--csr-policy requires client certificates, which --client-auth=none doesn't ask for")
+	}
 
-	// Load TLS configuration
-	tlsConfig, err := tlsconfig.NewTLSConfig(*caCert, *caKey, *serverCert, *serverKey, *acceptedCAs)
+	caSigner, caKeyFile, closeCAKey, err := openCAKey()
 	if err != nil {
-		return fmt.Errorf("failed to create TLS configuration: %w", err)
+		return err
+	}
+	defer closeCAKey()
+
+	var backend registrator.Backend
+	if *vaultAddr != "" {
+		if backend, err = vault.New(vault.Config{
+			Address:             *vaultAddr,
+			CACert:              *vaultCACert,
+			Mount:               *vaultMount,
+			Role:                *vaultRole,
+			Verbatim:            *vaultSignVerbatim,
+			TokenFile:           *vaultTokenFile,
+			KubernetesRole:      *vaultKubernetesRole,
+			KubernetesMount:     *vaultKubernetesMount,
+			KubernetesTokenFile: *vaultKubernetesTokenFile,
+		}); err != nil {
+			return fmt.Errorf("invalid Vault configuration: %w", err)
+		}
 	}
 
-	// Create gRPC server with logging and Basic Auth interceptors
-	server := grpc.NewServer(
-		grpc.Creds(credentials.NewTLS(tlsConfig)),
-		grpc.ChainUnaryInterceptor(
-			unaryLoggingInterceptor(),
-			basicAuthInterceptor(*authToken),
-		),
-	)
+	if *signerPlugin != "" {
+		pluginBackend, err := plugin.New(plugin.Config{
+			Socket:         *signerPlugin,
+			Timeout:        *signerPluginTimeout,
+			Retries:        *signerPluginRetries,
+			HealthInterval: *signerPluginHealthInterval,
+		})
+		if err != nil {
+			return err
+		}
+		defer pluginBackend.Close()
+
+		go pluginBackend.Watch(ctx, "signer plugin")
+
+		backend = pluginBackend
+	}
+
+	var issuanceLedger *ledger.Ledger
+	if *ledgerPath != "" {
+		if issuanceLedger, err = ledger.Open(*ledgerPath); err != nil {
+			return err
+		}
+		defer issuanceLedger.Close()
+
+		if *ledgerRetention > 0 {
+			go pruneLedger(ctx, issuanceLedger, *ledgerRetention)
+		}
+	}
+
+	errChan := make(chan error, 4)
+	ready := &readiness{}
+
+	debugMux := http.NewServeMux()
+	registerDebugHandlers(debugMux, ready)
+
+	// Load key material, reloaded on change; tenants load their own
+	var keyMaterial *pki.Store
+	if *tenantsDir == "" {
+		if keyMaterial, err = pki.Load(keyMaterialFiles(caSigner, caKeyFile)); err != nil {
+			return fmt.Errorf("failed to load key material: %w", err)
+		}
+
+		if err = startupCheck("key material", keyMaterial.Current(), splitList(*advertiseAddresses)); err != nil {
+			return err
+		}
+	}
+
+	var crlDistributionPoints []string
+	switch {
+	case *crlEnabled && issuanceLedger == nil:
+		return fmt.Errorf("--crl requires --ledger")
+	case *crlEnabled && *caDir != "":
+		return fmt.Errorf("--crl can't be used with --ca-dir")
+	case *crlEnabled && backend != nil:
+		return fmt.Errorf("--crl can't be used with --vault-addr or --signer-plugin")
+	case !*crlEnabled && *crlURL != "":
+		return fmt.Errorf("--crl-url requires --crl")
+	case *crlEnabled:
+		crl, err := newCRL(ctx, issuanceLedger, keyMaterial)
+		if err != nil {
+			return err
+		}
+
+		go crl.Run(ctx, *crlRefresh)
+		debugMux.Handle("/crl", crl)
+
+		if *crlURL != "" {
+			crlDistributionPoints = []string{*crlURL}
+		}
+	}
+
+	var ocspServers []string
+	switch {
+	case *ocspEnabled && issuanceLedger == nil:
+		return fmt.Errorf("--ocsp requires --ledger")
+	case *ocspEnabled && *caDir != "":
+		return fmt.Errorf("--ocsp can't be used with --ca-dir")
+	case *ocspEnabled && backend != nil:
+		return fmt.Errorf("--ocsp can't be used with --vault-addr or --signer-plugin")
+	case !*ocspEnabled && *ocspURL != "":
+		return fmt.Errorf("--ocsp-url requires --ocsp")
+	case *ocspEnabled:
+		responder, err := newOCSPResponder(issuanceLedger, keyMaterial)
+		if err != nil {
+			return err
+		}
+
+		debugMux.Handle("/ocsp", responder)
+		debugMux.Handle("/ocsp/", http.StripPrefix("/ocsp/", responder))
+
+		if *ocspURL != "" {
+			ocspServers = []string{*ocspURL}
+		}
+	}
+
+	// Start debug server
+	debugServer, err := startHTTPServer("debug", fmt.Sprintf(":%d", *debugPort), debugMux, errChan)
+	if err != nil {
+		return err
+	}
+	defer debugServer.Close()
+
+	// Start admin server, which changes the state of the process
+	var adminServer *http.Server
+
+	if *adminAddr != "" {
+		adminMux := http.NewServeMux()
+		registerAdminHandlers(adminMux)
+
+		if adminServer, err = startHTTPServer("admin", *adminAddr, adminMux, errChan); err != nil {
+			return err
+		}
+		defer adminServer.Close()
+	}
 
 	// Create registrator
 	reg := &registrator.Registrator{
@@ -96,10 +450,86 @@ func run() error {
 		CAKey:       *caKey,
 		AcceptedCAs: *acceptedCAs,
 		AuthToken:   *authToken,
+		Backend:     backend,
+		OmitChain:   !*returnChain,
+
+		PeerIPVerification: peerIPMode,
+		PeerIPAllowedCIDRs: peerIPCIDRs,
+		Policy:             csrPol,
+		Lifetime: registrator.Lifetime{
+			Validity: *certValidity,
+			Backdate: *certBackdate,
+			Jitter:   *certJitter,
+			CAExpiry: caExpiryPolicy,
+		},
+		Ledger:                issuanceLedger,
+		CRLDistributionPoints: crlDistributionPoints,
+		OCSPServers:           ocspServers,
 	}
 
+	var (
+		tlsConfig     *tls.Config
+		authenticator auth.Authenticator
+		service       interface{ Register(*grpc.Server) }
+
+		// key material checked for the health status, by tenant
+		stores = map[string]*pki.Store{}
+	)
+
+	if *tenantsDir != "" {
+		tenants, closeTenants, err := loadTenants(ctx, reg, clientAuthMode)
+		if err != nil {
+			return err
+		}
+		defer closeTenants()
+
+		tlsConfig = tlsconfig.NewServerTLSConfig(tenants.GetCertificate, clientAuthMode, tenants.GetClientCAs)
+		authenticator, service = tenants, tenants
+
+		for _, t := range tenants.Tenants() {
+			stores[t.Name] = t.PKI
+		}
+	} else {
+		go keyMaterial.Watch(ctx, "key material", *reloadInterval)
+
+		metrics.AddKeyMaterial("", keyMaterial)
+
+		reg.PKI = keyMaterial
+		stores[""] = keyMaterial
+		tlsConfig = tlsconfig.NewServerTLSConfig(keyMaterial.GetCertificate, clientAuthMode, func(*tls.ClientHelloInfo) (*stdx509.CertPool, error) {
+			return keyMaterial.Current().ClientCAs, nil
+		})
+
+		if authenticator, err = newAuthenticator(*authMode, *authToken, *authTokensFile, *kubeconfig); err != nil {
+			return err
+		}
+
+		service = reg
+	}
+
+	ready.keyMaterial.Store(true)
+
+	server := newServer(credentials.NewTLS(tlsConfig), authenticator)
+
 	// Register services
-	reg.Register(server)
+	service.Register(server)
+
+	healthServer := health.NewServer()
+	healthpb.RegisterHealthServer(server, healthServer)
+
+	go watchHealth(ctx, healthServer, stores)
+
+	if *serveReflection {
+		reflection.Register(server)
+	}
+
+	if *healthPort != 0 {
+		probeServer, err := startHealthServer(*healthPort, healthServer, errChan)
+		if err != nil {
+			return err
+		}
+		defer probeServer.Stop()
+	}
 
 	// Start server
 	listener, err := createListener(*port)
@@ -107,37 +537,161 @@ func run() error {
 		return fmt.Errorf("failed to create listener: %w", err)
 	}
 
-	logv(0, "Starting standalone trustd on port %d", *port)
+	slog.Info("starting standalone trustd", "version", readBuildInfo().Version, "port", *port)
 
 	// Start server in goroutine
-	errChan := make(chan error, 1)
 	go func() {
 		if err := server.Serve(listener); err != nil {
 			errChan <- fmt.Errorf("server failed: %w", err)
 		}
 	}()
 
-	// Wait for context cancellation
-	<-ctx.Done()
+	ready.serving.Store(true)
 
-	// Graceful shutdown
-	logv(0, "Shutting down server...")
+	// Wait for context cancellation or a server failure
+	select {
+	case <-ctx.Done():
+	case err = <-errChan:
+	}
+
+	// Graceful shutdown, not ready anymore while connections drain
+	slog.Info("shutting down server")
+	ready.serving.Store(false)
+	healthServer.Shutdown()
 	server.GracefulStop()
 
-	// Check if server had any errors
-	select {
-	case err := <-errChan:
-		return err
-	default:
-		return nil
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelShutdown()
+
+	if shutdownErr := debugServer.Shutdown(shutdownCtx); shutdownErr != nil {
+		slog.Warn("debug server shutdown failed", "error", shutdownErr)
 	}
+
+	if adminServer != nil {
+		if shutdownErr := adminServer.Shutdown(shutdownCtx); shutdownErr != nil {
+			slog.Warn("admin server shutdown failed", "error", shutdownErr)
+		}
+	}
+
+	return err
+}
+
+// newAuthenticator builds the token store from a static token and a tokens
+// file, or the bootstrap token authenticator of the cluster in kubeconfigPath.
+func newAuthenticator(mode, token, tokensFile, kubeconfigPath string) (auth.Authenticator, error) {
+	if mode == "bootstrap-token" {
+		config, err := clientcmd.BuildConfigFromFlags("", kubeconfigPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load kubeconfig: %w", err)
+		}
+
+		client, err := kubernetes.NewForConfig(config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create Kubernetes client: %w", err)
+		}
+
+		return &auth.BootstrapTokens{Client: client, CacheTTL: *bootstrapTokenCacheTTL}, nil
+	}
+
+	var static []auth.Token
+	if token != "" {
+		static = append(static, auth.Token{Name: staticTokenName, Secret: token})
+	}
+
+	if tokensFile == "" {
+		return auth.NewStore(static...)
+	}
+
+	store, err := auth.LoadStore(tokensFile, static...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load auth tokens: %w", err)
+	}
+
+	return store, nil
+}
+
+// openCAKey opens the CA key configured by flags: a PKCS#11 key, or a key
+// file which is decrypted into memory when it has a passphrase, in which
+// case the returned key file is empty. The closer releases the PKCS#11
+// session.
+func openCAKey() (crypto.Signer, string, func(), error) {
+	var caSigner crypto.Signer
+
+	closeKey := func() {}
+
+	if *pkcs11Module != "" {
+		signer, err := pkcs11.Open(pkcs11.Config{
+			Module:   *pkcs11Module,
+			Slot:     *pkcs11Slot,
+			PINFile:  *pkcs11PINFile,
+			KeyLabel: *pkcs11KeyLabel,
+		})
+		if err != nil {
+			return nil, "", nil, fmt.Errorf("failed to open the PKCS#11 CA key: %w", err)
+		}
+
+		caSigner, closeKey = signer, func() { signer.Close() }
+	}
+
+	// an encrypted key is decrypted once and only kept in memory
+	caKeyFile := *caKey
+	if *caKeyPassphrase != "" {
+		var err error
+		if caSigner, err = decryptCAKey(*caKey, *caKeyPassphrase); err != nil {
+			closeKey()
+
+			return nil, "", nil, err
+		}
+
+		caKeyFile = ""
+	}
+
+	return caSigner, caKeyFile, closeKey, nil
 }
 
-func runDebugServer(ctx context.Context, port int) {
-	// Simple debug server implementation
-	// In a real implementation, you might want to use a proper debug server
-	logv(1, "Debug server would start on port %d", port)
-	<-ctx.Done()
+// keyMaterialFiles returns the key material configured by flags.
+func keyMaterialFiles(caSigner crypto.Signer, caKeyFile string) pki.Files {
+	return pki.Files{
+		CACert:           *caCert,
+		CAKey:            caKeyFile,
+		Signer:           caSigner,
+		CAChain:          *caChain,
+		CADir:            *caDir,
+		AcceptedCAs:      splitList(*acceptedCAs),
+		ServerCert:       *serverCert,
+		ServerKey:        *serverKey,
+		IncludeSigningCA: *includeSigningCA,
+		ClientCAs:        *clientCAs,
+	}
+}
+
+// decryptCAKey decrypts an encrypted CA key with the passphrase from source.
+func decryptCAKey(path, source string) (crypto.Signer, error) {
+	passphrase, err := pki.ReadPassphrase(source)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the CA key passphrase: %w", err)
+	}
+	defer clear(passphrase)
+
+	key, err := pki.LoadEncryptedKey(path, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt the CA key: %w", err)
+	}
+
+	return key, nil
+}
+
+// splitList splits a comma-separated flag value, dropping empty elements.
+func splitList(s string) []string {
+	var list []string
+
+	for _, field := range strings.Split(s, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			list = append(list, field)
+		}
+	}
+
+	return list
 }
 
 func createListener(port int) (net.Listener, error) {
@@ -159,7 +713,7 @@ func (l *loggingListener) Accept() (net.Conn, error) {
 	if err != nil {
 		return nil, err
 	}
-	logv(1, "accepted connection from %v", c.RemoteAddr())
+	slog.Debug("accepted connection", "peer", c.RemoteAddr())
 	return &loggingConn{Conn: c}, nil
 }
 
@@ -172,42 +726,130 @@ func (c *loggingConn) Close() error {
 	var err error
 	c.closeOnce.Do(func() {
 		err = c.Conn.Close()
-		logv(1, "closed connection from %v", c.RemoteAddr())
+		slog.Debug("closed connection", "peer", c.RemoteAddr())
 	})
 	return err
 }
 
-// basicAuthInterceptor enforces Basic auth on incoming RPC calls.
-// Username is ignored; password must equal expectedToken.
-func basicAuthInterceptor(expectedToken string) grpc.UnaryServerInterceptor {
+// newServer creates the gRPC server with logging and Basic Auth
+// interceptors, for unary and streaming RPCs alike.
+func newServer(creds credentials.TransportCredentials, authenticator auth.Authenticator) *grpc.Server {
+	return grpc.NewServer(
+		grpc.Creds(creds),
+		grpc.StatsHandler(otelgrpc.NewServerHandler(otelgrpc.WithFilter(filters.Not(filters.HealthCheck())))),
+		grpc.ChainUnaryInterceptor(
+			metrics.UnaryServerInterceptor(),
+			unaryLoggingInterceptor(),
+			basicAuthInterceptor(authenticator),
+		),
+		grpc.ChainStreamInterceptor(
+			metrics.StreamServerInterceptor(),
+			streamLoggingInterceptor(),
+			basicAuthStreamInterceptor(authenticator),
+		),
+		grpc.UnknownServiceHandler(unknownServiceHandler),
+	)
+}
+
+// staticTokenName identifies the --auth-token in logs and the ledger.
+const staticTokenName = "default"
+
+// basicAuthInterceptor enforces the credentials of methodCredentials on
+// incoming RPC calls and stores the authenticated identity in the request
+// context.
+func basicAuthInterceptor(authenticator auth.Authenticator) grpc.UnaryServerInterceptor {
 	return func(
 		ctx context.Context,
 		req interface{},
 		info *grpc.UnaryServerInfo,
 		handler grpc.UnaryHandler,
 	) (interface{}, error) {
-		p, _ := peer.FromContext(ctx)
-
-		md, ok := metadata.FromIncomingContext(ctx)
-		if !ok {
-			log.Printf("auth failed for %s from %v: missing metadata", info.FullMethod, peerAddr(p))
-			return nil, status.Error(codes.Unauthenticated, "missing metadata")
+		ctx, err := authorize(ctx, authenticator, info.FullMethod)
+		if err != nil {
+			return nil, err
 		}
 
-		// Require raw token header (Talos sends `token: <value>`)
-		tokenHeaders := md.Get("token")
-		if len(tokenHeaders) == 0 {
-			logv(2, "auth failed for %s from %v: missing token header", info.FullMethod, peerAddr(p))
-			return nil, status.Error(codes.Unauthenticated, "missing token header")
+		return handler(ctx, req)
+	}
+}
+
+// basicAuthStreamInterceptor is basicAuthInterceptor for streaming RPCs,
+// including calls to unknown services.
+func basicAuthStreamInterceptor(authenticator auth.Authenticator) grpc.StreamServerInterceptor {
+	return func(
+		srv interface{},
+		ss grpc.ServerStream,
+		info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler,
+	) error {
+		ctx, err := authorize(ss.Context(), authenticator, info.FullMethod)
+		if err != nil {
+			return err
 		}
-		providedToken := tokenHeaders[0]
-		if subtle.ConstantTimeCompare([]byte(providedToken), []byte(expectedToken)) != 1 {
-			logv(2, "auth failed for %s from %v: invalid token", info.FullMethod, peerAddr(p))
+
+		return handler(srv, &contextStream{ServerStream: ss, ctx: ctx})
+	}
+}
+
+// contextStream replaces the context of a server stream.
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+// Context implements grpc.ServerStream.
+func (s *contextStream) Context() context.Context {
+	return s.ctx
+}
+
+// authenticate checks the token of a call, returning gRPC status errors.
+func authenticate(ctx context.Context, authenticator auth.Authenticator, method string) (*auth.Identity, error) {
+	p, _ := peer.FromContext(ctx)
+	logger := slog.With("method", method, "peer", peerAddr(p))
+
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		logger.Warn("auth failed: missing metadata")
+		metrics.AuthFailures.WithLabelValues(metrics.AuthMissingMetadata).Inc()
+		return nil, status.Error(codes.Unauthenticated, "missing metadata")
+	}
+
+	// Require raw token header (Talos sends `token: <value>`)
+	tokenHeaders := md.Get("token")
+	if len(tokenHeaders) == 0 {
+		logger.Warn("auth failed: missing token header")
+		metrics.AuthFailures.WithLabelValues(metrics.AuthMissingToken).Inc()
+		return nil, status.Error(codes.Unauthenticated, "missing token header")
+	}
+
+	var addr net.Addr
+	if p != nil {
+		addr = p.Addr
+	}
+
+	id, err := authenticator.Authenticate(ctx, tokenHeaders[0], addr)
+	if err != nil {
+		switch {
+		case errors.Is(err, auth.ErrTokenExpired):
+			logger.Warn("auth failed: token expired", "error", err)
+			metrics.AuthFailures.WithLabelValues(metrics.AuthTokenExpired).Inc()
+			return nil, status.Error(codes.Unauthenticated, "token expired")
+		case errors.Is(err, auth.ErrSourceNotAllowed):
+			logger.Warn("auth failed: token not allowed from this address", "error", err)
+			metrics.AuthFailures.WithLabelValues(metrics.AuthSourceNotAllowed).Inc()
+			return nil, status.Error(codes.PermissionDenied, "token not allowed from this address")
+		case errors.Is(err, auth.ErrInvalidToken):
+			logger.Warn("auth failed: invalid token", "error", err)
+			metrics.AuthFailures.WithLabelValues(metrics.AuthInvalidToken).Inc()
 			return nil, status.Error(codes.Unauthenticated, "invalid token")
+		default:
+			logger.Error("auth failed: failed to validate token", "error", err)
+			metrics.AuthFailures.WithLabelValues(metrics.AuthError).Inc()
+			return nil, status.Error(codes.Unavailable, "failed to validate token")
 		}
-
-		return handler(ctx, req)
 	}
+
+	return id, nil
 }
 
 // unaryLoggingInterceptor logs incoming requests, their outcome and latency.
@@ -219,58 +861,102 @@ func unaryLoggingInterceptor() grpc.UnaryServerInterceptor {
 		handler grpc.UnaryHandler,
 	) (interface{}, error) {
 		start := time.Now()
-		p, _ := peer.FromContext(ctx)
-
-		// Log incoming metadata (with redaction)
-		if md, ok := metadata.FromIncomingContext(ctx); ok {
-			if *verbosity >= 2 {
-				log.Printf("rpc %s from %v headers: %v", info.FullMethod, peerAddr(p), md)
-			}
-		}
+		logger := rpcLogger(ctx, info.FullMethod)
 
 		// Log request payload
-		if pm, ok := req.(proto.Message); ok {
-			if *verbosity >= 3 {
-				b, _ := (protojson.MarshalOptions{Multiline: true, Indent: "  ", EmitUnpopulated: true}).Marshal(pm)
-				log.Printf("rpc %s request json:\n%s", info.FullMethod, string(b))
-			}
-		}
-		if r, ok := req.(*securityapi.CertificateRequest); ok {
-			if *verbosity >= 3 {
-				log.Printf("rpc %s request.csr (len=%d):\n%s", info.FullMethod, len(r.Csr), string(r.Csr))
-			}
+		if logger.Enabled(ctx, logging.LevelTrace) {
+			logger.Log(ctx, logging.LevelTrace, "rpc request", payloadAttrs(req)...)
 		}
 
 		resp, err := handler(ctx, req)
-		duration := time.Since(start)
-		code := status.Code(err)
 
 		// Log response payload
-		if resp != nil {
-			if pm, ok := resp.(proto.Message); ok {
-				if *verbosity >= 3 {
-					b, _ := (protojson.MarshalOptions{Multiline: true, Indent: "  ", EmitUnpopulated: true}).Marshal(pm)
-					log.Printf("rpc %s response json:\n%s", info.FullMethod, string(b))
-				}
-			}
-			if r, ok := resp.(*securityapi.CertificateResponse); ok {
-				if *verbosity >= 3 {
-					log.Printf("rpc %s response.ca (len=%d):\n%s", info.FullMethod, len(r.Ca), string(r.Ca))
-					log.Printf("rpc %s response.crt (len=%d):\n%s", info.FullMethod, len(r.Crt), string(r.Crt))
-				}
-			}
+		if resp != nil && logger.Enabled(ctx, logging.LevelTrace) {
+			logger.Log(ctx, logging.LevelTrace, "rpc response", payloadAttrs(resp)...)
 		}
 
-		if err != nil {
-			logv(2, "rpc %s from %v -> %s (%s): %v", info.FullMethod, peerAddr(p), code, duration, err)
-		} else {
-			logv(2, "rpc %s from %v -> %s (%s)", info.FullMethod, peerAddr(p), code, duration)
-		}
+		logRPC(ctx, logger, info.FullMethod, start, err)
 
 		return resp, err
 	}
 }
 
+// streamLoggingInterceptor is unaryLoggingInterceptor for streaming RPCs,
+// logging every message received and sent.
+func streamLoggingInterceptor() grpc.StreamServerInterceptor {
+	return func(
+		srv interface{},
+		ss grpc.ServerStream,
+		info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler,
+	) error {
+		start := time.Now()
+		logger := rpcLogger(ss.Context(), info.FullMethod)
+
+		err := handler(srv, &loggingStream{ServerStream: ss, logger: logger})
+
+		logRPC(ss.Context(), logger, info.FullMethod, start, err)
+
+		return err
+	}
+}
+
+// rpcLogger returns the logger of a call, logging its incoming metadata.
+func rpcLogger(ctx context.Context, method string) *slog.Logger {
+	p, _ := peer.FromContext(ctx)
+	logger := slog.With("method", method, "peer", peerAddr(p))
+
+	// Log incoming metadata, secrets are redacted by the handler
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		logger.Debug("rpc headers", "metadata", md)
+	}
+
+	return logger
+}
+
+// logRPC logs the outcome and latency of a call.
+func logRPC(ctx context.Context, logger *slog.Logger, method string, start time.Time, err error) {
+	duration := time.Since(start)
+	code := status.Code(err)
+
+	// probes would drown the other requests
+	level := slog.LevelInfo
+	if isHealthCheck(method) {
+		level = slog.LevelDebug
+	}
+
+	if err != nil {
+		logger.Log(ctx, level, "rpc", "code", code.String(), "duration", duration, "error", err)
+	} else {
+		logger.Log(ctx, level, "rpc", "code", code.String(), "duration", duration)
+	}
+}
+
+// loggingStream logs the payloads of a streaming RPC.
+type loggingStream struct {
+	grpc.ServerStream
+	logger *slog.Logger
+}
+
+// RecvMsg implements grpc.ServerStream.
+func (s *loggingStream) RecvMsg(m any) error {
+	err := s.ServerStream.RecvMsg(m)
+	if err == nil && s.logger.Enabled(s.Context(), logging.LevelTrace) {
+		s.logger.Log(s.Context(), logging.LevelTrace, "rpc request", payloadAttrs(m)...)
+	}
+
+	return err
+}
+
+// SendMsg implements grpc.ServerStream.
+func (s *loggingStream) SendMsg(m any) error {
+	if s.logger.Enabled(s.Context(), logging.LevelTrace) {
+		s.logger.Log(s.Context(), logging.LevelTrace, "rpc response", payloadAttrs(m)...)
+	}
+
+	return s.ServerStream.SendMsg(m)
+}
+
 // peerAddr formats peer address safely for logging.
 func peerAddr(p *peer.Peer) interface{} {
 	if p == nil || p.Addr == nil {
@@ -279,9 +965,23 @@ func peerAddr(p *peer.Peer) interface{} {
 	return p.Addr
 }
 
-// logv prints a log line if the current verbosity is >= level.
-func logv(level int, format string, args ...interface{}) {
-	if verbosity != nil && *verbosity >= level {
-		log.Printf(format, args...)
+// payloadAttrs returns the attributes logging a request or response
+// payload: its JSON form, and the PEM data of certificate requests and
+// responses.
+func payloadAttrs(msg any) []any {
+	var attrs []any
+
+	if pm, ok := msg.(proto.Message); ok {
+		b, _ := protojson.Marshal(pm)
+		attrs = append(attrs, "payload", string(b))
 	}
+
+	switch m := msg.(type) {
+	case *securityapi.CertificateRequest:
+		attrs = append(attrs, "csr", string(m.Csr))
+	case *securityapi.CertificateResponse:
+		attrs = append(attrs, "ca", string(m.Ca), "crt", string(m.Crt))
+	}
+
+	return attrs
 }
@@ -0,0 +1,170 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
+	reflectionv1 "google.golang.org/grpc/reflection/grpc_reflection_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	"github.com/cozystack/standalone-trustd/internal/auth"
+	"github.com/cozystack/standalone-trustd/internal/metrics"
+)
+
+// watchMethod is a token-protected server streaming method served by the
+// test server.
+const watchMethod = "/trustd.test.TestService/Watch"
+
+var testServiceDesc = grpc.ServiceDesc{
+	ServiceName: "trustd.test.TestService",
+	HandlerType: (*any)(nil),
+	Streams: []grpc.StreamDesc{{
+		StreamName:    "Watch",
+		ServerStreams: true,
+		Handler: func(_ any, stream grpc.ServerStream) error {
+			return stream.SendMsg(&emptypb.Empty{})
+		},
+	}},
+}
+
+// startServer serves the gRPC server of trustd, with health, reflection and
+// the test service, on an in-memory listener.
+func startServer(t *testing.T) *grpc.ClientConn {
+	t.Helper()
+
+	methodCredentials[watchMethod] = credentialToken
+
+	t.Cleanup(func() { delete(methodCredentials, watchMethod) })
+
+	authenticator, err := auth.NewStore(auth.Token{Name: staticTokenName, Secret: "s3cret"})
+	require.NoError(t, err)
+
+	server := newServer(insecure.NewCredentials(), authenticator)
+	server.RegisterService(&testServiceDesc, struct{}{})
+	healthpb.RegisterHealthServer(server, health.NewServer())
+	reflection.Register(server)
+
+	listener := bufconn.Listen(1 << 20)
+
+	go server.Serve(listener) //nolint:errcheck
+
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+
+	t.Cleanup(func() { conn.Close() })
+
+	return conn
+}
+
+// watch calls the streaming test method and returns the error of its first
+// response.
+func watch(ctx context.Context, conn *grpc.ClientConn) error {
+	stream, err := conn.NewStream(ctx, &grpc.StreamDesc{ServerStreams: true}, watchMethod)
+	if err != nil {
+		return err
+	}
+
+	if err = stream.SendMsg(&emptypb.Empty{}); err != nil {
+		return err
+	}
+
+	if err = stream.CloseSend(); err != nil {
+		return err
+	}
+
+	return stream.RecvMsg(&emptypb.Empty{})
+}
+
+func TestServerStreamingAuth(t *testing.T) {
+	conn := startServer(t)
+	ctx := context.Background()
+
+	assert.Equal(t, codes.Unauthenticated, status.Code(watch(ctx, conn)))
+	assert.Equal(t, codes.Unauthenticated, status.Code(watch(metadata.AppendToOutgoingContext(ctx, "token", "wrong"), conn)))
+	assert.NoError(t, watch(metadata.AppendToOutgoingContext(ctx, "token", "s3cret"), conn))
+}
+
+func TestServerUnauthenticatedServices(t *testing.T) {
+	conn := startServer(t)
+	ctx := context.Background()
+
+	resp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, resp.Status)
+
+	stream, err := reflectionv1.NewServerReflectionClient(conn).ServerReflectionInfo(ctx)
+	require.NoError(t, err)
+
+	require.NoError(t, stream.Send(&reflectionv1.ServerReflectionRequest{
+		MessageRequest: &reflectionv1.ServerReflectionRequest_ListServices{},
+	}))
+
+	reflectionResp, err := stream.Recv()
+	require.NoError(t, err)
+	assert.NotEmpty(t, reflectionResp.GetListServicesResponse().GetService())
+}
+
+func TestServerUnknownMethod(t *testing.T) {
+	conn := startServer(t)
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "token", "s3cret")
+
+	unknown := metrics.AuthFailures.WithLabelValues(metrics.AuthUnknownMethod)
+	before := testutil.ToFloat64(unknown)
+
+	// Talos services other than trustd aren't served, even with a valid token
+	err := conn.Invoke(ctx, "/machine.MachineService/Version", &emptypb.Empty{}, &emptypb.Empty{})
+	assert.Equal(t, codes.Unimplemented, status.Code(err))
+
+	err = conn.Invoke(ctx, "/machine.MachineService/Reboot", &emptypb.Empty{}, &emptypb.Empty{})
+	assert.Equal(t, codes.Unimplemented, status.Code(err))
+
+	assert.Equal(t, before+2, testutil.ToFloat64(unknown))
+}
+
+func TestDebugHandlers(t *testing.T) {
+	debugMux, adminMux := http.NewServeMux(), http.NewServeMux()
+	registerDebugHandlers(debugMux, &readiness{})
+	registerAdminHandlers(adminMux)
+
+	get := func(mux *http.ServeMux, method, path string) int {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+
+		return rec.Code
+	}
+
+	// the debug port only serves read-only endpoints
+	assert.Equal(t, http.StatusOK, get(debugMux, http.MethodGet, "/healthz"))
+	assert.Equal(t, http.StatusNotFound, get(debugMux, http.MethodPut, "/loglevel?level=trace"))
+	assert.Equal(t, http.StatusNotFound, get(debugMux, http.MethodGet, "/debug/pprof/"))
+
+	assert.Equal(t, http.StatusOK, get(adminMux, http.MethodGet, "/loglevel"))
+	assert.Equal(t, http.StatusOK, get(adminMux, http.MethodGet, "/debug/pprof/"))
+	assert.Equal(t, http.StatusNotFound, get(adminMux, http.MethodGet, "/debug/pprof/cmdline"))
+}
@@ -0,0 +1,100 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"log/slog"
+
+	securityapi "github.com/siderolabs/talos/pkg/machinery/api/security"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/peer"
+	reflectionv1 "google.golang.org/grpc/reflection/grpc_reflection_v1"
+	reflectionv1alpha "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/grpc/status"
+
+	"github.com/cozystack/standalone-trustd/internal/auth"
+	"github.com/cozystack/standalone-trustd/internal/metrics"
+	"github.com/cozystack/standalone-trustd/internal/tracing"
+)
+
+// credential is what a method requires from callers.
+type credential int
+
+const (
+	// credentialDenied rejects every call, for methods missing from
+	// methodCredentials.
+	credentialDenied credential = iota
+	// credentialNone admits anyone reaching the port.
+	credentialNone
+	// credentialToken requires a valid token.
+	credentialToken
+)
+
+// methodCredentials is the allowlist of the methods served on the gRPC
+// port. A service registered on the server must be added here, calls to
+// any other method are rejected as unknown.
+var methodCredentials = map[string]credential{
+	securityapi.SecurityService_Certificate_FullMethodName: credentialToken,
+
+	// probes
+	healthpb.Health_Check_FullMethodName: credentialNone,
+	healthpb.Health_List_FullMethodName:  credentialNone,
+	healthpb.Health_Watch_FullMethodName: credentialNone,
+
+	// only describes the API, and only served with --reflection
+	reflectionv1.ServerReflection_ServerReflectionInfo_FullMethodName:      credentialNone,
+	reflectionv1alpha.ServerReflection_ServerReflectionInfo_FullMethodName: credentialNone,
+}
+
+// authorize checks that a call satisfies the credentials of its method. It
+// returns the context of the call, holding the identity of the caller when
+// the method requires a token.
+func authorize(ctx context.Context, authenticator auth.Authenticator, method string) (context.Context, error) {
+	switch methodCredentials[method] {
+	case credentialNone:
+		return ctx, nil
+	case credentialToken:
+	default:
+		return nil, rejectMethod(ctx, method)
+	}
+
+	spanCtx, span := tracing.Start(ctx, "trustd.authenticate")
+
+	id, err := authenticate(spanCtx, authenticator, method)
+	if err == nil {
+		span.SetAttributes(attribute.String("trustd.token_name", id.TokenName))
+	}
+
+	tracing.End(span, err)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return auth.NewContext(ctx, id), nil
+}
+
+// rejectMethod logs and rejects a call to a method outside the allowlist,
+// typically a scanner probing for other Talos services.
+func rejectMethod(ctx context.Context, method string) error {
+	p, _ := peer.FromContext(ctx)
+
+	slog.Warn("rejected call to unknown method", "method", method, "peer", peerAddr(p))
+	metrics.AuthFailures.WithLabelValues(metrics.AuthUnknownMethod).Inc()
+
+	return status.Errorf(codes.Unimplemented, "unknown method %s", method)
+}
+
+// unknownServiceHandler handles calls to services which aren't registered,
+// e.g. machine.MachineService.
+func unknownServiceHandler(_ any, stream grpc.ServerStream) error {
+	method, _ := grpc.MethodFromServerStream(stream)
+
+	return rejectMethod(stream.Context(), method)
+}
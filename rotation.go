@@ -0,0 +1,65 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/cozystack/standalone-trustd/internal/pki"
+)
+
+// runRotateCA implements the rotate-ca command: it moves the CA rotation in
+// --ca-dir to the next phase. A running server picks up the change like any
+// other update of its key material.
+func runRotateCA() error {
+	if *caDir == "" {
+		return fmt.Errorf("--ca-dir is required")
+	}
+
+	switch *rotatePhase {
+	case "introduce":
+		if *newCACert == "" || *newCAKey == "" {
+			return fmt.Errorf("--new-ca-cert and --new-ca-key are required to introduce a CA")
+		}
+
+		certPEM, err := os.ReadFile(*newCACert)
+		if err != nil {
+			return err
+		}
+
+		keyPEM, err := os.ReadFile(*newCAKey)
+		if err != nil {
+			return err
+		}
+
+		if err = pki.Introduce(*caDir, certPEM, keyPEM, *crossSign); err != nil {
+			return fmt.Errorf("failed to introduce CA: %w", err)
+		}
+
+		slog.Info("introduced the next CA, activate it once all workers trust it", "ca", *newCACert, "cross_signed", *crossSign)
+	case "activate":
+		if pki.ActivationPending(*caDir) {
+			slog.Warn("resuming an interrupted activation", "ca_dir", *caDir)
+		}
+
+		if err := pki.Activate(*caDir); err != nil {
+			return fmt.Errorf("failed to activate CA: %w", err)
+		}
+
+		slog.Info("activated the next CA, the previous CA stays trusted until retired")
+	case "retire":
+		if err := pki.Retire(*caDir); err != nil {
+			return fmt.Errorf("failed to retire CA: %w", err)
+		}
+
+		slog.Info("retired the previous CA")
+	default:
+		return fmt.Errorf("--phase must be one of introduce, activate, retire")
+	}
+
+	return nil
+}
@@ -0,0 +1,91 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"google.golang.org/grpc"
+
+	"github.com/cozystack/standalone-trustd/internal/pki"
+	"github.com/cozystack/standalone-trustd/internal/signer/plugin"
+)
+
+// runSignerPlugin implements the signer-plugin command: it serves the CA
+// from --ca-cert and --ca-key (or --ca-dir) over the signer protocol on
+// --signer-plugin, as a reference plugin and a way to keep the CA key out of
+// the trustd process.
+func runSignerPlugin() error {
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer cancel()
+
+	switch {
+	case *signerPlugin == "":
+		return fmt.Errorf("--signer-plugin is required")
+	case *caDir == "" && (*caCert == "" || *caKey == ""):
+		return fmt.Errorf("--ca-cert and --ca-key, or --ca-dir, are required")
+	case *caKeyPassphrase != "" && *caKey == "":
+		return fmt.Errorf("--ca-key-passphrase requires --ca-key")
+	}
+
+	caKeyFile := *caKey
+
+	var caSigner crypto.Signer
+
+	if *caKeyPassphrase != "" {
+		var err error
+
+		if caSigner, err = decryptCAKey(*caKey, *caKeyPassphrase); err != nil {
+			return err
+		}
+
+		caKeyFile = ""
+	}
+
+	keyMaterial, err := pki.Load(pki.Files{
+		CACert:  *caCert,
+		CAKey:   caKeyFile,
+		Signer:  caSigner,
+		CAChain: *caChain,
+		CADir:   *caDir,
+		// nothing is accepted, but a CA requires accepted CAs
+		IncludeSigningCA: true,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to load key material: %w", err)
+	}
+
+	go keyMaterial.Watch(ctx, "key material", *reloadInterval)
+
+	// remove the socket of a previous run
+	if err = os.Remove(*signerPlugin); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	listener, err := net.Listen("unix", *signerPlugin)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", *signerPlugin, err)
+	}
+
+	server := grpc.NewServer()
+	(&plugin.Server{PKI: keyMaterial}).Register(server)
+
+	go func() {
+		<-ctx.Done()
+		server.GracefulStop()
+	}()
+
+	slog.Info("serving signer plugin", "socket", *signerPlugin)
+
+	return server.Serve(listener)
+}
@@ -0,0 +1,325 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+
+	"github.com/cozystack/standalone-trustd/internal/auth"
+	"github.com/cozystack/standalone-trustd/internal/ledger"
+	"github.com/cozystack/standalone-trustd/internal/metrics"
+	"github.com/cozystack/standalone-trustd/internal/pki"
+	"github.com/cozystack/standalone-trustd/internal/policy"
+	"github.com/cozystack/standalone-trustd/internal/registrator"
+	"github.com/cozystack/standalone-trustd/internal/signer/pkcs11"
+	"github.com/cozystack/standalone-trustd/internal/signer/plugin"
+	"github.com/cozystack/standalone-trustd/internal/signer/vault"
+	"github.com/cozystack/standalone-trustd/internal/tenant"
+	"github.com/cozystack/standalone-trustd/internal/tlsconfig"
+)
+
+// tenantExclusiveFlags are configured per tenant in multi-tenant mode.
+var tenantExclusiveFlags = []string{
+	"ca-cert", "ca-key", "ca-key-passphrase", "ca-chain", "ca-dir", "pkcs11-module", "pkcs11-slot", "pkcs11-pin-file", "pkcs11-key-label",
+	"vault-addr", "vault-ca-cert", "vault-mount", "vault-role", "vault-sign-verbatim", "vault-token-file", "vault-kubernetes-role", "vault-kubernetes-mount", "vault-kubernetes-token-file",
+	"signer-plugin", "signer-plugin-timeout", "signer-plugin-retries", "signer-plugin-health-interval",
+	"accepted-cas", "accepted-cas-include-signing-ca", "auth-token", "auth-tokens-file", "auth-mode", "kubeconfig",
+	"ledger", "crl", "crl-url", "ocsp", "ocsp-url", "ocsp-signer-cert", "ocsp-signer-key",
+}
+
+// validateTenantFlags rejects flags which have no meaning with --tenants-dir.
+func validateTenantFlags() error {
+	var err error
+
+	flag.Visit(func(f *flag.Flag) {
+		for _, name := range tenantExclusiveFlags {
+			if f.Name == name && err == nil {
+				err = fmt.Errorf("--%s can't be used with --tenants-dir, configure it per tenant", name)
+			}
+		}
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if (*serverCert == "") != (*serverKey == "") {
+		return fmt.Errorf("--server-cert and --server-key must be set together")
+	}
+
+	return nil
+}
+
+// loadTenants builds the tenants defined in --tenants-dir on top of the
+// settings shared by all tenants in base, for clients authenticated with
+// clientAuth.
+//
+// A tenant with a broken definition or broken material is logged and
+// skipped, so that it doesn't take the other tenants down.
+func loadTenants(ctx context.Context, base *registrator.Registrator, clientAuth tlsconfig.ClientAuth) (*tenant.Set, func(), error) {
+	set := &tenant.Set{}
+
+	if *serverCert != "" || *clientCAs != "" {
+		fallback, err := pki.Load(pki.Files{ServerCert: *serverCert, ServerKey: *serverKey, ClientCAs: *clientCAs})
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to load server certificate: %w", err)
+		}
+
+		if err = startupCheck("fallback server certificate", fallback.Current(), splitList(*advertiseAddresses)); err != nil {
+			return nil, nil, err
+		}
+
+		go fallback.Watch(ctx, "fallback server certificate", *reloadInterval)
+
+		metrics.AddKeyMaterial("", fallback)
+
+		set.Fallback = fallback
+	}
+
+	configs, err := tenant.LoadDir(*tenantsDir)
+	if err != nil {
+		if configs == nil {
+			return nil, nil, err
+		}
+
+		slog.Warn("skipping broken tenants", "error", err)
+	}
+
+	var closers []func() error
+
+	closeAll := func() {
+		for _, c := range closers {
+			c()
+		}
+	}
+
+	for _, cfg := range configs {
+		t, closer, err := newTenant(cfg, base, clientAuth)
+		if err == nil {
+			err = set.Add(t)
+			if err != nil {
+				closer()
+			}
+		}
+
+		if err != nil {
+			slog.Warn("skipping tenant", "tenant", cfg.Name, "error", err)
+
+			continue
+		}
+
+		closers = append(closers, closer)
+
+		go t.PKI.Watch(ctx, "tenant "+t.Name, *reloadInterval)
+
+		metrics.AddKeyMaterial(t.Name, t.PKI)
+
+		if backend, ok := t.Registrator.Backend.(*plugin.Backend); ok {
+			go backend.Watch(ctx, "tenant "+t.Name)
+		}
+
+		if t.Registrator.Ledger != nil && *ledgerRetention > 0 {
+			go pruneLedger(ctx, t.Registrator.Ledger, *ledgerRetention)
+		}
+
+		slog.Info("loaded tenant", "tenant", t.Name, "server_names", t.ServerNames, "token_prefix", t.TokenPrefix)
+	}
+
+	if set.Len() == 0 {
+		closeAll()
+
+		return nil, nil, fmt.Errorf("no usable tenants in %s", *tenantsDir)
+	}
+
+	return set, closeAll, nil
+}
+
+// newTenant builds a tenant from its definition. The returned closer
+// releases the tenant's PKCS#11 session, signer plugin connection and ledger.
+func newTenant(cfg *tenant.Config, base *registrator.Registrator, clientAuth tlsconfig.ClientAuth) (_ *tenant.Tenant, _ func() error, err error) {
+	var closers []func() error
+
+	closeAll := func() error {
+		var errs []error
+
+		for _, c := range closers {
+			errs = append(errs, c())
+		}
+
+		return errors.Join(errs...)
+	}
+
+	defer func() {
+		if err != nil {
+			closeAll()
+		}
+	}()
+
+	keyMaterial, closeKey, err := loadTenantMaterial(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	closers = append(closers, closeKey)
+
+	if err = startupCheck("tenant "+cfg.Name, keyMaterial.Current(), cfg.ServerNames); err != nil {
+		return nil, nil, err
+	}
+
+	t := &tenant.Tenant{
+		Name:        cfg.Name,
+		ServerNames: cfg.ServerNames,
+		TokenPrefix: cfg.TokenPrefix,
+		PKI:         keyMaterial,
+	}
+
+	authenticator, err := newAuthenticator(cfg.AuthMode, cfg.AuthToken, cfg.AuthTokensFile, cfg.Kubeconfig)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if store, ok := authenticator.(*auth.Store); ok && cfg.TokenPrefix != "" {
+		if err = store.RequirePrefix(cfg.TokenPrefix); err != nil {
+			return nil, nil, fmt.Errorf("tokens of a tenant with tokenPrefix: %w", err)
+		}
+	}
+
+	t.Authenticator = authenticator
+
+	reg := &registrator.Registrator{
+		AuthToken: cfg.AuthToken,
+		Tenant:    cfg.Name,
+		PKI:       keyMaterial,
+		OmitChain: base.OmitChain,
+
+		PeerIPVerification: base.PeerIPVerification,
+		PeerIPAllowedCIDRs: base.PeerIPAllowedCIDRs,
+		Policy:             base.Policy,
+		Lifetime:           base.Lifetime,
+	}
+
+	if cfg.CSRPolicy != "" {
+		if reg.Policy, err = policy.Load(cfg.CSRPolicy); err != nil {
+			return nil, nil, fmt.Errorf("failed to load CSR policy: %w", err)
+		}
+	}
+
+	if err = validateTenantClientAuth(cfg, reg.Policy, clientAuth); err != nil {
+		return nil, nil, err
+	}
+
+	if cfg.Vault != nil {
+		if reg.Backend, err = vault.New(*cfg.Vault); err != nil {
+			return nil, nil, fmt.Errorf("invalid Vault configuration: %w", err)
+		}
+	}
+
+	if cfg.SignerPlugin != nil {
+		backend, err := plugin.New(*cfg.SignerPlugin)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		closers = append(closers, backend.Close)
+		reg.Backend = backend
+	}
+
+	if cfg.Ledger != "" {
+		if reg.Ledger, err = ledger.Open(cfg.Ledger); err != nil {
+			return nil, nil, err
+		}
+
+		closers = append(closers, reg.Ledger.Close)
+	}
+
+	t.Registrator = reg
+
+	return t, closeAll, nil
+}
+
+// validateTenantClientAuth checks that the clients of a tenant can present
+// the client certificates required by clientAuth and its CSR policy.
+//
+// A tenant only trusts client certificates issued by its own clientCAs,
+// also when it is reached by token prefix and the certificate was verified
+// by --client-cas.
+func validateTenantClientAuth(cfg *tenant.Config, pol *policy.Policy, clientAuth tlsconfig.ClientAuth) error {
+	if pol.RequiresClientCertificate() {
+		switch {
+		case clientAuth == tlsconfig.ClientAuthNone:
+			return fmt.Errorf("the CSR policy requires client certificates, which --client-auth=none doesn't ask for")
+		case cfg.ClientCAs == "":
+			return fmt.Errorf("the CSR policy requires client certificates, which requires clientCAs")
+		}
+	}
+
+	if clientAuth != tlsconfig.ClientAuthRequireAndVerify {
+		return nil
+	}
+
+	switch {
+	case len(cfg.ServerNames) > 0 && cfg.ClientCAs == "":
+		return fmt.Errorf("--client-auth=%s requires clientCAs", clientAuth)
+	case cfg.TokenPrefix != "" && *clientCAs == "":
+		return fmt.Errorf("--client-auth=%s requires --client-cas for clients routed by tokenPrefix", clientAuth)
+	}
+
+	return nil
+}
+
+// loadTenantMaterial loads the key material of a tenant. The returned closer
+// releases the tenant's PKCS#11 session.
+func loadTenantMaterial(cfg *tenant.Config) (_ *pki.Store, _ func() error, err error) {
+	var caSigner crypto.Signer
+
+	closeKey := func() error { return nil }
+
+	if cfg.PKCS11 != nil {
+		signer, err := pkcs11.Open(*cfg.PKCS11)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to open the PKCS#11 CA key: %w", err)
+		}
+
+		caSigner, closeKey = signer, signer.Close
+
+		defer func() {
+			if err != nil {
+				closeKey()
+			}
+		}()
+	}
+
+	caKeyFile := cfg.CAKey
+	if cfg.CAKeyPassphrase != "" {
+		if caSigner, err = decryptCAKey(cfg.CAKey, cfg.CAKeyPassphrase); err != nil {
+			return nil, nil, err
+		}
+
+		caKeyFile = ""
+	}
+
+	keyMaterial, err := pki.Load(pki.Files{
+		CACert:           cfg.CACert,
+		CAKey:            caKeyFile,
+		Signer:           caSigner,
+		CAChain:          cfg.CAChain,
+		CADir:            cfg.CADir,
+		AcceptedCAs:      cfg.AcceptedCAs,
+		ServerCert:       cfg.ServerCert,
+		ServerKey:        cfg.ServerKey,
+		IncludeSigningCA: cfg.IncludeSigningCA,
+		ClientCAs:        cfg.ClientCAs,
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load key material: %w", err)
+	}
+
+	return keyMaterial, closeKey, nil
+}